@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"object-storage-server/auth"
+	"object-storage-server/config"
+	"object-storage-server/database"
+)
+
+const apiKeyUsage = `Usage: object-storage-server apikey <command> [options]
+
+Commands:
+  create -name <name> -scopes <scope,...>   Create a key and print it once
+  list                                      List keys
+  revoke <id>                               Revoke a key
+  s3-credentials <id>                       Print the key's S3 access key ID and secret
+
+Scopes: %s
+
+The server holds a lock on the database while it runs, so use the
+/api/admin/keys endpoints instead of this command on a running server.
+`
+
+// runAPIKeyCommand manages API keys from the command line and
+// returns the process exit code
+func runAPIKeyCommand(cfg *config.Config, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, apiKeyUsage, strings.Join(auth.Scopes, ", "))
+		return 2
+	}
+
+	db, err := database.Open(cfg.DatabasePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to open metadata database:", err)
+		return 1
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		name := fs.String("name", "", "name identifying the key owner")
+		scopes := fs.String("scopes", "", "comma separated scopes")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if *name == "" {
+			fmt.Fprintln(os.Stderr, "-name is required")
+			return 2
+		}
+
+		var scopeList []string
+		for _, scope := range strings.Split(*scopes, ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				scopeList = append(scopeList, scope)
+			}
+		}
+
+		key, rec, err := auth.CreateKey(db, *name, scopeList)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to create API key:", err)
+			return 1
+		}
+		fmt.Printf("Created API key %s (%s) with scopes %s\n", rec.ID, rec.Name, strings.Join(rec.Scopes, ","))
+		fmt.Println("Store it now, it cannot be shown again:")
+		fmt.Println(key)
+		if err := printS3Credentials(cfg, db, rec); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to derive S3 credentials:", err)
+			return 1
+		}
+
+	case "list":
+		keys, err := db.ListAPIKeys()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to list API keys:", err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPES\tCREATED\tREVOKED")
+		for _, key := range keys {
+			revoked := "-"
+			if key.RevokedAt != nil {
+				revoked = key.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, strings.Join(key.Scopes, ","), key.CreatedAt.Format(time.RFC3339), revoked)
+		}
+		w.Flush()
+
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "Usage: object-storage-server apikey revoke <id>")
+			return 2
+		}
+		if err := auth.RevokeKey(db, args[1]); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to revoke API key:", err)
+			return 1
+		}
+		fmt.Println("Revoked API key", args[1])
+
+	case "s3-credentials":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "Usage: object-storage-server apikey s3-credentials <id>")
+			return 2
+		}
+		rec, err := db.GetAPIKey(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to load API key:", err)
+			return 1
+		}
+		if err := printS3Credentials(cfg, db, rec); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to derive S3 credentials:", err)
+			return 1
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, apiKeyUsage, strings.Join(auth.Scopes, ", "))
+		return 2
+	}
+	return 0
+}
+
+// printS3Credentials prints the SigV4 credentials of rec for the S3 endpoint
+func printS3Credentials(cfg *config.Config, db *database.DB, rec *database.APIKeyRecord) error {
+	secret, err := auth.LoadSigningSecret(db, cfg.SigningSecret)
+	if err != nil {
+		return err
+	}
+	accessKey, secretKey := auth.NewSigner(secret).S3Credentials(rec)
+	fmt.Println("S3 credentials (change when the signing secret changes):")
+	fmt.Println("  aws_access_key_id     =", accessKey)
+	fmt.Println("  aws_secret_access_key =", secretKey)
+	return nil
+}
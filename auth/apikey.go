@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"object-storage-server/database"
+)
+
+// Scopes that can be granted to an API key
+const (
+	ScopeUpload = "upload"
+	ScopeRead   = "read"
+	ScopeDelete = "delete"
+	ScopeAdmin  = "admin" // Grants every other scope and key management
+)
+
+// Scopes lists every valid scope
+var Scopes = []string{ScopeUpload, ScopeRead, ScopeDelete, ScopeAdmin}
+
+// keyPrefix marks strings that look like API keys issued by this server
+const keyPrefix = "osk_"
+
+// ErrInvalidKey is returned for unknown, malformed or revoked keys
+var ErrInvalidKey = errors.New("invalid API key")
+
+// ValidScope reports whether scope is one of Scopes
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether key grants scope. Admin keys grant every scope.
+func HasScope(key *database.APIKeyRecord, scope string) bool {
+	for _, s := range key.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateKey generates a new API key with the given name and scopes and
+// stores its hash in db. The returned secret is the only copy of the key.
+func CreateKey(db *database.DB, name string, scopes []string) (string, *database.APIKeyRecord, error) {
+	if len(scopes) == 0 {
+		return "", nil, errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !ValidScope(scope) {
+			return "", nil, fmt.Errorf("unknown scope %q (valid: %s)", scope, strings.Join(Scopes, ", "))
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The ID is part of the key so lookups do not need to scan every key
+	key := keyPrefix + id + "_" + secret
+	rec := &database.APIKeyRecord{
+		ID:        id,
+		Name:      name,
+		Hash:      hashKey(key),
+		Prefix:    keyPrefix + id,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+	if err := db.PutAPIKey(rec); err != nil {
+		return "", nil, fmt.Errorf("failed to store API key: %w", err)
+	}
+	return key, rec, nil
+}
+
+// RevokeKey marks the key as revoked so it can no longer authenticate
+func RevokeKey(db *database.DB, id string) error {
+	return db.UpdateAPIKey(id, func(rec *database.APIKeyRecord) error {
+		if rec.RevokedAt == nil {
+			now := time.Now()
+			rec.RevokedAt = &now
+		}
+		return nil
+	})
+}
+
+// Authenticate returns the stored record of key, or ErrInvalidKey
+func Authenticate(db *database.DB, key string) (*database.APIKeyRecord, error) {
+	id, _, ok := strings.Cut(strings.TrimPrefix(key, keyPrefix), "_")
+	if !ok || !strings.HasPrefix(key, keyPrefix) {
+		return nil, ErrInvalidKey
+	}
+
+	rec, err := db.GetAPIKey(id)
+	if errors.Is(err, database.ErrNotFound) {
+		return nil, ErrInvalidKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(rec.Hash), []byte(hashKey(key))) != 1 || rec.RevokedAt != nil {
+		return nil, ErrInvalidKey
+	}
+	return rec, nil
+}
+
+// hashKey returns the hex SHA-256 of key. Keys are long random strings,
+// so a fast hash is enough to keep them unrecoverable from the store.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns n random bytes encoded as hex
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
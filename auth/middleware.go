@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"object-storage-server/database"
+	"object-storage-server/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// localsKey is the fiber.Ctx Locals key holding the authenticated key
+const localsKey = "api_key"
+
+// Authenticator checks API keys on incoming requests
+type Authenticator struct {
+	DB      *database.DB
+	Enabled bool
+}
+
+// NewAuthenticator creates an Authenticator backed by db.
+// When enabled is false every request is let through anonymously.
+func NewAuthenticator(db *database.DB, enabled bool) *Authenticator {
+	return &Authenticator{DB: db, Enabled: enabled}
+}
+
+// Middleware authenticates the request with the key from the
+// "Authorization: Bearer <key>" or "X-API-Key: <key>" header and makes it
+// available to later handlers via KeyFromContext. Requests without a key
+// continue anonymously; routes that need one are guarded by Require.
+func (a *Authenticator) Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !a.Enabled || c.Method() == fiber.MethodOptions {
+			return c.Next()
+		}
+
+		key := requestKey(c)
+		if key == "" {
+			return c.Next()
+		}
+
+		rec, err := Authenticate(a.DB, key)
+		if errors.Is(err, ErrInvalidKey) {
+			c.Set(fiber.HeaderWWWAuthenticate, "Bearer error=\"invalid_token\"")
+			return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+				Success: false,
+				Message: "Invalid API key",
+			})
+		}
+		if err != nil {
+			log.Printf("Failed to authenticate API key: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Success: false,
+				Message: "Failed to authenticate API key",
+			})
+		}
+
+		c.Locals(localsKey, rec)
+		return c.Next()
+	}
+}
+
+// Require returns a handler that only lets requests through whose key
+// grants scope. It is a no-op when authentication is disabled.
+func (a *Authenticator) Require(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !a.Enabled {
+			return c.Next()
+		}
+
+		rec := KeyFromContext(c)
+		if rec == nil {
+			c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+			return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+				Success: false,
+				Message: "API key required",
+			})
+		}
+		if !HasScope(rec, scope) {
+			return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+				Success: false,
+				Message: fmt.Sprintf("API key lacks the %q scope", scope),
+			})
+		}
+		return c.Next()
+	}
+}
+
+// KeyFromContext returns the key that authenticated the request,
+// or nil for anonymous requests
+func KeyFromContext(c *fiber.Ctx) *database.APIKeyRecord {
+	rec, _ := c.Locals(localsKey).(*database.APIKeyRecord)
+	return rec
+}
+
+// SetKey attaches a key that was authenticated by other means, such as a
+// SigV4 signature, to the request
+func SetKey(c *fiber.Ctx, rec *database.APIKeyRecord) {
+	c.Locals(localsKey, rec)
+}
+
+// requestKey extracts the API key from the request headers
+func requestKey(c *fiber.Ctx) string {
+	if bearer := c.Get(fiber.HeaderAuthorization); bearer != "" {
+		scheme, token, ok := strings.Cut(bearer, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return c.Get("X-API-Key")
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"path"
+	"strings"
+	"time"
+)
+
+// Query parameters carried by presigned upload URLs
+const (
+	ParamPolicy = "policy" // Base64url encoded JSON UploadPolicy
+)
+
+// UploadPolicy constrains uploads made with a presigned upload URL
+type UploadPolicy struct {
+	Bucket       string   `json:"bucket,omitempty"`        // Bucket uploads go to, empty for the default bucket
+	Expires      int64    `json:"expires"`                 // Unix time after which the policy is rejected
+	MaxSize      int64    `json:"max_size,omitempty"`      // Bytes, 0 for the server limit
+	ContentTypes []string `json:"content_types,omitempty"` // Allowed types, "image/*" style wildcards allowed
+	Extensions   []string `json:"extensions,omitempty"`    // Allowed extensions such as ".jpg"
+	KeyPrefix    string   `json:"key_prefix,omitempty"`    // Prepended to the generated object key
+	Visibility   string   `json:"visibility,omitempty"`    // Visibility forced on the upload
+
+	// API key that minted the policy, recorded as the uploader
+	KeyID   string `json:"key_id,omitempty"`
+	KeyName string `json:"key_name,omitempty"`
+}
+
+// AllowsExtension reports whether a file with extension ext may be uploaded
+func (p *UploadPolicy) AllowsExtension(ext string) bool {
+	if len(p.Extensions) == 0 {
+		return true
+	}
+	for _, allowed := range p.Extensions {
+		if strings.EqualFold(allowed, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsContentType reports whether a file of contentType may be uploaded
+func (p *UploadPolicy) AllowsContentType(contentType string) bool {
+	if len(p.ContentTypes) == 0 {
+		return true
+	}
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	for _, allowed := range p.ContentTypes {
+		if ok, _ := path.Match(strings.ToLower(allowed), contentType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SignPolicy encodes policy and returns the query parameters
+// that authorize uploads under it
+func (s *Signer) SignPolicy(policy *UploadPolicy) (map[string]string, error) {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(data)
+	return map[string]string{
+		ParamPolicy:    encoded,
+		ParamSignature: s.signature("upload", encoded),
+	}, nil
+}
+
+// VerifyPolicy checks the signature of an encoded policy and returns it
+// once it is known to be authentic and unexpired
+func (s *Signer) VerifyPolicy(encoded, signature string) (*UploadPolicy, error) {
+	if !s.validSignature(signature, "upload", encoded) {
+		return nil, ErrSignatureInvalid
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrSignatureInvalid
+	}
+	var policy UploadPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, ErrSignatureInvalid
+	}
+	if time.Now().After(time.Unix(policy.Expires, 0)) {
+		return nil, ErrPolicyExpired
+	}
+	return &policy, nil
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"object-storage-server/database"
+)
+
+// Query parameters carried by presigned URLs
+const (
+	ParamExpires     = "expires"     // Unix time after which the URL is rejected
+	ParamIP          = "ip"          // Client IP the URL is bound to, optional
+	ParamDisposition = "disposition" // Forced Content-Disposition, optional
+	ParamSignature   = "signature"   // Hex HMAC-SHA256 over path and the parameters above
+
+	// Hex HMAC-SHA256 over path and the transform parameters of an image URL
+	ParamTransformSignature = "tsig"
+)
+
+// Errors returned by Signer.Verify
+var (
+	ErrSignatureInvalid = errors.New("invalid signature")
+	ErrSignatureExpired = errors.New("presigned URL has expired")
+	ErrIPMismatch       = errors.New("presigned URL is bound to another IP address")
+	ErrPolicyExpired    = errors.New("upload policy has expired")
+)
+
+// PresignOptions are the constraints signed into a URL
+type PresignOptions struct {
+	Expires     time.Time
+	IP          string // Empty to allow any client
+	Disposition string // Empty to keep the endpoint's default
+}
+
+// Signer mints and verifies HMAC-signed URLs
+type Signer struct {
+	secret []byte
+}
+
+// NewSigner creates a Signer using secret as the HMAC key
+func NewSigner(secret []byte) *Signer {
+	return &Signer{secret: secret}
+}
+
+// LoadSigningSecret returns configured when set. Otherwise a random secret
+// is generated on first use and kept in db, so URLs survive restarts.
+func LoadSigningSecret(db *database.DB, configured string) ([]byte, error) {
+	if configured != "" {
+		return []byte(configured), nil
+	}
+	secret, err := db.GetOrCreateSetting("signing_secret", func() (string, error) {
+		return randomHex(32)
+	})
+	return []byte(secret), err
+}
+
+// Sign returns the query parameters that authorize a GET of path
+// under the given options
+func (s *Signer) Sign(path string, opts PresignOptions) url.Values {
+	query := url.Values{}
+	query.Set(ParamExpires, strconv.FormatInt(opts.Expires.Unix(), 10))
+	if opts.IP != "" {
+		query.Set(ParamIP, opts.IP)
+	}
+	if opts.Disposition != "" {
+		query.Set(ParamDisposition, opts.Disposition)
+	}
+	query.Set(ParamSignature, s.signature(path, query.Get(ParamExpires), opts.IP, opts.Disposition))
+	return query
+}
+
+// Verify checks the presigned parameters in query for a request of path
+// made by clientIP and returns the signed options
+func (s *Signer) Verify(path string, query func(key string) string, clientIP string) (PresignOptions, error) {
+	expires := query(ParamExpires)
+	opts := PresignOptions{IP: query(ParamIP), Disposition: query(ParamDisposition)}
+
+	if !s.validSignature(query(ParamSignature), path, expires, opts.IP, opts.Disposition) {
+		return opts, ErrSignatureInvalid
+	}
+
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return opts, ErrSignatureInvalid
+	}
+	opts.Expires = time.Unix(unix, 0)
+	if time.Now().After(opts.Expires) {
+		return opts, ErrSignatureExpired
+	}
+	if opts.IP != "" && opts.IP != clientIP {
+		return opts, ErrIPMismatch
+	}
+	return opts, nil
+}
+
+// SignTransform returns the signature authorizing the image transform
+// params (see utils.ImageTransform.Canonical) of path. Unlike presigned
+// URLs it does not expire, so that transform URLs can be embedded in pages.
+func (s *Signer) SignTransform(path, params string) string {
+	return s.signature("transform", path, params)
+}
+
+// VerifyTransform reports whether signature authorizes the image transform
+// params of path
+func (s *Signer) VerifyTransform(path, params, signature string) bool {
+	return s.validSignature(signature, "transform", path, params)
+}
+
+// validSignature reports whether signature matches the fields
+func (s *Signer) validSignature(signature string, fields ...string) bool {
+	return hmac.Equal([]byte(s.signature(fields...)), []byte(signature))
+}
+
+// signature computes the hex HMAC of the newline separated fields
+func (s *Signer) signature(fields ...string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	for i, field := range fields {
+		if i > 0 {
+			mac.Write([]byte("\n"))
+		}
+		mac.Write([]byte(field))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
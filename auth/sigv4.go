@@ -0,0 +1,377 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"object-storage-server/database"
+)
+
+// AWS Signature Version 4 constants
+const (
+	SigV4Algorithm = "AWS4-HMAC-SHA256"
+
+	// x-amz-content-sha256 values that do not carry the payload hash
+	UnsignedPayload          = "UNSIGNED-PAYLOAD"
+	StreamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	StreamingPayloadTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	StreamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	sigV4TimeFormat   = "20060102T150405Z"
+	sigV4MaxSkew      = 15 * time.Minute
+	sigV4MaxExpires   = 7 * 24 * time.Hour
+	sigV4ChunkMaxSize = 64 * 1024 * 1024
+	emptySHA256       = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// SigV4 verification errors, mapped to S3 error codes by the caller
+var (
+	ErrSigV4Malformed    = errors.New("malformed SigV4 authorization")
+	ErrSigV4UnknownKey   = errors.New("unknown access key")
+	ErrSigV4Mismatch     = errors.New("signature does not match")
+	ErrSigV4Skewed       = errors.New("request time too skewed")
+	ErrSigV4Expired      = errors.New("presigned request expired")
+	ErrSigV4ChunkInvalid = errors.New("invalid aws-chunked payload")
+)
+
+// SigV4Request is the part of an HTTP request covered by a SigV4 signature
+type SigV4Request struct {
+	Method   string
+	Path     string // Escaped request path as sent by the client
+	RawQuery string
+	Header   func(name string) string
+}
+
+// SigV4Result is a verified SigV4 request
+type SigV4Result struct {
+	Key         *database.APIKeyRecord
+	PayloadHash string // Value of x-amz-content-sha256, or UNSIGNED-PAYLOAD
+
+	// Needed to verify the signatures of aws-chunked payloads
+	signingKey []byte
+	timestamp  string
+	scope      string
+	signature  string
+}
+
+// S3Credentials returns the access key ID and secret access key S3 clients
+// use to sign requests with the given API key. The secret is derived from
+// the signing secret, so it is never stored.
+func (s *Signer) S3Credentials(key *database.APIKeyRecord) (string, string) {
+	return key.Prefix, s.signature("s3", key.ID)
+}
+
+// IsSigV4 reports whether the request carries a SigV4 Authorization header
+// or presigned query parameters
+func IsSigV4(req *SigV4Request) bool {
+	return strings.HasPrefix(req.Header("Authorization"), SigV4Algorithm+" ") ||
+		strings.Contains(req.RawQuery, "X-Amz-Signature=")
+}
+
+// VerifySigV4 checks the signature of req, from either the Authorization
+// header or presigned X-Amz-* query parameters, and returns the API key that
+// signed it. The payload itself is verified by the caller against
+// PayloadHash, or through NewChunkedReader for streaming uploads.
+func (s *Signer) VerifySigV4(db *database.DB, req *SigV4Request, now time.Time) (*SigV4Result, error) {
+	query, err := url.ParseQuery(req.RawQuery)
+	if err != nil {
+		return nil, ErrSigV4Malformed
+	}
+
+	var credential, signedHeaders, signature, timestamp, payloadHash string
+	presigned := query.Get("X-Amz-Signature") != ""
+	if presigned {
+		if query.Get("X-Amz-Algorithm") != SigV4Algorithm {
+			return nil, ErrSigV4Malformed
+		}
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		timestamp = query.Get("X-Amz-Date")
+		payloadHash = UnsignedPayload
+		query.Del("X-Amz-Signature")
+	} else {
+		header, ok := strings.CutPrefix(req.Header("Authorization"), SigV4Algorithm+" ")
+		if !ok {
+			return nil, ErrSigV4Malformed
+		}
+		for _, field := range strings.Split(header, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature = value
+			}
+		}
+		timestamp = req.Header("X-Amz-Date")
+		payloadHash = req.Header("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			payloadHash = UnsignedPayload
+		}
+	}
+
+	// Credential is <access key>/<date>/<region>/s3/aws4_request
+	accessKey, scope, _ := strings.Cut(credential, "/")
+	scopeParts := strings.Split(scope, "/")
+	if len(scopeParts) != 4 || scopeParts[2] != "s3" || scopeParts[3] != "aws4_request" ||
+		signedHeaders == "" || signature == "" {
+		return nil, ErrSigV4Malformed
+	}
+	t, err := time.Parse(sigV4TimeFormat, timestamp)
+	if err != nil || scopeParts[0] != timestamp[:8] {
+		return nil, ErrSigV4Malformed
+	}
+
+	if presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || time.Duration(expires)*time.Second > sigV4MaxExpires {
+			return nil, ErrSigV4Malformed
+		}
+		if t.Sub(now) > sigV4MaxSkew {
+			return nil, ErrSigV4Skewed
+		}
+		if now.After(t.Add(time.Duration(expires) * time.Second)) {
+			return nil, ErrSigV4Expired
+		}
+	} else if d := now.Sub(t); d > sigV4MaxSkew || d < -sigV4MaxSkew {
+		return nil, ErrSigV4Skewed
+	}
+
+	key, err := s.s3Key(db, accessKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Canonical request, see the "Signature Version 4 signing process"
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n")
+	canonical.WriteString(canonicalURI(req.Path) + "\n")
+	canonical.WriteString(canonicalQuery(query) + "\n")
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := req.Header(name)
+		canonical.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	canonical.WriteString("\n" + signedHeaders + "\n" + payloadHash)
+
+	_, secret := s.S3Credentials(key)
+	signingKey := []byte("AWS4" + secret)
+	for _, part := range scopeParts {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+
+	expected := hex.EncodeToString(hmacSHA256(signingKey, strings.Join([]string{
+		SigV4Algorithm, timestamp, scope, sha256Hex([]byte(canonical.String())),
+	}, "\n")))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, ErrSigV4Mismatch
+	}
+
+	return &SigV4Result{
+		Key:         key,
+		PayloadHash: payloadHash,
+		signingKey:  signingKey,
+		timestamp:   timestamp,
+		scope:       scope,
+		signature:   signature,
+	}, nil
+}
+
+// s3Key looks up the API key behind an access key ID ("osk_<id>")
+func (s *Signer) s3Key(db *database.DB, accessKey string) (*database.APIKeyRecord, error) {
+	id, ok := strings.CutPrefix(accessKey, keyPrefix)
+	if !ok {
+		return nil, ErrSigV4UnknownKey
+	}
+	key, err := db.GetAPIKey(id)
+	if errors.Is(err, database.ErrNotFound) || (err == nil && key.RevokedAt != nil) {
+		return nil, ErrSigV4UnknownKey
+	}
+	return key, err
+}
+
+// NewChunkedReader decodes an aws-chunked request body. For the signed
+// streaming variants every chunk signature is verified against the seed
+// signature of result; trailing headers are read and ignored.
+func NewChunkedReader(body io.Reader, result *SigV4Result) io.Reader {
+	return &chunkedReader{
+		r:         bufio.NewReader(body),
+		result:    result,
+		signed:    result.PayloadHash != StreamingUnsignedTrailer,
+		previous:  result.signature,
+		remaining: -1,
+	}
+}
+
+type chunkedReader struct {
+	r         *bufio.Reader
+	result    *SigV4Result
+	signed    bool
+	previous  string    // Signature of the previous chunk
+	signature string    // Signature of the current chunk
+	remaining int64     // Bytes left in the current chunk, -1 before a chunk header
+	hash      hash.Hash // SHA-256 of the current chunk
+	done      bool
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for !cr.done {
+		switch {
+		case cr.remaining < 0:
+			if err := cr.readHeader(); err != nil {
+				return 0, err
+			}
+			if cr.remaining == 0 {
+				// The final, empty chunk is followed by optional trailers
+				if err := cr.verifyChunk(); err != nil {
+					return 0, err
+				}
+				cr.done = true
+				if err := cr.skipTrailer(); err != nil {
+					return 0, err
+				}
+			}
+		case cr.remaining == 0:
+			var crlf [2]byte
+			if _, err := io.ReadFull(cr.r, crlf[:]); err != nil || string(crlf[:]) != "\r\n" {
+				return 0, ErrSigV4ChunkInvalid
+			}
+			if err := cr.verifyChunk(); err != nil {
+				return 0, err
+			}
+			cr.remaining = -1
+		default:
+			if int64(len(p)) > cr.remaining {
+				p = p[:cr.remaining]
+			}
+			n, err := cr.r.Read(p)
+			cr.remaining -= int64(n)
+			cr.hash.Write(p[:n])
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+// readHeader parses "<hex size>[;chunk-signature=<signature>]\r\n"
+func (cr *chunkedReader) readHeader() error {
+	line, err := cr.r.ReadString('\n')
+	if err != nil {
+		return ErrSigV4ChunkInvalid
+	}
+	sizeHex, ext, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > sigV4ChunkMaxSize {
+		return ErrSigV4ChunkInvalid
+	}
+	cr.signature, _ = strings.CutPrefix(ext, "chunk-signature=")
+	if cr.signed && cr.signature == "" {
+		return ErrSigV4ChunkInvalid
+	}
+	cr.remaining = size
+	if cr.hash == nil {
+		cr.hash = sha256.New()
+	}
+	cr.hash.Reset()
+	return nil
+}
+
+// verifyChunk checks the signature of the chunk just read, which chains
+// to the signature of the previous chunk
+func (cr *chunkedReader) verifyChunk() error {
+	if !cr.signed {
+		return nil
+	}
+	stringToSign := strings.Join([]string{
+		SigV4Algorithm + "-PAYLOAD", cr.result.timestamp, cr.result.scope,
+		cr.previous, emptySHA256, hex.EncodeToString(cr.hash.Sum(nil)),
+	}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(cr.result.signingKey, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(cr.signature)) {
+		return ErrSigV4Mismatch
+	}
+	cr.previous = cr.signature
+	return nil
+}
+
+// skipTrailer reads trailing headers up to the final empty line
+func (cr *chunkedReader) skipTrailer() error {
+	for {
+		line, err := cr.r.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == "" {
+			return nil
+		}
+		if err != nil {
+			return ErrSigV4ChunkInvalid
+		}
+	}
+}
+
+// canonicalURI re-encodes a request path the way SigV4 clients do for S3:
+// every byte except unreserved characters and "/" is percent-encoded once
+func canonicalURI(path string) string {
+	if decoded, err := url.PathUnescape(path); err == nil {
+		path = decoded
+	}
+	if path == "" {
+		return "/"
+	}
+	return uriEncode(path, false)
+}
+
+// canonicalQuery sorts and encodes the query parameters
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes s per RFC 3986, keeping "/" unless encodeSlash
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+
+	"object-storage-server/database"
+)
+
+func TestCanonicalURI(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/s3/default/photo.jpg", "/s3/default/photo.jpg"},
+		{"/s3/default/a%20b.txt", "/s3/default/a%20b.txt"},
+		{"/s3/default/a b.txt", "/s3/default/a%20b.txt"},
+		{"/s3/default/a+b.txt", "/s3/default/a%2Bb.txt"},
+		{"/s3/default/a%2Bb.txt", "/s3/default/a%2Bb.txt"},
+		{"/s3/default/dir/%E2%82%AC.txt", "/s3/default/dir/%E2%82%AC.txt"},
+		{"/s3/default/~user/file-1_2.txt", "/s3/default/~user/file-1_2.txt"},
+		{"/s3/default/a%2Fb", "/s3/default/a/b"},
+	}
+	for _, tt := range tests {
+		if got := canonicalURI(tt.path); got != tt.want {
+			t.Errorf("canonicalURI(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"", ""},
+		{"uploads", "uploads="},
+		{"prefix=photos/&list-type=2", "list-type=2&prefix=photos%2F"},
+		{"b=2&a=1&a=0", "a=0&a=1&b=2"},
+		{"key=a+b", "key=a%20b"},
+		{"key=a%2Bb&marker=%E2%82%AC", "key=a%2Bb&marker=%E2%82%AC"},
+		{"x-id=PutObject&partNumber=1&uploadId=abc~1", "partNumber=1&uploadId=abc~1&x-id=PutObject"},
+	}
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := canonicalQuery(query); got != tt.want {
+			t.Errorf("canonicalQuery(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestVerifySigV4(t *testing.T) {
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	signer := NewSigner([]byte("test-secret"))
+	_, key, err := CreateKey(db, "s3", []string{ScopeUpload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, revoked, err := CreateKey(db, "revoked", []string{ScopeUpload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeKey(db, revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	accessKey, secretKey := signer.S3Credentials(key)
+	revokedAccess, revokedSecret := signer.S3Credentials(revoked)
+
+	// Requests are signed by the AWS SDK so the canonical request is
+	// checked against an independent implementation
+	sign := func(method, target, body, access, secret string, presign time.Duration, at time.Time) *http.Request {
+		req, err := http.NewRequest(method, "http://localhost:3000"+target, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		// S3 clients sign the path as sent, without escaping it again
+		s := v4.NewSigner(credentials.NewStaticCredentials(access, secret, ""), func(s *v4.Signer) {
+			s.DisableURIPathEscaping = true
+		})
+		if presign > 0 {
+			_, err = s.Presign(req, strings.NewReader(body), "s3", "us-east-1", presign, at)
+		} else {
+			_, err = s.Sign(req, strings.NewReader(body), "s3", "us-east-1", at)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		mutate func(req *http.Request)
+		now    time.Time
+		want   error
+	}{
+		{name: "get", req: sign("GET", "/s3/default/photo.jpg", "", accessKey, secretKey, 0, now)},
+		{name: "put with payload", req: sign("PUT", "/s3/default/docs/a.txt", "hello", accessKey, secretKey, 0, now)},
+		{name: "escaped key", req: sign("PUT", "/s3/default/dir/a%20b%2Bc%E2%82%AC.txt", "x", accessKey, secretKey, 0, now)},
+		{name: "query", req: sign("GET", "/s3/default?list-type=2&prefix=photos%2F&max-keys=10", "", accessKey, secretKey, 0, now)},
+		{name: "presigned", req: sign("GET", "/s3/default/photo.jpg", "", accessKey, secretKey, time.Hour, now)},
+		{name: "presigned within expiry", req: sign("GET", "/s3/default/photo.jpg", "", accessKey, secretKey, time.Hour, now), now: now.Add(59 * time.Minute)},
+		{
+			name:   "tampered path",
+			req:    sign("GET", "/s3/default/photo.jpg", "", accessKey, secretKey, 0, now),
+			mutate: func(req *http.Request) { req.URL.Path = "/s3/default/other.jpg" },
+			want:   ErrSigV4Mismatch,
+		},
+		{
+			name:   "tampered query",
+			req:    sign("GET", "/s3/default?prefix=a", "", accessKey, secretKey, 0, now),
+			mutate: func(req *http.Request) { req.URL.RawQuery = "prefix=b" },
+			want:   ErrSigV4Mismatch,
+		},
+		{
+			name:   "tampered signed header",
+			req:    sign("PUT", "/s3/default/a.txt", "x", accessKey, secretKey, 0, now),
+			mutate: func(req *http.Request) { req.Header.Set("X-Amz-Content-Sha256", emptySHA256) },
+			want:   ErrSigV4Mismatch,
+		},
+		{name: "wrong secret", req: sign("GET", "/s3/default/a.txt", "", accessKey, "wrong", 0, now), want: ErrSigV4Mismatch},
+		{name: "unknown key", req: sign("GET", "/s3/default/a.txt", "", "osk_0000000000000000", secretKey, 0, now), want: ErrSigV4UnknownKey},
+		{name: "revoked key", req: sign("GET", "/s3/default/a.txt", "", revokedAccess, revokedSecret, 0, now), want: ErrSigV4UnknownKey},
+		{name: "skewed", req: sign("GET", "/s3/default/a.txt", "", accessKey, secretKey, 0, now), now: now.Add(16 * time.Minute), want: ErrSigV4Skewed},
+		{name: "presigned expired", req: sign("GET", "/s3/default/a.txt", "", accessKey, secretKey, time.Hour, now), now: now.Add(61 * time.Minute), want: ErrSigV4Expired},
+		{name: "presigned too long", req: sign("GET", "/s3/default/a.txt", "", accessKey, secretKey, 8*24*time.Hour, now), want: ErrSigV4Malformed},
+		{
+			name:   "malformed credential",
+			req:    sign("GET", "/s3/default/a.txt", "", accessKey, secretKey, 0, now),
+			mutate: func(req *http.Request) { req.Header.Set("Authorization", SigV4Algorithm+" Credential=x, Signature=y") },
+			want:   ErrSigV4Malformed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mutate != nil {
+				tt.mutate(tt.req)
+			}
+			at := tt.now
+			if at.IsZero() {
+				at = now
+			}
+			req := &SigV4Request{
+				Method:   tt.req.Method,
+				Path:     tt.req.URL.EscapedPath(),
+				RawQuery: tt.req.URL.RawQuery,
+				Header: func(name string) string {
+					if strings.EqualFold(name, "host") {
+						return tt.req.URL.Host
+					}
+					return tt.req.Header.Get(name)
+				},
+			}
+			if !IsSigV4(req) {
+				t.Fatal("IsSigV4 = false")
+			}
+			result, err := signer.VerifySigV4(db, req, at)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("VerifySigV4 error = %v, want %v", err, tt.want)
+			}
+			if tt.want == nil && result.Key.ID != key.ID {
+				t.Errorf("VerifySigV4 key = %s, want %s", result.Key.ID, key.ID)
+			}
+		})
+	}
+}
+
+// chunkedResult returns the seed of the streaming PUT example from the AWS
+// documentation ("Signature Calculations for the Authorization Header:
+// Transferring Payload in Multiple Chunks")
+func chunkedResult() *SigV4Result {
+	scope := "20130524/us-east-1/s3/aws4_request"
+	signingKey := []byte("AWS4wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY")
+	for _, part := range strings.Split(scope, "/") {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	return &SigV4Result{
+		PayloadHash: StreamingPayload,
+		signingKey:  signingKey,
+		timestamp:   "20130524T000000Z",
+		scope:       scope,
+		signature:   "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9",
+	}
+}
+
+func TestChunkedReader(t *testing.T) {
+	chunk1 := strings.Repeat("a", 65536)
+	chunk2 := strings.Repeat("a", 1024)
+	valid := "10000;chunk-signature=ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648\r\n" + chunk1 + "\r\n" +
+		"400;chunk-signature=0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497\r\n" + chunk2 + "\r\n" +
+		"0;chunk-signature=b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9\r\n\r\n"
+
+	tests := []struct {
+		name    string
+		body    string
+		payload string // PayloadHash, defaults to the signed streaming variant
+		want    string
+		err     error
+	}{
+		{name: "valid", body: valid, want: chunk1 + chunk2},
+		{
+			name: "tampered data",
+			body: strings.Replace(valid, "aaaa\r\n400;", "aaab\r\n400;", 1),
+			err:  ErrSigV4Mismatch,
+		},
+		{
+			name: "tampered signature",
+			body: strings.Replace(valid, "0055627c", "1055627c", 1),
+			err:  ErrSigV4Mismatch,
+		},
+		{
+			name: "reordered chunks",
+			body: "400;chunk-signature=0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497\r\n" + chunk2 + "\r\n",
+			err:  ErrSigV4Mismatch,
+		},
+		{
+			name: "missing final chunk",
+			body: strings.TrimSuffix(valid, "0;chunk-signature=b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9\r\n\r\n"),
+			err:  ErrSigV4ChunkInvalid,
+		},
+		{name: "missing signature", body: "5\r\nhello\r\n0\r\n\r\n", err: ErrSigV4ChunkInvalid},
+		{name: "bad size", body: "zz;chunk-signature=00\r\nhello\r\n", err: ErrSigV4ChunkInvalid},
+		{name: "oversized chunk", body: "4000001;chunk-signature=00\r\n", err: ErrSigV4ChunkInvalid},
+		{
+			name: "missing crlf",
+			body: "10000;chunk-signature=ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648\r\n" + chunk1 + "xx",
+			err:  ErrSigV4ChunkInvalid,
+		},
+		{name: "truncated data", body: "10000;chunk-signature=ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648\r\naaa", err: io.ErrUnexpectedEOF},
+		{
+			name:    "unsigned with trailer",
+			body:    "5\r\nhello\r\n6\r\n world\r\n0\r\nx-amz-checksum-crc32:AAAAAA==\r\n\r\n",
+			payload: StreamingUnsignedTrailer,
+			want:    "hello world",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := chunkedResult()
+			if tt.payload != "" {
+				result.PayloadHash = tt.payload
+			}
+			got, err := io.ReadAll(NewChunkedReader(strings.NewReader(tt.body), result))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && string(got) != tt.want {
+				t.Errorf("decoded %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
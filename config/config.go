@@ -2,7 +2,10 @@ package config
 
 import (
 	"os"
+	"runtime"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -11,6 +14,89 @@ type Config struct {
 	MaxFileSize  int64
 	AllowedHosts string
 	BaseURL      string
+
+	// Server-wide upload rules, applied to every bucket. Type entries are
+	// extensions (".pdf") or content types ("image/*").
+	AllowedTypes     []string         // Empty allows all
+	DeniedTypes      []string         // Checked before AllowedTypes
+	MaxSizeByType    map[string]int64 // Bytes by type entry
+	MaxImageWidth    int              // Pixels, 0 for no limit
+	MaxImageHeight   int              // Pixels, 0 for no limit
+	MaxVideoDuration time.Duration    // 0 for no limit, needs ffprobe
+
+	// Require API keys on /api routes
+	AuthEnabled bool
+
+	// Presigned URLs
+	SigningSecret     string        // HMAC key, generated and stored in the database when empty
+	PresignMaxExpiry  time.Duration // Longest lifetime a presigned URL may be given
+	DefaultVisibility string        // "public" or "private" for uploads that do not choose
+
+	// What an upload with a client chosen key does when the key is taken:
+	// "reject" (409), "overwrite" or "rename" (appends -1, -2, ...)
+	KeyConflictPolicy string
+
+	// What an upload whose content does not match its extension (an
+	// executable named .jpg) does: "reject" (415) or "normalize" (generated
+	// names get the extension of the detected type)
+	ContentTypeMismatch string
+
+	// Multipart uploads untouched for this long are aborted and their parts removed
+	MultipartUploadExpiry time.Duration
+
+	// Path of the embedded metadata database file
+	DatabasePath string
+
+	// Scan storage on startup and enqueue originals missing renditions
+	ReconcileOnStartup bool
+
+	// Finished job records older than this are removed, 0 keeps them forever
+	JobRetention time.Duration
+
+	// Background processing
+	WorkerCount      int           // Max concurrent processing jobs
+	JobQueueSize     int           // Jobs that may wait for a worker
+	JobSubmitTimeout time.Duration // How long an upload waits for a queue slot
+	QueueFullPolicy  string        // "reject" (503) or "defer" when the queue is full
+	QueueRetryAfter  int           // Retry-After seconds sent with 503 responses
+
+	// Graceful shutdown
+	ShutdownTimeout time.Duration // How long in-flight requests may take to finish
+	JobDrainTimeout time.Duration // How long workers may keep draining the job queue
+
+	// Bucket name served by the S3-compatible endpoint at /s3
+	S3APIBucket string
+
+	// Storage backend: "local" (default), "memory" or "s3"
+	StorageDriver string
+
+	// Store identical uploads and renditions once, as SHA-256 addressed blobs
+	Deduplication bool
+
+	// On-the-fly image transforms (/api/img)
+	ImageCacheDir              string   // Transformed images, keyed by object and parameters
+	ImageCacheMaxSize          int64    // Bytes the cache may hold before the least recently used entries are evicted, 0 for no limit
+	ImageTransformSigned       bool     // Only serve transform URLs signed with POST /api/img/sign
+	ImageTransformSizes        []string // "WxH" or "WxH:fit" sizes unsigned URLs may ask for, empty refuses unsigned transforms
+	ImageTransformQualities    []string // Qualities unsigned URLs may ask for besides the default
+	ImageTransformFormats      []string // Formats unsigned URLs may convert to besides the source format
+	ImageTransformMaxDimension int      // Largest width or height in pixels
+	ImageTransformConcurrency  int      // Transforms running at the same time
+
+	// Extra formats ("webp", "avif") stored next to each image rendition
+	RenditionFormats []string
+
+	// Remove EXIF, XMP and other metadata (except the colour profile) from uploaded images
+	StripImageMetadata bool
+
+	// S3-compatible backend settings (used when StorageDriver is "s3")
+	S3Endpoint       string
+	S3Region         string
+	S3Bucket         string
+	S3AccessKey      string
+	S3SecretKey      string
+	S3Prefix         string
+	S3ForcePathStyle bool
 }
 
 func LoadConfig() *Config {
@@ -32,6 +118,31 @@ func LoadConfig() *Config {
 		}
 	}
 
+	// Per-type limits as "image/*=20971520,video/*=4294967296"
+	maxSizeByType := make(map[string]int64)
+	for _, entry := range splitList(os.Getenv("MAX_SIZE_BY_TYPE")) {
+		pattern, size, _ := strings.Cut(entry, "=")
+		pattern = strings.TrimSpace(pattern)
+		if n, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64); err == nil && n > 0 && validTypeEntry(pattern) {
+			maxSizeByType[pattern] = n
+		}
+	}
+
+	maxImageWidth := 0
+	if v, err := strconv.Atoi(os.Getenv("MAX_IMAGE_WIDTH")); err == nil && v > 0 {
+		maxImageWidth = v
+	}
+
+	maxImageHeight := 0
+	if v, err := strconv.Atoi(os.Getenv("MAX_IMAGE_HEIGHT")); err == nil && v > 0 {
+		maxImageHeight = v
+	}
+
+	var maxVideoDuration time.Duration
+	if v, err := time.ParseDuration(os.Getenv("MAX_VIDEO_DURATION")); err == nil && v > 0 {
+		maxVideoDuration = v
+	}
+
 	allowedHosts := os.Getenv("ALLOWED_HOSTS")
 	if allowedHosts == "" {
 		allowedHosts = "*"
@@ -42,11 +153,248 @@ func LoadConfig() *Config {
 		baseURL = "http://localhost:" + port
 	}
 
+	authEnabled := false
+	if v := os.Getenv("AUTH_ENABLED"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			authEnabled = b
+		}
+	}
+
+	presignMaxExpiry := 7 * 24 * time.Hour
+	if v, err := time.ParseDuration(os.Getenv("PRESIGN_MAX_EXPIRY")); err == nil && v > 0 {
+		presignMaxExpiry = v
+	}
+
+	// Objects are private by default once API keys are required
+	defaultVisibility := os.Getenv("DEFAULT_VISIBILITY")
+	if defaultVisibility != "public" && defaultVisibility != "private" {
+		defaultVisibility = "public"
+		if authEnabled {
+			defaultVisibility = "private"
+		}
+	}
+
+	keyConflictPolicy := os.Getenv("KEY_CONFLICT_POLICY")
+	if keyConflictPolicy != "overwrite" && keyConflictPolicy != "rename" {
+		keyConflictPolicy = "reject"
+	}
+
+	contentTypeMismatch := os.Getenv("CONTENT_TYPE_MISMATCH")
+	if contentTypeMismatch != "normalize" {
+		contentTypeMismatch = "reject"
+	}
+
+	multipartUploadExpiry := 24 * time.Hour
+	if v, err := time.ParseDuration(os.Getenv("MULTIPART_UPLOAD_EXPIRY")); err == nil && v > 0 {
+		multipartUploadExpiry = v
+	}
+
+	databasePath := os.Getenv("DATABASE_PATH")
+	if databasePath == "" {
+		databasePath = "./data/metadata.db"
+	}
+
+	reconcileOnStartup := true
+	if v := os.Getenv("RECONCILE_ON_STARTUP"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			reconcileOnStartup = b
+		}
+	}
+
+	jobRetention := 7 * 24 * time.Hour
+	if v, err := time.ParseDuration(os.Getenv("JOB_RETENTION")); err == nil && v >= 0 {
+		jobRetention = v
+	}
+
+	workerCount := 4
+	if v, err := strconv.Atoi(os.Getenv("WORKER_COUNT")); err == nil && v > 0 {
+		workerCount = v
+	}
+
+	jobQueueSize := 100
+	if v, err := strconv.Atoi(os.Getenv("JOB_QUEUE_SIZE")); err == nil && v >= 0 {
+		jobQueueSize = v
+	}
+
+	jobSubmitTimeout := 2 * time.Second
+	if v, err := time.ParseDuration(os.Getenv("JOB_SUBMIT_TIMEOUT")); err == nil && v >= 0 {
+		jobSubmitTimeout = v
+	}
+
+	queueFullPolicy := os.Getenv("QUEUE_FULL_POLICY")
+	if queueFullPolicy != "defer" {
+		queueFullPolicy = "reject"
+	}
+
+	queueRetryAfter := 30
+	if v, err := strconv.Atoi(os.Getenv("QUEUE_RETRY_AFTER")); err == nil && v > 0 {
+		queueRetryAfter = v
+	}
+
+	shutdownTimeout := 30 * time.Second
+	if v, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil && v >= 0 {
+		shutdownTimeout = v
+	}
+
+	jobDrainTimeout := 10 * time.Second
+	if v, err := time.ParseDuration(os.Getenv("JOB_DRAIN_TIMEOUT")); err == nil && v >= 0 {
+		jobDrainTimeout = v
+	}
+
+	s3APIBucket := os.Getenv("S3_API_BUCKET")
+	if s3APIBucket == "" {
+		s3APIBucket = "default"
+	}
+
+	storageDriver := os.Getenv("STORAGE_DRIVER")
+	if storageDriver == "" {
+		storageDriver = "local"
+	}
+
+	deduplication := false
+	if v := os.Getenv("DEDUPLICATION"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			deduplication = b
+		}
+	}
+
+	imageCacheDir := os.Getenv("IMAGE_CACHE_DIR")
+	if imageCacheDir == "" {
+		imageCacheDir = "./cache/images"
+	}
+
+	imageCacheMaxSize := int64(1024 * 1024 * 1024) // 1GB
+	if v, err := strconv.ParseInt(os.Getenv("IMAGE_CACHE_MAX_SIZE"), 10, 64); err == nil && v >= 0 {
+		imageCacheMaxSize = v
+	}
+
+	imageTransformSigned := false
+	if v := os.Getenv("IMAGE_TRANSFORM_SIGNED"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			imageTransformSigned = b
+		}
+	}
+
+	imageTransformMaxDimension := 4096
+	if v, err := strconv.Atoi(os.Getenv("IMAGE_TRANSFORM_MAX_DIMENSION")); err == nil && v > 0 {
+		imageTransformMaxDimension = v
+	}
+
+	imageTransformConcurrency := runtime.NumCPU()
+	if v, err := strconv.Atoi(os.Getenv("IMAGE_TRANSFORM_CONCURRENCY")); err == nil && v > 0 {
+		imageTransformConcurrency = v
+	}
+
+	stripImageMetadata := false
+	if v := os.Getenv("STRIP_IMAGE_METADATA"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			stripImageMetadata = b
+		}
+	}
+
+	s3Region := os.Getenv("S3_REGION")
+	if s3Region == "" {
+		s3Region = "us-east-1"
+	}
+
+	// Path-style addressing is on by default because MinIO requires it
+	s3ForcePathStyle := true
+	if v := os.Getenv("S3_FORCE_PATH_STYLE"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			s3ForcePathStyle = b
+		}
+	}
+
 	return &Config{
 		ServerPort:   port,
 		UploadDir:    uploadDir,
 		MaxFileSize:  maxFileSize,
 		AllowedHosts: allowedHosts,
 		BaseURL:      baseURL,
+
+		AllowedTypes:     validTypeEntries(splitList(os.Getenv("ALLOWED_TYPES"))),
+		DeniedTypes:      validTypeEntries(splitList(os.Getenv("DENIED_TYPES"))),
+		MaxSizeByType:    maxSizeByType,
+		MaxImageWidth:    maxImageWidth,
+		MaxImageHeight:   maxImageHeight,
+		MaxVideoDuration: maxVideoDuration,
+
+		AuthEnabled: authEnabled,
+
+		SigningSecret:     os.Getenv("SIGNING_SECRET"),
+		PresignMaxExpiry:  presignMaxExpiry,
+		DefaultVisibility: defaultVisibility,
+
+		KeyConflictPolicy:   keyConflictPolicy,
+		ContentTypeMismatch: contentTypeMismatch,
+
+		MultipartUploadExpiry: multipartUploadExpiry,
+
+		DatabasePath:       databasePath,
+		ReconcileOnStartup: reconcileOnStartup,
+		JobRetention:       jobRetention,
+
+		WorkerCount:      workerCount,
+		JobQueueSize:     jobQueueSize,
+		JobSubmitTimeout: jobSubmitTimeout,
+		QueueFullPolicy:  queueFullPolicy,
+		QueueRetryAfter:  queueRetryAfter,
+
+		ShutdownTimeout: shutdownTimeout,
+		JobDrainTimeout: jobDrainTimeout,
+
+		S3APIBucket: s3APIBucket,
+
+		StorageDriver: storageDriver,
+		Deduplication: deduplication,
+
+		ImageCacheDir:              imageCacheDir,
+		ImageCacheMaxSize:          imageCacheMaxSize,
+		ImageTransformSigned:       imageTransformSigned,
+		ImageTransformSizes:        splitList(os.Getenv("IMAGE_TRANSFORM_SIZES")),
+		ImageTransformQualities:    splitList(os.Getenv("IMAGE_TRANSFORM_QUALITIES")),
+		ImageTransformFormats:      splitList(os.Getenv("IMAGE_TRANSFORM_FORMATS")),
+		ImageTransformMaxDimension: imageTransformMaxDimension,
+		ImageTransformConcurrency:  imageTransformConcurrency,
+
+		RenditionFormats:   splitList(os.Getenv("RENDITION_FORMATS")),
+		StripImageMetadata: stripImageMetadata,
+
+		S3Endpoint:       os.Getenv("S3_ENDPOINT"),
+		S3Region:         s3Region,
+		S3Bucket:         os.Getenv("S3_BUCKET"),
+		S3AccessKey:      os.Getenv("S3_ACCESS_KEY"),
+		S3SecretKey:      os.Getenv("S3_SECRET_KEY"),
+		S3Prefix:         os.Getenv("S3_PREFIX"),
+		S3ForcePathStyle: s3ForcePathStyle,
+	}
+}
+
+// splitList splits a comma separated list, lowercasing the entries and
+// dropping empty ones
+func splitList(s string) []string {
+	var entries []string
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			entries = append(entries, entry)
+		}
 	}
+	return entries
+}
+
+// validTypeEntries drops the entries that are neither an extension nor a content type
+func validTypeEntries(entries []string) []string {
+	var valid []string
+	for _, entry := range entries {
+		if validTypeEntry(entry) {
+			valid = append(valid, entry)
+		}
+	}
+	return valid
+}
+
+// validTypeEntry reports whether entry is an extension such as ".pdf" or a
+// content type such as "image/*"
+func validTypeEntry(entry string) bool {
+	return len(entry) >= 2 && (strings.HasPrefix(entry, ".") || strings.Contains(entry, "/"))
 }
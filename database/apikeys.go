@@ -0,0 +1,75 @@
+package database
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// APIKeyRecord is a persisted API key. Only the SHA-256 hash of the
+// secret is stored, the key itself is shown once when it is created.
+type APIKeyRecord struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash"`   // Hex SHA-256 of the full key
+	Prefix    string     `json:"prefix"` // First characters of the key, to recognize it
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// PutAPIKey creates or replaces the record for key.ID
+func (db *DB) PutAPIKey(key *APIKeyRecord) error {
+	return db.put(apiKeysBucket, key.ID, key)
+}
+
+// GetAPIKey returns the key with the given ID
+func (db *DB) GetAPIKey(id string) (*APIKeyRecord, error) {
+	var key APIKeyRecord
+	if err := db.get(apiKeysBucket, id, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// UpdateAPIKey loads the key, applies fn and saves it atomically
+func (db *DB) UpdateAPIKey(id string, fn func(key *APIKeyRecord) error) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(apiKeysBucket)
+		data := b.Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+
+		var key APIKeyRecord
+		if err := json.Unmarshal(data, &key); err != nil {
+			return err
+		}
+		if err := fn(&key); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(&key)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+}
+
+// ListAPIKeys returns all keys, including revoked ones, oldest first
+func (db *DB) ListAPIKeys() ([]APIKeyRecord, error) {
+	var keys []APIKeyRecord
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiKeysBucket).ForEach(func(k, v []byte) error {
+			var key APIKeyRecord
+			if err := json.Unmarshal(v, &key); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	return keys, err
+}
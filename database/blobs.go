@@ -0,0 +1,213 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BlobRecord is a content-addressed blob shared by every object key with
+// the same content
+type BlobRecord struct {
+	Hash      string    `json:"hash"` // Hex SHA-256 of the content
+	Key       string    `json:"key"`  // Storage key of the content
+	Size      int64     `json:"size"`
+	Refs      int       `json:"refs"` // Object keys referring to the blob
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BlobRef links an object key to the blob holding its content
+type BlobRef struct {
+	Key       string    `json:"-"`
+	Hash      string    `json:"hash"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"` // When the key was last written
+}
+
+// GetBlob returns the blob with the given hash
+func (db *DB) GetBlob(hash string) (*BlobRecord, error) {
+	var blob BlobRecord
+	if err := db.get(blobsBucket, hash, &blob); err != nil {
+		return nil, err
+	}
+	return &blob, nil
+}
+
+// GetBlobRef returns the blob reference of an object key
+func (db *DB) GetBlobRef(key string) (*BlobRef, error) {
+	var ref BlobRef
+	if err := db.get(blobRefsBucket, key, &ref); err != nil {
+		return nil, err
+	}
+	ref.Key = key
+	return &ref, nil
+}
+
+// LinkBlob points key at blob, creating the blob record on first use and
+// incrementing its reference count. When key referred to another blob
+// before, that reference is dropped and the other blob's hash is returned
+// if it has no references left.
+func (db *DB) LinkBlob(key string, blob *BlobRecord) (string, error) {
+	var orphan string
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		refs := tx.Bucket(blobRefsBucket)
+		if data := refs.Get([]byte(key)); data != nil {
+			var old BlobRef
+			if err := json.Unmarshal(data, &old); err != nil {
+				return err
+			}
+			if old.Hash != blob.Hash {
+				unreferenced, err := unlinkBlob(tx, key, old.Hash)
+				if err != nil {
+					return err
+				}
+				if unreferenced {
+					orphan = old.Hash
+				}
+			}
+		}
+
+		blobs := tx.Bucket(blobsBucket)
+		record := *blob
+		if data := blobs.Get([]byte(blob.Hash)); data != nil {
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+		}
+		index := tx.Bucket(blobKeysBucket)
+		indexKey := []byte(blob.Hash + "/" + key)
+		if index.Get(indexKey) == nil {
+			record.Refs++
+			if err := index.Put(indexKey, []byte{}); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+		if err := blobs.Put([]byte(blob.Hash), data); err != nil {
+			return err
+		}
+
+		data, err = json.Marshal(&BlobRef{Hash: blob.Hash, Size: record.Size, CreatedAt: time.Now()})
+		if err != nil {
+			return err
+		}
+		return refs.Put([]byte(key), data)
+	})
+	return orphan, err
+}
+
+// UnlinkBlob removes the blob reference of key and returns the blob's hash
+// when no references are left. It returns ErrNotFound for keys without one.
+func (db *DB) UnlinkBlob(key string) (string, error) {
+	var orphan string
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		var ref BlobRef
+		data := tx.Bucket(blobRefsBucket).Get([]byte(key))
+		if data == nil {
+			return ErrNotFound
+		}
+		if err := json.Unmarshal(data, &ref); err != nil {
+			return err
+		}
+		if err := tx.Bucket(blobRefsBucket).Delete([]byte(key)); err != nil {
+			return err
+		}
+		unreferenced, err := unlinkBlob(tx, key, ref.Hash)
+		if unreferenced {
+			orphan = ref.Hash
+		}
+		return err
+	})
+	return orphan, err
+}
+
+// unlinkBlob drops the reference of key from the blob with the given hash
+// and reports whether the blob has no references left
+func unlinkBlob(tx *bolt.Tx, key, hash string) (bool, error) {
+	if err := tx.Bucket(blobKeysBucket).Delete([]byte(hash + "/" + key)); err != nil {
+		return false, err
+	}
+
+	blobs := tx.Bucket(blobsBucket)
+	data := blobs.Get([]byte(hash))
+	if data == nil {
+		return false, nil
+	}
+	var blob BlobRecord
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return false, err
+	}
+	if blob.Refs > 0 {
+		blob.Refs--
+	}
+	data, err := json.Marshal(&blob)
+	if err != nil {
+		return false, err
+	}
+	return blob.Refs == 0, blobs.Put([]byte(hash), data)
+}
+
+// DeleteBlobIfUnreferenced removes the blob record when no key refers to it
+// anymore and reports whether it did. Blobs relinked since they became
+// unreferenced are kept.
+func (db *DB) DeleteBlobIfUnreferenced(hash string) (*BlobRecord, bool, error) {
+	var blob BlobRecord
+	deleted := false
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		blobs := tx.Bucket(blobsBucket)
+		data := blobs.Get([]byte(hash))
+		if data == nil {
+			return ErrNotFound
+		}
+		if err := json.Unmarshal(data, &blob); err != nil {
+			return err
+		}
+		if blob.Refs > 0 {
+			return nil
+		}
+		deleted = true
+		return blobs.Delete([]byte(hash))
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return &blob, deleted, nil
+}
+
+// ListBlobRefs returns the blob references of all keys starting with
+// prefix, ordered by key
+func (db *DB) ListBlobRefs(prefix string) ([]BlobRef, error) {
+	var refs []BlobRef
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(blobRefsBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			var ref BlobRef
+			if err := json.Unmarshal(v, &ref); err != nil {
+				return err
+			}
+			ref.Key = string(k)
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// BlobKeys returns the object keys referring to the blob with the given hash
+func (db *DB) BlobKeys(hash string) ([]string, error) {
+	var keys []string
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		prefix := []byte(hash + "/")
+		c := tx.Bucket(blobKeysBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, string(k[len(prefix):]))
+		}
+		return nil
+	})
+	return keys, err
+}
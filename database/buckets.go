@@ -0,0 +1,126 @@
+package database
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultBucket names the bucket served by /api/files. Its objects live at
+// the root of the store and its settings come from the configuration.
+const DefaultBucket = "default"
+
+// BucketKeyPrefix is the storage key prefix reserved for the objects of all
+// other buckets, which are stored as "_buckets/<bucket>/<key>"
+const BucketKeyPrefix = "_buckets/"
+
+// Processing profiles, selecting the renditions generated for uploads
+const (
+	ProfileFull      = "full"      // Every rendition
+	ProfileThumbnail = "thumbnail" // Only the thumbnail of images and videos
+	ProfileNone      = "none"      // Originals are stored as uploaded
+)
+
+// BucketRecord is a named namespace of objects with its own upload settings
+type BucketRecord struct {
+	Name        string `json:"name"`
+	Visibility  string `json:"visibility"`              // Visibility of uploads that do not choose
+	MaxFileSize int64  `json:"max_file_size,omitempty"` // Bytes, 0 for the server limit
+
+	// Apply on top of the server-wide rules
+	UploadRules
+
+	ProcessingProfile string    `json:"processing_profile"`
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+// ObjectKey returns the storage key of key in bucket
+func ObjectKey(bucket, key string) string {
+	if bucket == "" || bucket == DefaultBucket {
+		return key
+	}
+	return BucketKeyPrefix + bucket + "/" + key
+}
+
+// SplitObjectKey returns the bucket a storage key belongs to and the key
+// of the object within that bucket
+func SplitObjectKey(storageKey string) (string, string) {
+	if rest, ok := strings.CutPrefix(storageKey, BucketKeyPrefix); ok {
+		if bucket, key, ok := strings.Cut(rest, "/"); ok {
+			return bucket, key
+		}
+	}
+	return DefaultBucket, storageKey
+}
+
+// CreateBucket stores a new bucket, failing with ErrExists when the name is taken
+func (db *DB) CreateBucket(bucket *BucketRecord) error {
+	data, err := json.Marshal(bucket)
+	if err != nil {
+		return err
+	}
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketsBucket)
+		if b.Get([]byte(bucket.Name)) != nil {
+			return ErrExists
+		}
+		return b.Put([]byte(bucket.Name), data)
+	})
+}
+
+// GetBucket returns the bucket with the given name
+func (db *DB) GetBucket(name string) (*BucketRecord, error) {
+	var bucket BucketRecord
+	if err := db.get(bucketsBucket, name, &bucket); err != nil {
+		return nil, err
+	}
+	return &bucket, nil
+}
+
+// UpdateBucket loads the bucket, applies fn and saves it atomically
+func (db *DB) UpdateBucket(name string, fn func(bucket *BucketRecord) error) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketsBucket)
+		data := b.Get([]byte(name))
+		if data == nil {
+			return ErrNotFound
+		}
+
+		var bucket BucketRecord
+		if err := json.Unmarshal(data, &bucket); err != nil {
+			return err
+		}
+		if err := fn(&bucket); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(&bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), data)
+	})
+}
+
+// ListBuckets returns all buckets ordered by name
+func (db *DB) ListBuckets() ([]BucketRecord, error) {
+	var buckets []BucketRecord
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketsBucket).ForEach(func(k, v []byte) error {
+			var bucket BucketRecord
+			if err := json.Unmarshal(v, &bucket); err != nil {
+				return err
+			}
+			buckets = append(buckets, bucket)
+			return nil
+		})
+	})
+	return buckets, err
+}
+
+// DeleteBucket removes the bucket record. Its objects are not touched.
+func (db *DB) DeleteBucket(name string) error {
+	return db.delete(bucketsBucket, name)
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrNotFound is returned when a record does not exist
+var ErrNotFound = errors.New("record not found")
+
+// ErrExists is returned when creating a record that already exists
+var ErrExists = errors.New("record already exists")
+
+// Bucket names inside the bolt file
+var (
+	objectsBucket  = []byte("objects")
+	jobsBucket     = []byte("jobs")
+	apiKeysBucket  = []byte("api_keys")
+	settingsBucket = []byte("settings")
+	tusBucket      = []byte("tus_uploads")
+	bucketsBucket  = []byte("buckets")
+
+	blobsBucket    = []byte("blobs")
+	blobRefsBucket = []byte("blob_refs")
+	blobKeysBucket = []byte("blob_keys") // Keyed "<hash>/<object key>"
+
+	multipartBucket      = []byte("multipart_uploads")
+	multipartPartsBucket = []byte("multipart_parts") // Keyed "<upload id>/<part number>"
+)
+
+// DB is the embedded metadata store backed by a single bbolt file
+type DB struct {
+	bolt *bolt.DB
+}
+
+// Open opens (or creates) the database file at path
+func Open(path string) (*DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	b, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	err = b.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{objectsBucket, jobsBucket, apiKeysBucket, settingsBucket, tusBucket, bucketsBucket, multipartBucket, multipartPartsBucket, blobsBucket, blobRefsBucket, blobKeysBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Close()
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+
+	return &DB{bolt: b}, nil
+}
+
+// Close closes the database file
+func (db *DB) Close() error {
+	return db.bolt.Close()
+}
+
+// get decodes the JSON value stored under key in bucket into v
+func (db *DB) get(bucket []byte, key string, v interface{}) error {
+	return db.bolt.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(key))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, v)
+	})
+}
+
+// put stores v as JSON under key in bucket
+func (db *DB) put(bucket []byte, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+// delete removes key from bucket
+func (db *DB) delete(bucket []byte, key string) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b.Get([]byte(key)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(key))
+	})
+}
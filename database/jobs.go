@@ -0,0 +1,152 @@
+package database
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Job states
+const (
+	JobQueued    = "queued"
+	JobDeferred  = "deferred" // Persisted, waiting for a free queue slot
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Rendition states inside a job
+const (
+	RenditionSucceeded = "succeeded"
+	RenditionFailed    = "failed"
+	RenditionSkipped   = "skipped"
+)
+
+// JobRendition is the outcome of a single rendition of a job
+type JobRendition struct {
+	Name     string `json:"name"`
+	FileName string `json:"file_name"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// JobRecord tracks a background processing job
+type JobRecord struct {
+	ID         string         `json:"id"`
+	Type       string         `json:"type"` // "image", "video", "audio"
+	FileName   string         `json:"file_name"`
+	Profile    string         `json:"profile,omitempty"` // Processing profile, empty means ProfileFull
+	Status     string         `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	Renditions []JobRendition `json:"renditions,omitempty"`
+	QueuedAt   time.Time      `json:"queued_at"`
+	StartedAt  *time.Time     `json:"started_at,omitempty"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+}
+
+// PutJob creates or replaces the record for job.ID
+func (db *DB) PutJob(job *JobRecord) error {
+	return db.put(jobsBucket, job.ID, job)
+}
+
+// GetJob returns the job with the given ID
+func (db *DB) GetJob(id string) (*JobRecord, error) {
+	var job JobRecord
+	if err := db.get(jobsBucket, id, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// UpdateJob loads the job, applies fn and saves it atomically
+func (db *DB) UpdateJob(id string, fn func(job *JobRecord) error) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		data := b.Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+
+		var job JobRecord
+		if err := json.Unmarshal(data, &job); err != nil {
+			return err
+		}
+		if err := fn(&job); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(&job)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+}
+
+// DeleteJob removes the job record
+func (db *DB) DeleteJob(id string) error {
+	return db.delete(jobsBucket, id)
+}
+
+// ListJobs returns the jobs whose status is one of statuses, oldest first.
+// Job IDs are UUID v7, so key order is submission order.
+func (db *DB) ListJobs(statuses ...string) ([]JobRecord, error) {
+	wanted := make(map[string]bool, len(statuses))
+	for _, status := range statuses {
+		wanted[status] = true
+	}
+
+	var jobs []JobRecord
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			var job JobRecord
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			if len(wanted) == 0 || wanted[job.Status] {
+				jobs = append(jobs, job)
+			}
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// DeleteFinishedJobs removes succeeded, failed and cancelled jobs that
+// finished before cutoff and returns how many were removed
+func (db *DB) DeleteFinishedJobs(cutoff time.Time) (int, error) {
+	removed := 0
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+
+		// Keys are collected first, deleting under a cursor skips entries
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var job JobRecord
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			switch job.Status {
+			case JobSucceeded, JobFailed, JobCancelled:
+				if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+					expired = append(expired, append([]byte(nil), k...))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	return removed, err
+}
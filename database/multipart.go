@@ -0,0 +1,163 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// MultipartUploadRecord tracks an S3-style multipart upload that has been
+// initiated but not yet completed or aborted
+type MultipartUploadRecord struct {
+	ID           string `json:"id"`
+	OriginalName string `json:"original_name"`
+	ContentType  string `json:"content_type,omitempty"` // Declared by the client
+	Bucket       string `json:"bucket,omitempty"`       // Empty for the default bucket
+	Visibility   string `json:"visibility"`
+
+	// The API key that initiated the upload, the only one besides admin
+	// keys allowed to add parts to, list, complete or abort it
+	UploaderKeyID   string `json:"uploader_key_id,omitempty"`
+	UploaderKeyName string `json:"uploader_key_name,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"` // Last part received
+}
+
+// MultipartPartRecord describes one uploaded part. Uploading the same part
+// number again replaces the record.
+type MultipartPartRecord struct {
+	PartNumber   int       `json:"part_number"`
+	ETag         string    `json:"etag"` // Hex MD5 of the part, unquoted
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// multipartPartKey orders parts numerically below their upload ID
+func multipartPartKey(uploadID string, partNumber int) []byte {
+	return []byte(fmt.Sprintf("%s/%05d", uploadID, partNumber))
+}
+
+// PutMultipartUpload creates or replaces the record for upload.ID
+func (db *DB) PutMultipartUpload(upload *MultipartUploadRecord) error {
+	return db.put(multipartBucket, upload.ID, upload)
+}
+
+// GetMultipartUpload returns the multipart upload with the given ID
+func (db *DB) GetMultipartUpload(id string) (*MultipartUploadRecord, error) {
+	var upload MultipartUploadRecord
+	if err := db.get(multipartBucket, id, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// DeleteMultipartUpload removes the upload and all of its part records
+func (db *DB) DeleteMultipartUpload(id string) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(multipartBucket)
+		if b.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+
+		parts := tx.Bucket(multipartPartsBucket)
+		prefix := []byte(id + "/")
+		var keys [][]byte
+		c := parts.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := parts.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListMultipartUploads returns all multipart uploads in progress, oldest first
+func (db *DB) ListMultipartUploads() ([]MultipartUploadRecord, error) {
+	var uploads []MultipartUploadRecord
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(multipartBucket).ForEach(func(k, v []byte) error {
+			var upload MultipartUploadRecord
+			if err := json.Unmarshal(v, &upload); err != nil {
+				return err
+			}
+			uploads = append(uploads, upload)
+			return nil
+		})
+	})
+	return uploads, err
+}
+
+// PutMultipartPart records a part of upload uploadID and marks the upload
+// as active. It returns the record the part replaced, nil for a new part
+// number, or ErrNotFound when the upload no longer exists.
+func (db *DB) PutMultipartPart(uploadID string, part *MultipartPartRecord) (*MultipartPartRecord, error) {
+	data, err := json.Marshal(part)
+	if err != nil {
+		return nil, err
+	}
+	var previous *MultipartPartRecord
+	err = db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(multipartBucket)
+		raw := b.Get([]byte(uploadID))
+		if raw == nil {
+			return ErrNotFound
+		}
+
+		var upload MultipartUploadRecord
+		if err := json.Unmarshal(raw, &upload); err != nil {
+			return err
+		}
+		upload.UpdatedAt = part.LastModified
+		updated, err := json.Marshal(&upload)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(uploadID), updated); err != nil {
+			return err
+		}
+
+		parts := tx.Bucket(multipartPartsBucket)
+		key := multipartPartKey(uploadID, part.PartNumber)
+		if old := parts.Get(key); old != nil {
+			previous = &MultipartPartRecord{}
+			if err := json.Unmarshal(old, previous); err != nil {
+				return err
+			}
+		}
+		return parts.Put(key, data)
+	})
+	return previous, err
+}
+
+// ListMultipartParts returns up to limit parts of uploadID with a part
+// number above marker, ordered by part number. A limit of 0 returns all.
+func (db *DB) ListMultipartParts(uploadID string, marker, limit int) ([]MultipartPartRecord, error) {
+	var parts []MultipartPartRecord
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		prefix := []byte(uploadID + "/")
+		c := tx.Bucket(multipartPartsBucket).Cursor()
+		for k, v := c.Seek(multipartPartKey(uploadID, marker+1)); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if limit > 0 && len(parts) == limit {
+				break
+			}
+			var part MultipartPartRecord
+			if err := json.Unmarshal(v, &part); err != nil {
+				return err
+			}
+			parts = append(parts, part)
+		}
+		return nil
+	})
+	return parts, err
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Processing states of an object's renditions
+const (
+	ProcessingNone      = ""
+	ProcessingPending   = "pending"
+	ProcessingCompleted = "completed"
+	ProcessingFailed    = "failed"
+)
+
+// Object visibility
+const (
+	VisibilityPublic  = "public"  // Anyone may download or view
+	VisibilityPrivate = "private" // Needs an API key with the read scope or a presigned URL
+)
+
+// ObjectRecord is the persisted metadata of an uploaded original
+type ObjectRecord struct {
+	FileName     string    `json:"file_name"`
+	OriginalName string    `json:"original_name"`
+	ContentType  string    `json:"content_type"`
+	FileType     string    `json:"file_type"`
+	Size         int64     `json:"size"`
+	UploaderIP   string    `json:"uploader_ip,omitempty"`
+	UploadedAt   time.Time `json:"uploaded_at"`
+
+	// API key that uploaded the object, empty when authentication is disabled
+	UploaderKeyID   string `json:"uploader_key_id,omitempty"`
+	UploaderKeyName string `json:"uploader_key_name,omitempty"`
+
+	// VisibilityPublic or VisibilityPrivate, empty for records created
+	// before visibility existed (the configured default applies)
+	Visibility string `json:"visibility,omitempty"`
+
+	// Bucket the object was uploaded to, empty for the default bucket
+	Bucket string `json:"bucket,omitempty"`
+
+	// Composite ETag ("<md5 of part md5s>-<parts>") of multipart uploads
+	ETag string `json:"etag,omitempty"`
+
+	// Hex SHA-256 of the content, recorded when deduplication is enabled
+	SHA256 string `json:"sha256,omitempty"`
+
+	// MIME type sniffed from the content at upload, empty for objects
+	// stored before content detection existed
+	DetectedType string `json:"detected_type,omitempty"`
+
+	// Dimensions and EXIF fields of images, read at upload
+	Image *ImageInfo `json:"image,omitempty"`
+
+	// Rendition name ("small", "720p", "high", ...) to stored file name
+	Renditions        map[string]string `json:"renditions,omitempty"`
+	JobID             string            `json:"job_id,omitempty"`
+	ProcessingProfile string            `json:"processing_profile,omitempty"` // Empty means ProfileFull
+	ProcessingStatus  string            `json:"processing_status,omitempty"`
+	ProcessingError   string            `json:"processing_error,omitempty"`
+	ProcessedAt       *time.Time        `json:"processed_at,omitempty"`
+}
+
+// ImageInfo describes an uploaded image. The EXIF fields are read before
+// STRIP_IMAGE_METADATA removes them from the stored file.
+type ImageInfo struct {
+	Width       int    `json:"width"`                 // Pixels, as displayed after EXIF orientation
+	Height      int    `json:"height"`                // Pixels, as displayed after EXIF orientation
+	Orientation int    `json:"orientation,omitempty"` // EXIF orientation, 1-8
+	Camera      string `json:"camera,omitempty"`      // EXIF make and model
+	TakenAt     string `json:"taken_at,omitempty"`    // EXIF DateTimeOriginal, RFC 3339 without zone when the camera recorded none
+}
+
+// PutObject creates or replaces the record for rec.FileName
+func (db *DB) PutObject(rec *ObjectRecord) error {
+	return db.put(objectsBucket, rec.FileName, rec)
+}
+
+// GetObject returns the record for fileName
+func (db *DB) GetObject(fileName string) (*ObjectRecord, error) {
+	var rec ObjectRecord
+	if err := db.get(objectsBucket, fileName, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// UpdateObject loads the record for fileName, applies fn and saves it
+// atomically. fn is not called when the record does not exist.
+func (db *DB) UpdateObject(fileName string, fn func(rec *ObjectRecord) error) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(objectsBucket)
+		data := b.Get([]byte(fileName))
+		if data == nil {
+			return ErrNotFound
+		}
+
+		var rec ObjectRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		if err := fn(&rec); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(&rec)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(fileName), data)
+	})
+}
+
+// FindObjectByStem returns the record of the original whose file name is
+// stem plus an extension, e.g. the original "<uuid>.mp4" of "<uuid>_720p.mp4".
+// Names that merely start with stem, such as "<stem>.tar.gz" or
+// "<stem>.d/<name>", are not matches.
+func (db *DB) FindObjectByStem(stem string) (*ObjectRecord, error) {
+	var rec ObjectRecord
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		prefix := []byte(stem + ".")
+		c := tx.Bucket(objectsBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if !bytes.ContainsAny(k[len(prefix):], "./") {
+				return json.Unmarshal(v, &rec)
+			}
+		}
+		return ErrNotFound
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// DeleteObject removes the record for fileName
+func (db *DB) DeleteObject(fileName string) error {
+	return db.delete(objectsBucket, fileName)
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UploadRules restrict the files that may be uploaded, server-wide or to a
+// bucket. Type entries starting with "." match extensions, all others
+// match content types and may use wildcards such as "image/*". Zero
+// limits do not apply.
+type UploadRules struct {
+	AllowedTypes     []string         `json:"allowed_types,omitempty"`      // Empty allows all
+	DeniedTypes      []string         `json:"denied_types,omitempty"`       // Checked before AllowedTypes
+	MaxSizes         map[string]int64 `json:"max_sizes,omitempty"`          // Bytes by type, e.g. {"image/*": 20971520}
+	MaxImageWidth    int              `json:"max_image_width,omitempty"`    // Pixels
+	MaxImageHeight   int              `json:"max_image_height,omitempty"`   // Pixels
+	MaxVideoDuration int64            `json:"max_video_duration,omitempty"` // Seconds
+}
+
+// Names of the upload rules, as reported in RuleViolation
+const (
+	RuleDeniedTypes      = "denied_types"
+	RuleAllowedTypes     = "allowed_types"
+	RuleMaxSize          = "max_size"
+	RuleMaxImageWidth    = "max_image_width"
+	RuleMaxImageHeight   = "max_image_height"
+	RuleMaxVideoDuration = "max_video_duration"
+)
+
+// RuleViolation describes the upload rule a file breaks
+type RuleViolation struct {
+	Scope  string // "server" or "bucket", set by the caller
+	Rule   string // One of the Rule* names
+	Match  string // Type entry that applied, for type and size rules
+	Limit  int64
+	Actual int64
+}
+
+// Error describes the violation in a sentence
+func (v *RuleViolation) Error() string {
+	switch v.Rule {
+	case RuleDeniedTypes:
+		return fmt.Sprintf("Files matching %q are not allowed", v.Match)
+	case RuleAllowedTypes:
+		return "File type is not in the list of allowed types"
+	case RuleMaxSize:
+		return fmt.Sprintf("Files matching %q may not be larger than %d bytes", v.Match, v.Limit)
+	case RuleMaxImageWidth:
+		return fmt.Sprintf("Image is %d pixels wide, the limit is %d", v.Actual, v.Limit)
+	case RuleMaxImageHeight:
+		return fmt.Sprintf("Image is %d pixels high, the limit is %d", v.Actual, v.Limit)
+	case RuleMaxVideoDuration:
+		return fmt.Sprintf("Video is %d seconds long, the limit is %d", v.Actual, v.Limit)
+	}
+	return "Upload rule " + v.Rule + " failed"
+}
+
+// CheckFile checks the type and size of a file with extension ext and
+// contentType. The smallest size limit among the matching entries applies.
+func (r *UploadRules) CheckFile(ext, contentType string, size int64) *RuleViolation {
+	for _, denied := range r.DeniedTypes {
+		if matchesType(denied, ext, contentType) {
+			return &RuleViolation{Rule: RuleDeniedTypes, Match: denied}
+		}
+	}
+	if !r.Allows(ext, contentType) {
+		return &RuleViolation{Rule: RuleAllowedTypes, Match: mediaType(contentType)}
+	}
+
+	// Sorted so the reported entry does not depend on map order
+	entries := make([]string, 0, len(r.MaxSizes))
+	for entry := range r.MaxSizes {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+
+	var violation *RuleViolation
+	for _, entry := range entries {
+		limit := r.MaxSizes[entry]
+		if limit <= 0 || size <= limit || !matchesType(entry, ext, contentType) {
+			continue
+		}
+		if violation == nil || limit < violation.Limit {
+			violation = &RuleViolation{Rule: RuleMaxSize, Match: entry, Limit: limit, Actual: size}
+		}
+	}
+	return violation
+}
+
+// CheckImage checks the pixel dimensions of an image
+func (r *UploadRules) CheckImage(width, height int) *RuleViolation {
+	if r.MaxImageWidth > 0 && width > r.MaxImageWidth {
+		return &RuleViolation{Rule: RuleMaxImageWidth, Limit: int64(r.MaxImageWidth), Actual: int64(width)}
+	}
+	if r.MaxImageHeight > 0 && height > r.MaxImageHeight {
+		return &RuleViolation{Rule: RuleMaxImageHeight, Limit: int64(r.MaxImageHeight), Actual: int64(height)}
+	}
+	return nil
+}
+
+// CheckVideo checks the duration of a video
+func (r *UploadRules) CheckVideo(duration time.Duration) *RuleViolation {
+	limit := time.Duration(r.MaxVideoDuration) * time.Second
+	if limit > 0 && duration > limit {
+		// Round up, so a video just over the limit is not reported as equal to it
+		actual := int64((duration + time.Second - 1) / time.Second)
+		return &RuleViolation{Rule: RuleMaxVideoDuration, Limit: r.MaxVideoDuration, Actual: actual}
+	}
+	return nil
+}
+
+// Allows reports whether a file with extension ext and contentType matches
+// AllowedTypes
+func (r *UploadRules) Allows(ext, contentType string) bool {
+	if len(r.AllowedTypes) == 0 {
+		return true
+	}
+	for _, allowed := range r.AllowedTypes {
+		if matchesType(allowed, ext, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesType reports whether a type entry matches a file with extension
+// ext and contentType
+func matchesType(entry, ext, contentType string) bool {
+	if strings.HasPrefix(entry, ".") {
+		return strings.EqualFold(entry, ext)
+	}
+	ok, _ := path.Match(strings.ToLower(entry), mediaType(contentType))
+	return ok
+}
+
+// mediaType returns contentType in lower case without parameters
+func mediaType(contentType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
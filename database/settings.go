@@ -0,0 +1,26 @@
+package database
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+// GetOrCreateSetting returns the server setting stored under name. When it
+// does not exist yet, create is called once and its result is stored.
+func (db *DB) GetOrCreateSetting(name string, create func() (string, error)) (string, error) {
+	var value string
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(settingsBucket)
+		if data := b.Get([]byte(name)); data != nil {
+			value = string(data)
+			return nil
+		}
+
+		v, err := create()
+		if err != nil {
+			return err
+		}
+		value = v
+		return b.Put([]byte(name), []byte(v))
+	})
+	return value, err
+}
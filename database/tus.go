@@ -0,0 +1,67 @@
+package database
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// TusUploadRecord tracks a resumable tus upload. The received bytes live in
+// a data file named after the ID; its size is the current upload offset.
+type TusUploadRecord struct {
+	ID         string            `json:"id"`
+	Length     int64             `json:"length"`
+	Metadata   map[string]string `json:"metadata,omitempty"` // Decoded Upload-Metadata
+	RawMeta    string            `json:"raw_metadata,omitempty"`
+	Bucket     string            `json:"bucket,omitempty"` // Empty for the default bucket
+	Visibility string            `json:"visibility"`
+
+	// The API key that started the upload, the only one besides admin
+	// keys allowed to continue or terminate it
+	UploaderKeyID   string `json:"uploader_key_id,omitempty"`
+	UploaderKeyName string `json:"uploader_key_name,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Set once all bytes arrived and the file was handed to storage
+	FileName    string     `json:"file_name,omitempty"` // Storage key, see ObjectKey
+	JobID       string     `json:"job_id,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// PutTusUpload creates or replaces the record for upload.ID
+func (db *DB) PutTusUpload(upload *TusUploadRecord) error {
+	return db.put(tusBucket, upload.ID, upload)
+}
+
+// GetTusUpload returns the tus upload with the given ID
+func (db *DB) GetTusUpload(id string) (*TusUploadRecord, error) {
+	var upload TusUploadRecord
+	if err := db.get(tusBucket, id, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// DeleteTusUpload removes the tus upload record
+func (db *DB) DeleteTusUpload(id string) error {
+	return db.delete(tusBucket, id)
+}
+
+// ListTusUploads returns all tus upload records, oldest first
+func (db *DB) ListTusUploads() ([]TusUploadRecord, error) {
+	var uploads []TusUploadRecord
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tusBucket).ForEach(func(k, v []byte) error {
+			var upload TusUploadRecord
+			if err := json.Unmarshal(v, &upload); err != nil {
+				return err
+			}
+			uploads = append(uploads, upload)
+			return nil
+		})
+	})
+	return uploads, err
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"errors"
+	"object-storage-server/auth"
+	"object-storage-server/database"
+	"object-storage-server/models"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type APIKeyHandler struct {
+	DB     *database.DB
+	Signer *auth.Signer
+}
+
+func NewAPIKeyHandler(db *database.DB, signer *auth.Signer) *APIKeyHandler {
+	return &APIKeyHandler{DB: db, Signer: signer}
+}
+
+// CreateAPIKeyRequest is the body of POST /api/admin/keys
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// CreateAPIKey issues a new API key. The key is only returned in this response.
+func (h *APIKeyHandler) CreateAPIKey(c *fiber.Ctx) error {
+	var req CreateAPIKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return badRequest(c, "Invalid request body")
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return badRequest(c, "name is required")
+	}
+
+	key, rec, err := auth.CreateKey(h.DB, req.Name, req.Scopes)
+	if err != nil {
+		return badRequest(c, err.Error())
+	}
+
+	s3AccessKey, s3SecretKey := h.Signer.S3Credentials(rec)
+	return c.Status(fiber.StatusCreated).JSON(models.APIKeyResponse{
+		Success:           true,
+		Message:           "API key created, store it now as it cannot be shown again",
+		Key:               key,
+		S3AccessKeyID:     s3AccessKey,
+		S3SecretAccessKey: s3SecretKey,
+		Data:              apiKeyInfo(rec),
+	})
+}
+
+// ListAPIKeys lists all API keys without their secrets
+func (h *APIKeyHandler) ListAPIKeys(c *fiber.Ctx) error {
+	keys, err := h.DB.ListAPIKeys()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Failed to load API keys",
+		})
+	}
+
+	infos := make([]models.APIKeyInfo, 0, len(keys))
+	for i := range keys {
+		infos = append(infos, apiKeyInfo(&keys[i]))
+	}
+	return c.JSON(models.APIKeyListResponse{Success: true, Keys: infos})
+}
+
+// RevokeAPIKey revokes an API key so it can no longer be used
+func (h *APIKeyHandler) RevokeAPIKey(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	if err := auth.RevokeKey(h.DB, id); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+				Success: false,
+				Message: "API key not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Failed to revoke API key",
+		})
+	}
+
+	rec, err := h.DB.GetAPIKey(id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Failed to load API key",
+		})
+	}
+	return c.JSON(models.APIKeyResponse{
+		Success: true,
+		Message: "API key revoked",
+		Data:    apiKeyInfo(rec),
+	})
+}
+
+// apiKeyInfo converts a stored key to its public representation
+func apiKeyInfo(rec *database.APIKeyRecord) models.APIKeyInfo {
+	info := models.APIKeyInfo{
+		ID:        rec.ID,
+		Name:      rec.Name,
+		Prefix:    rec.Prefix,
+		Scopes:    rec.Scopes,
+		CreatedAt: rec.CreatedAt.Format(time.RFC3339),
+	}
+	if rec.RevokedAt != nil {
+		info.RevokedAt = rec.RevokedAt.Format(time.RFC3339)
+	}
+	return info
+}
@@ -0,0 +1,560 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"object-storage-server/auth"
+	"object-storage-server/database"
+	"object-storage-server/models"
+	"object-storage-server/storage"
+	"object-storage-server/utils"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// bucketNamePattern follows the S3 rules for bucket names, without dots
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// errBucketNotEmpty is returned by removeBucket for buckets that still
+// hold objects when deletion was not forced
+var errBucketNotEmpty = errors.New("bucket is not empty")
+
+// errBucketNotDeleted is returned by removeBucket when objects survived
+// the deletion; the bucket is kept so the deletion can be retried
+var errBucketNotDeleted = errors.New("bucket still holds objects")
+
+// BucketRequest is the body of POST /api/buckets and PATCH /api/buckets/:bucket.
+// Settings left out keep their current value, or the default on creation.
+type BucketRequest struct {
+	Name              string    `json:"name"`
+	Visibility        *string   `json:"visibility"`         // "public" or "private"
+	MaxFileSize       *int64    `json:"max_file_size"`      // Bytes, 0 for MAX_FILE_SIZE
+	AllowedTypes      *[]string `json:"allowed_types"`      // e.g. ["image/*", ".pdf"], empty allows all
+	ProcessingProfile *string   `json:"processing_profile"` // "full", "thumbnail" or "none"
+
+	// Upload rules applied on top of the server-wide ones, see database.UploadRules
+	DeniedTypes      *[]string         `json:"denied_types"`       // Same format as allowed_types
+	MaxSizes         *map[string]int64 `json:"max_sizes"`          // Bytes by type, e.g. {"image/*": 20971520}
+	MaxImageWidth    *int              `json:"max_image_width"`    // Pixels, 0 for no limit
+	MaxImageHeight   *int              `json:"max_image_height"`   // Pixels, 0 for no limit
+	MaxVideoDuration *int64            `json:"max_video_duration"` // Seconds, 0 for no limit
+}
+
+// CreateBucket creates a bucket with the settings in the request body
+func (h *FileHandler) CreateBucket(c *fiber.Ctx) error {
+	var req BucketRequest
+	if err := c.BodyParser(&req); err != nil {
+		return badRequest(c, "Invalid request body")
+	}
+	if err := h.validBucketName(req.Name); err != nil {
+		return badRequest(c, err.Error())
+	}
+
+	bucket := h.newBucket(req.Name)
+	if err := h.applyBucketSettings(bucket, &req); err != nil {
+		return badRequest(c, err.Error())
+	}
+
+	if err := h.DB.CreateBucket(bucket); err != nil {
+		if errors.Is(err, database.ErrExists) {
+			return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+				Success: false,
+				Message: fmt.Sprintf("Bucket %q already exists", bucket.Name),
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Failed to create bucket",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(models.BucketResponse{
+		Success: true,
+		Message: "Bucket created",
+		Data:    h.bucketInfo(bucket),
+	})
+}
+
+// ListBuckets lists the default bucket followed by all created buckets
+func (h *FileHandler) ListBuckets(c *fiber.Ctx) error {
+	buckets, err := h.DB.ListBuckets()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Failed to load buckets",
+		})
+	}
+
+	infos := make([]models.BucketInfo, 0, len(buckets)+1)
+	infos = append(infos, h.bucketInfo(h.defaultBucket()))
+	for i := range buckets {
+		infos = append(infos, h.bucketInfo(&buckets[i]))
+	}
+	return c.JSON(models.BucketListResponse{Success: true, Buckets: infos, Count: len(infos)})
+}
+
+// GetBucket returns the settings of a bucket
+func (h *FileHandler) GetBucket(c *fiber.Ctx) error {
+	bucket, err := h.bucket(c.Params("bucket"))
+	if err != nil {
+		return bucketError(c, err)
+	}
+	return c.JSON(models.BucketResponse{Success: true, Data: h.bucketInfo(bucket)})
+}
+
+// UpdateBucket changes the settings of a bucket. They apply to new uploads,
+// stored objects keep their visibility and renditions.
+func (h *FileHandler) UpdateBucket(c *fiber.Ctx) error {
+	name := c.Params("bucket")
+	if name == database.DefaultBucket {
+		return badRequest(c, "The default bucket is configured through environment variables")
+	}
+
+	var req BucketRequest
+	if err := c.BodyParser(&req); err != nil {
+		return badRequest(c, "Invalid request body")
+	}
+
+	var settingsErr error
+	err := h.DB.UpdateBucket(name, func(bucket *database.BucketRecord) error {
+		settingsErr = h.applyBucketSettings(bucket, &req)
+		return settingsErr
+	})
+	if settingsErr != nil {
+		return badRequest(c, settingsErr.Error())
+	}
+	if err != nil {
+		return bucketError(c, err)
+	}
+
+	bucket, err := h.DB.GetBucket(name)
+	if err != nil {
+		return bucketError(c, err)
+	}
+	return c.JSON(models.BucketResponse{
+		Success: true,
+		Message: "Bucket updated",
+		Data:    h.bucketInfo(bucket),
+	})
+}
+
+// DeleteBucket removes an empty bucket. With ?force=true the objects of the
+// bucket are deleted along with it.
+func (h *FileHandler) DeleteBucket(c *fiber.Ctx) error {
+	name := c.Params("bucket")
+	if name == database.DefaultBucket {
+		return badRequest(c, "The default bucket cannot be deleted")
+	}
+	bucket, err := h.bucket(name)
+	if err != nil {
+		return bucketError(c, err)
+	}
+
+	deleted, err := h.removeBucket(bucket.Name, c.QueryBool("force", false))
+	if errors.Is(err, errBucketNotEmpty) {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Bucket is not empty, delete its files first or use ?force=true",
+		})
+	}
+	if errors.Is(err, errBucketNotDeleted) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success":       false,
+			"message":       "Some files could not be deleted, the bucket was kept. Retry to delete the rest",
+			"bucket":        bucket.Name,
+			"deleted_files": deleted,
+		})
+	}
+	if err != nil {
+		return bucketError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":       true,
+		"message":       "Bucket deleted",
+		"bucket":        bucket.Name,
+		"deleted_files": deleted,
+	})
+}
+
+// UploadBucketFile uploads a file to the bucket, like UploadFile
+func (h *FileHandler) UploadBucketFile(c *fiber.Ctx) error {
+	bucket, err := h.bucket(c.Params("bucket"))
+	if err != nil {
+		return bucketError(c, err)
+	}
+	return h.upload(c, bucket)
+}
+
+// ListBucketFiles returns a page of the files in the bucket, like ListFiles
+func (h *FileHandler) ListBucketFiles(c *fiber.Ctx) error {
+	bucket, err := h.bucket(c.Params("bucket"))
+	if err != nil {
+		return bucketError(c, err)
+	}
+	return h.listFiles(c, bucket.Name)
+}
+
+// DownloadBucketFile downloads a file of the bucket, like DownloadFile
+func (h *FileHandler) DownloadBucketFile(c *fiber.Ctx) error {
+	bucket, err := h.bucket(c.Params("bucket"))
+	if err != nil {
+		return bucketError(c, err)
+	}
+	return h.sendFile(c, bucket.Name, "attachment")
+}
+
+// ViewBucketFile shows a file of the bucket inline, like ViewFile
+func (h *FileHandler) ViewBucketFile(c *fiber.Ctx) error {
+	bucket, err := h.bucket(c.Params("bucket"))
+	if err != nil {
+		return bucketError(c, err)
+	}
+	return h.sendFile(c, bucket.Name, "inline")
+}
+
+// GetBucketFileMetadata returns the metadata of a file of the bucket, like GetFileMetadata
+func (h *FileHandler) GetBucketFileMetadata(c *fiber.Ctx) error {
+	bucket, err := h.bucket(c.Params("bucket"))
+	if err != nil {
+		return bucketError(c, err)
+	}
+	return h.fileMetadata(c, bucket.Name)
+}
+
+// DeleteBucketFile removes a file of the bucket, like DeleteFile
+func (h *FileHandler) DeleteBucketFile(c *fiber.Ctx) error {
+	bucket, err := h.bucket(c.Params("bucket"))
+	if err != nil {
+		return bucketError(c, err)
+	}
+	return h.removeFile(c, bucket.Name)
+}
+
+// bucket returns the bucket called name; "" names the default bucket
+func (h *FileHandler) bucket(name string) (*database.BucketRecord, error) {
+	if name == "" || name == database.DefaultBucket {
+		return h.defaultBucket(), nil
+	}
+	return h.DB.GetBucket(name)
+}
+
+// defaultBucket describes the bucket served by /api/files, whose settings
+// are the server-wide ones
+func (h *FileHandler) defaultBucket() *database.BucketRecord {
+	return &database.BucketRecord{
+		Name:              database.DefaultBucket,
+		Visibility:        h.Config.DefaultVisibility,
+		UploadRules:       *h.serverRules(),
+		ProcessingProfile: database.ProfileFull,
+	}
+}
+
+// newBucket returns a bucket called name with the default settings
+func (h *FileHandler) newBucket(name string) *database.BucketRecord {
+	return &database.BucketRecord{
+		Name:              name,
+		Visibility:        h.Config.DefaultVisibility,
+		ProcessingProfile: database.ProfileFull,
+		CreatedAt:         time.Now().UTC(),
+	}
+}
+
+// validBucketName checks that a new bucket may be called name
+func (h *FileHandler) validBucketName(name string) error {
+	if !bucketNamePattern.MatchString(name) {
+		return errors.New("name must be 3 to 63 lowercase letters, digits or dashes, starting and ending with a letter or digit")
+	}
+	if name == database.DefaultBucket || name == h.Config.S3APIBucket {
+		return fmt.Errorf("bucket name %q is reserved", name)
+	}
+	return nil
+}
+
+// applyBucketSettings validates the settings in req and copies them to bucket
+func (h *FileHandler) applyBucketSettings(bucket *database.BucketRecord, req *BucketRequest) error {
+	if req.Visibility != nil {
+		if *req.Visibility != database.VisibilityPublic && *req.Visibility != database.VisibilityPrivate {
+			return errors.New("visibility must be \"public\" or \"private\"")
+		}
+		bucket.Visibility = *req.Visibility
+	}
+
+	if req.MaxFileSize != nil {
+		if *req.MaxFileSize < 0 || *req.MaxFileSize > h.Config.MaxFileSize {
+			return fmt.Errorf("max_file_size must be between 0 and %d bytes", h.Config.MaxFileSize)
+		}
+		bucket.MaxFileSize = *req.MaxFileSize
+	}
+
+	if req.AllowedTypes != nil {
+		types, err := typeEntries("allowed_types", *req.AllowedTypes)
+		if err != nil {
+			return err
+		}
+		bucket.AllowedTypes = types
+	}
+
+	if req.DeniedTypes != nil {
+		types, err := typeEntries("denied_types", *req.DeniedTypes)
+		if err != nil {
+			return err
+		}
+		bucket.DeniedTypes = types
+	}
+
+	if req.MaxSizes != nil {
+		sizes := make(map[string]int64, len(*req.MaxSizes))
+		for entry, size := range *req.MaxSizes {
+			types, err := typeEntries("max_sizes", []string{entry})
+			if err != nil {
+				return err
+			}
+			if size <= 0 {
+				return fmt.Errorf("max_sizes limit of %q must be a positive number of bytes", entry)
+			}
+			sizes[types[0]] = size
+		}
+		bucket.MaxSizes = sizes
+	}
+
+	if req.MaxImageWidth != nil {
+		if *req.MaxImageWidth < 0 {
+			return errors.New("max_image_width must not be negative")
+		}
+		bucket.MaxImageWidth = *req.MaxImageWidth
+	}
+
+	if req.MaxImageHeight != nil {
+		if *req.MaxImageHeight < 0 {
+			return errors.New("max_image_height must not be negative")
+		}
+		bucket.MaxImageHeight = *req.MaxImageHeight
+	}
+
+	if req.MaxVideoDuration != nil {
+		if *req.MaxVideoDuration < 0 {
+			return errors.New("max_video_duration must not be negative")
+		}
+		bucket.MaxVideoDuration = *req.MaxVideoDuration
+	}
+
+	if req.ProcessingProfile != nil {
+		switch *req.ProcessingProfile {
+		case database.ProfileFull, database.ProfileThumbnail, database.ProfileNone:
+		default:
+			return errors.New("processing_profile must be \"full\", \"thumbnail\" or \"none\"")
+		}
+		bucket.ProcessingProfile = *req.ProcessingProfile
+	}
+	return nil
+}
+
+// typeEntries normalizes the type entries of the bucket setting field,
+// which must be extensions or content types
+func typeEntries(field string, entries []string) ([]string, error) {
+	types := make([]string, 0, len(entries))
+	for _, t := range entries {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if len(t) < 2 || (!strings.HasPrefix(t, ".") && !strings.Contains(t, "/")) {
+			return nil, fmt.Errorf("%s entries must be extensions such as \".pdf\" or content types such as \"image/*\"", field)
+		}
+		if _, err := path.Match(t, ""); err != nil {
+			return nil, fmt.Errorf("%s entry %q is not a valid pattern", field, t)
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// removeBucket deletes the bucket record, aborts the tus and multipart
+// uploads targeting the bucket and, when force is set, deletes every
+// object stored in it. It returns the deleted object keys. When objects
+// are left afterwards the record is restored and errBucketNotDeleted is
+// returned together with the keys deleted so far.
+func (h *FileHandler) removeBucket(name string, force bool) ([]string, error) {
+	bucket, err := h.DB.GetBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	prefix := database.ObjectKey(name, "")
+	objects, err := h.Storage.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) > 0 && !force {
+		return nil, errBucketNotEmpty
+	}
+
+	// Remove the record first so no new uploads arrive while objects are deleted
+	if err := h.DB.DeleteBucket(name); err != nil {
+		return nil, err
+	}
+	for _, abort := range h.bucketRemoved {
+		abort(name)
+	}
+
+	deleted := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		// Renditions go together with their original
+		if utils.IsDerivative(obj.Key) {
+			err := h.Storage.Delete(obj.Key)
+			if err == nil {
+				deleted = append(deleted, strings.TrimPrefix(obj.Key, prefix))
+			} else if !errors.Is(err, storage.ErrNotFound) {
+				log.Printf("Failed to delete %s: %v", obj.Key, err)
+			}
+			continue
+		}
+
+		files, _, err := h.deleteObject(obj.Key)
+		if err != nil {
+			log.Printf("Failed to delete %s: %v", obj.Key, err)
+		}
+		for _, file := range files {
+			deleted = append(deleted, strings.TrimPrefix(file, prefix))
+		}
+	}
+
+	// Objects left behind would reappear in a new bucket of the same name,
+	// so the bucket stays until they are gone. This also catches uploads
+	// that were completing while the bucket was deleted.
+	remaining, err := h.Storage.List(prefix)
+	if err == nil && len(remaining) == 0 {
+		return deleted, nil
+	}
+	if restoreErr := h.DB.CreateBucket(bucket); restoreErr != nil {
+		log.Printf("Failed to restore bucket %s: %v", name, restoreErr)
+	}
+	if err != nil {
+		return deleted, fmt.Errorf("%w: %v", errBucketNotDeleted, err)
+	}
+	return deleted, fmt.Errorf("%w: %d objects left", errBucketNotDeleted, len(remaining))
+}
+
+// onBucketRemoved registers fn to be called with the name of every bucket
+// removeBucket deletes, before its objects are deleted. Handlers register
+// while they are set up.
+func (h *FileHandler) onBucketRemoved(fn func(bucket string)) {
+	h.bucketRemoved = append(h.bucketRemoved, fn)
+}
+
+// bucketMaxFileSize returns the upload size limit of bucket
+func (h *FileHandler) bucketMaxFileSize(bucket *database.BucketRecord) int64 {
+	if bucket.MaxFileSize > 0 && bucket.MaxFileSize < h.Config.MaxFileSize {
+		return bucket.MaxFileSize
+	}
+	return h.Config.MaxFileSize
+}
+
+// bucketVisibility returns the visibility of objects without a record in
+// the bucket of storageKey. Keys of deleted buckets are treated as private.
+func (h *FileHandler) bucketVisibility(storageKey string) string {
+	name, _ := database.SplitObjectKey(storageKey)
+	bucket, err := h.bucket(name)
+	if err != nil {
+		return database.VisibilityPrivate
+	}
+	return bucket.Visibility
+}
+
+// bucketInfo converts a bucket to its public representation
+func (h *FileHandler) bucketInfo(bucket *database.BucketRecord) models.BucketInfo {
+	info := models.BucketInfo{
+		Name:              bucket.Name,
+		IsDefault:         bucket.Name == database.DefaultBucket,
+		Visibility:        bucket.Visibility,
+		MaxFileSize:       h.bucketMaxFileSize(bucket),
+		AllowedTypes:      bucket.AllowedTypes,
+		DeniedTypes:       bucket.DeniedTypes,
+		MaxSizes:          bucket.MaxSizes,
+		MaxImageWidth:     bucket.MaxImageWidth,
+		MaxImageHeight:    bucket.MaxImageHeight,
+		MaxVideoDuration:  bucket.MaxVideoDuration,
+		ProcessingProfile: bucket.ProcessingProfile,
+		FilesURL:          fmt.Sprintf("%s/api/buckets/%s/files", h.Config.BaseURL, bucket.Name),
+	}
+	if info.IsDefault {
+		info.FilesURL = fmt.Sprintf("%s/api/files", h.Config.BaseURL)
+	}
+	if !bucket.CreatedAt.IsZero() {
+		info.CreatedAt = bucket.CreatedAt.Format(time.RFC3339)
+	}
+	return info
+}
+
+// objectPath returns the path of the "download", "view", "metadata" or "img"
+// endpoint of the object stored under storageKey: below /api/files for the
+// default bucket and below /api/buckets/<bucket> for all others
+func objectPath(storageKey, endpoint string) string {
+	bucket, key := database.SplitObjectKey(storageKey)
+	key = escapeKey(key)
+	if bucket == database.DefaultBucket {
+		switch endpoint {
+		case "view", "metadata":
+			return fmt.Sprintf("/api/files/%s/%s", endpoint, key)
+		case "img":
+			return "/api/img/" + key
+		default:
+			return "/api/files/" + key
+		}
+	}
+
+	switch endpoint {
+	case "view", "metadata", "img":
+		return fmt.Sprintf("/api/buckets/%s/%s/%s", bucket, endpoint, key)
+	default:
+		return fmt.Sprintf("/api/buckets/%s/files/%s", bucket, key)
+	}
+}
+
+// escapeKey escapes each segment of an object key for use in a URL path
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// objectURL returns the absolute URL of objectPath
+func (h *FileHandler) objectURL(storageKey, endpoint string) string {
+	return h.Config.BaseURL + objectPath(storageKey, endpoint)
+}
+
+// uploadURL returns the upload endpoint of bucket
+func (h *FileHandler) uploadURL(bucket string) string {
+	if bucket == database.DefaultBucket {
+		return h.Config.BaseURL + "/api/upload"
+	}
+	return fmt.Sprintf("%s/api/buckets/%s/files", h.Config.BaseURL, bucket)
+}
+
+// policyBucket returns the bucket an upload policy is valid for
+func policyBucket(policy *auth.UploadPolicy) string {
+	if policy.Bucket == "" {
+		return database.DefaultBucket
+	}
+	return policy.Bucket
+}
+
+// bucketError writes the response for an error looking up a bucket
+func bucketError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, database.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Bucket not found",
+		})
+	}
+	log.Printf("Bucket lookup failed: %v", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+		Success: false,
+		Message: "Failed to load bucket",
+	})
+}
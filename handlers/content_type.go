@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"object-storage-server/utils"
+	"os"
+	"path"
+	"strings"
+)
+
+// errContentMismatch is returned when the content of an upload does not
+// match the extension it is stored under
+var errContentMismatch = errors.New("file content does not match its extension")
+
+// checkContent detects the type of an upload from its first bytes and
+// applies CONTENT_TYPE_MISMATCH when it does not match the extension of
+// name. With "normalize", generated names get the extension of the
+// detected type; client chosen keys are never renamed and are rejected
+// like with "reject". It returns the name to store the upload under and
+// the detected type.
+func (h *FileHandler) checkContent(name string, header []byte, generated bool) (string, string, error) {
+	detected := utils.DetectContentType(header)
+	if utils.MatchesContent(name, detected) {
+		return name, detected, nil
+	}
+	if h.Config.ContentTypeMismatch == "normalize" && generated {
+		return strings.TrimSuffix(name, path.Ext(name)) + utils.ExtensionForType(detected), detected, nil
+	}
+	mediaType, _, _ := strings.Cut(detected, ";")
+	return "", "", fmt.Errorf("%w: %s content cannot be stored as %q", errContentMismatch, mediaType, path.Ext(name))
+}
+
+// readHeader returns the first bytes of the local file at path, as many as
+// content detection looks at
+func readHeader(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, utils.SniffLength)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return header[:n], nil
+}
+
+// probeContentType refines the detected type of audio or video called
+// name with ffprobe, reading the local file at localPath. Content ffprobe
+// finds no audio or video stream in only looked like media in its header
+// and is rejected with errContentMismatch. Without ffprobe the detected
+// type is kept.
+func (h *FileHandler) probeContentType(name, detected, localPath string) (string, error) {
+	if !probeApplies(detected) {
+		return detected, nil
+	}
+	probed, err := utils.ProbeMediaType(localPath, detected)
+	if err != nil {
+		log.Printf("ffprobe could not read %s: %v", name, err)
+		mediaType, _, _ := strings.Cut(detected, ";")
+		return "", fmt.Errorf("%w: no audio or video stream found in %s content stored as %q", errContentMismatch, mediaType, path.Ext(name))
+	}
+	return probed, nil
+}
+
+// probeApplies reports whether probeContentType checks content of the detected type
+func probeApplies(detected string) bool {
+	return (strings.HasPrefix(detected, "video/") || strings.HasPrefix(detected, "audio/")) && utils.CheckFFprobeInstalled()
+}
+
+// servedContentType returns the Content-Type the object stored under key
+// is served with. The detected type is used where it is authoritative:
+// for media, whose extension it has been checked against, and for
+// extensions without a type of their own. Markup keeps the type of its
+// extension, so that an HTML page is never rendered from storage.
+func (h *FileHandler) servedContentType(key string) string {
+	contentType := utils.GetContentType(key)
+	rec, err := h.DB.GetObject(key)
+	if err != nil || rec.DetectedType == "" {
+		return contentType
+	}
+	mediaType, _, _ := strings.Cut(rec.DetectedType, ";")
+	if isMarkupType(mediaType) {
+		return contentType
+	}
+	if utils.GetFileType(key) != "other" || contentType == "application/octet-stream" {
+		return rec.DetectedType
+	}
+	return contentType
+}
+
+// isMarkupType reports whether browsers render mediaType as a document
+// that can run scripts in the origin it is served from
+func isMarkupType(mediaType string) bool {
+	switch strings.ToLower(mediaType) {
+	case "text/html", "text/xml", "application/xml", "application/xhtml+xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
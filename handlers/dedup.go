@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"log"
+	"object-storage-server/database"
+	"object-storage-server/storage"
+	"object-storage-server/utils"
+	"path"
+	"strings"
+)
+
+// contentHash returns the SHA-256 of the object stored under storageKey and
+// the other keys sharing its content, when the storage deduplicates
+func (h *FileHandler) contentHash(storageKey string) (string, []string) {
+	dedup, ok := h.Storage.(storage.Deduplicator)
+	if !ok {
+		return "", nil
+	}
+	hash, err := dedup.Hash(storageKey)
+	if err != nil {
+		return "", nil
+	}
+	keys, err := dedup.Keys(hash)
+	if err != nil {
+		log.Printf("Failed to look up duplicates of %s: %v", storageKey, err)
+		return hash, nil
+	}
+
+	var others []string
+	for _, key := range keys {
+		if key != storageKey {
+			others = append(others, key)
+		}
+	}
+	return hash, others
+}
+
+// reuseRenditions links the renditions of an original with the same
+// content as storageKey, so that a duplicate upload is not processed
+// again. The original must have been processed successfully, have the same
+// extension (renditions keep the original's format) and a processing
+// profile covering every rendition profile asks for. It returns the linked
+// renditions, or nil when no original qualifies.
+func (h *FileHandler) reuseRenditions(storageKey, profile string, duplicates []string) map[string]string {
+	dedup, ok := h.Storage.(storage.Deduplicator)
+	if !ok {
+		return nil
+	}
+
+	ext := strings.ToLower(path.Ext(storageKey))
+	for _, key := range duplicates {
+		if strings.ToLower(path.Ext(key)) != ext {
+			continue
+		}
+		rec, err := h.DB.GetObject(key)
+		if err != nil || rec.ProcessingStatus != database.ProcessingCompleted || rec.ProcessingError != "" {
+			continue
+		}
+
+		covered := true
+		for _, rendition := range utils.GetRenditions(storageKey) {
+			if utils.ProfileIncludes(profile, rendition.Name) && !utils.ProfileIncludes(rec.ProcessingProfile, rendition.Name) {
+				covered = false
+			}
+		}
+		if !covered {
+			continue
+		}
+
+		renditions := make(map[string]string)
+		for _, rendition := range utils.GetRenditions(storageKey) {
+			source, ok := rec.Renditions[rendition.Name]
+			if !ok || !utils.ProfileIncludes(profile, rendition.Name) {
+				continue
+			}
+			if err := dedup.Link(source, rendition.FileName); err != nil {
+				// Renditions stored before deduplication have no blob to share
+				log.Printf("Failed to reuse rendition %s for %s: %v", source, storageKey, err)
+				h.unlinkRenditions(renditions)
+				renditions = nil
+				break
+			}
+			renditions[rendition.Name] = rendition.FileName
+		}
+		if renditions != nil {
+			return renditions
+		}
+	}
+	return nil
+}
+
+// unlinkRenditions removes renditions linked by reuseRenditions for an
+// original that turned out unusable, releasing their blob references
+func (h *FileHandler) unlinkRenditions(renditions map[string]string) {
+	for _, fileName := range renditions {
+		if err := h.Storage.Delete(fileName); err != nil {
+			log.Printf("Failed to remove reused rendition %s: %v", fileName, err)
+		}
+	}
+}
@@ -1,380 +1,957 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"object-storage-server/auth"
 	"object-storage-server/config"
+	"object-storage-server/database"
 	"object-storage-server/models"
+	"object-storage-server/storage"
 	"object-storage-server/utils"
-	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 )
 
 type FileHandler struct {
-	Config *config.Config
+	Config  *config.Config
+	Storage storage.Driver
+	DB      *database.DB
+	Signer  *auth.Signer
+
+	// Client chosen keys of uploads in progress, without extension
+	keysMu    sync.Mutex
+	uploading map[string]bool
+
+	// Slots of the image transforms allowed to run at the same time
+	transforms chan struct{}
+
+	// Bytes held by the transform cache, measured on the first render
+	cacheMu       sync.Mutex
+	cacheSize     int64
+	cacheMeasured bool
+
+	// Called with the name of each deleted bucket, see onBucketRemoved
+	bucketRemoved []func(bucket string)
 }
 
-func NewFileHandler(cfg *config.Config) *FileHandler {
-	return &FileHandler{Config: cfg}
+func NewFileHandler(cfg *config.Config, store storage.Driver, db *database.DB, signer *auth.Signer) *FileHandler {
+	return &FileHandler{
+		Config:     cfg,
+		Storage:    store,
+		DB:         db,
+		Signer:     signer,
+		uploading:  make(map[string]bool),
+		transforms: make(chan struct{}, cfg.ImageTransformConcurrency),
+	}
 }
 
-// UploadFile handles file upload
+// multipartOverhead is the slack allowed on top of a size limit for the
+// multipart boundaries and headers when checking Content-Length
+const multipartOverhead = 64 * 1024
+
+// incomingUpload is a file received either as a multipart form part
+// (POST) or as the raw request body (PUT)
+type incomingUpload struct {
+	Name        string // Client side file name
+	Size        int64
+	ContentType string // Declared by the client
+	Open        func() (io.ReadCloser, error)
+}
+
+// UploadFile handles file upload to the default bucket, either as multipart
+// form field "file" (POST) or as the raw request body (PUT, name given by
+// ?filename=). Requests carrying a presigned upload policy are checked
+// against it before the body is read.
 func (h *FileHandler) UploadFile(c *fiber.Ctx) error {
-	// Get file from form
-	file, err := c.FormFile("file")
+	return h.upload(c, h.defaultBucket())
+}
+
+// upload stores a file sent to UploadFile or UploadBucketFile in bucket,
+// applying the bucket's size limit, allowed types, default visibility and
+// processing profile
+func (h *FileHandler) upload(c *fiber.Ctx, bucket *database.BucketRecord) error {
+	policy, err := h.authorizeUpload(c)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+		return accessDenied(c, err)
+	}
+	if policy != nil && policyBucket(policy) != bucket.Name {
+		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
 			Success: false,
-			Message: "No file uploaded or invalid form data",
+			Message: fmt.Sprintf("Upload policy is only valid for bucket %q", policyBucket(policy)),
 		})
 	}
 
+	maxSize := h.bucketMaxFileSize(bucket)
+	if policy != nil && policy.MaxSize > 0 && policy.MaxSize < maxSize {
+		maxSize = policy.MaxSize
+	}
+
+	// Reject oversized bodies up front, before they are read
+	overhead := int64(multipartOverhead)
+	if c.Method() == fiber.MethodPut {
+		overhead = 0
+	}
+	if length := int64(c.Request().Header.ContentLength()); length > maxSize+overhead {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(models.ErrorResponse{
+			Success: false,
+			Message: fmt.Sprintf("File size exceeds maximum allowed size of %d bytes", maxSize),
+		})
+	}
+
+	var file *incomingUpload
+	if c.Method() == fiber.MethodPut {
+		file, err = rawUpload(c)
+	} else {
+		file, err = formUpload(c)
+	}
+	if err != nil {
+		return badRequest(c, err.Error())
+	}
+
 	// Check file size
-	if file.Size > h.Config.MaxFileSize {
+	if file.Size > maxSize {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Success: false,
+			Message: fmt.Sprintf("File size exceeds maximum allowed size of %d bytes", maxSize),
+		})
+	}
+
+	// Visibility of the new object ("public" or "private")
+	visibility := c.FormValue("visibility", c.Query("visibility", bucket.Visibility))
+	if policy != nil && policy.Visibility != "" {
+		visibility = policy.Visibility
+	}
+	if visibility != database.VisibilityPublic && visibility != database.VisibilityPrivate {
 		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
 			Success: false,
-			Message: fmt.Sprintf("File size exceeds maximum allowed size of %d bytes", h.Config.MaxFileSize),
+			Message: "visibility must be \"public\" or \"private\"",
+		})
+	}
+
+	// Keep the client chosen key, or generate a unique filename with UUID v7
+	key := c.FormValue("key", c.Query("key"))
+	conflictPolicy := c.FormValue("on_conflict", c.Query("on_conflict", h.Config.KeyConflictPolicy))
+	var uniqueFileName string
+	if key != "" {
+		if policy != nil {
+			return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+				Success: false,
+				Message: "Uploads with a presigned policy cannot choose their key",
+			})
+		}
+		if err := checkUploadKey(bucket.Name, key); err != nil {
+			return badRequest(c, "Invalid key: "+err.Error())
+		}
+		if !validConflictPolicy(conflictPolicy) {
+			return badRequest(c, "on_conflict must be reject, overwrite or rename")
+		}
+		uniqueFileName = key
+	} else {
+		uniqueFileName = utils.GenerateUniqueFileName(file.Name)
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Failed to read uploaded file",
 		})
 	}
+	defer src.Close()
 
-	// Generate unique filename with UUID v7
-	uniqueFileName := utils.GenerateUniqueFileName(file.Filename)
+	// Check the content against the extension before anything is stored
+	body := bufio.NewReaderSize(src, utils.SniffLength)
+	header, err := body.Peek(int(min(file.Size, utils.SniffLength)))
+	if err != nil && err != io.EOF {
+		return badRequest(c, "Failed to read uploaded file")
+	}
+	uniqueFileName, detectedType, err := h.checkContent(uniqueFileName, header, key == "")
+	if err != nil {
+		return contentMismatch(c, err)
+	}
 
-	// Create full path
-	fullPath := filepath.Join(h.Config.UploadDir, uniqueFileName)
+	// Prefer the extension-based type, fall back to what the client declared
+	contentType := utils.GetContentType(uniqueFileName)
+	if contentType == "application/octet-stream" && file.ContentType != "" {
+		contentType = file.ContentType
+	}
 
-	// Save file
-	if err := c.SaveFile(file, fullPath); err != nil {
+	// Rules see the extension's type, which checkContent verified for media,
+	// or the detected one for extensions without a type of their own
+	ruleType := utils.GetContentType(uniqueFileName)
+	if ruleType == "application/octet-stream" {
+		ruleType = detectedType
+	}
+	if violation := h.checkFileRules(bucket, uniqueFileName, ruleType, file.Size); violation != nil {
+		return ruleError(c, violation)
+	}
+	if policy != nil {
+		if !policy.AllowsExtension(filepath.Ext(uniqueFileName)) {
+			return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+				Success: false,
+				Message: fmt.Sprintf("Upload policy does not allow %q files", filepath.Ext(uniqueFileName)),
+			})
+		}
+		if !policy.AllowsContentType(contentType) {
+			return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+				Success: false,
+				Message: fmt.Sprintf("Upload policy does not allow content type %q", contentType),
+			})
+		}
+		uniqueFileName = policy.KeyPrefix + uniqueFileName
+	}
+	uniqueFileName = database.ObjectKey(bucket.Name, uniqueFileName)
+
+	// Client chosen keys may be taken, resolve that before the body is stored
+	replaced := false
+	if key != "" {
+		claimed, release, err := h.claimKey(uniqueFileName, conflictPolicy)
+		if keyConflict(err) {
+			return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+		}
+		if err != nil {
+			return h.storageError(c, err)
+		}
+		defer release()
+		replaced = claimed == uniqueFileName && conflictPolicy == conflictOverwrite
+		uniqueFileName = claimed
+	}
+
+	// Stage the file for the checks that need its whole content
+	staged, detectedType, cleanup, err := h.stageChecked(bucket, uniqueFileName, detectedType, io.LimitReader(body, file.Size), file.Size)
+	defer cleanup()
+	var violation *database.RuleViolation
+	if errors.As(err, &violation) {
+		return ruleError(c, violation)
+	}
+	if errors.Is(err, errContentMismatch) {
+		return contentMismatch(c, err)
+	}
+	if errors.Is(err, errShortBody) {
+		return badRequest(c, "Request body is shorter than Content-Length")
+	}
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Success: false,
 			Message: "Failed to save file",
 		})
 	}
 
+	// A full queue turns the upload away while the object it would
+	// replace is still in place
+	if replaced && h.queueRejects(uniqueFileName, file.Size, bucket.ProcessingProfile) {
+		return uploadError(c, errUploadRejected, h.Config.QueueRetryAfter)
+	}
+	if _, err := storage.MoveFile(h.Storage, uniqueFileName, staged); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Failed to save file",
+		})
+	}
+
+	// Renditions of the replaced object are stale
+	if replaced {
+		utils.GetWorkerPool().Cancel(uniqueFileName)
+		h.deleteRenditions(uniqueFileName)
+	}
+
+	uploaderKeyID, uploaderKeyName := uploaderIdentity(c, policy)
+	response, status, err := h.processUpload(c, &storedUpload{
+		FileName:        uniqueFileName,
+		OriginalName:    file.Name,
+		ContentType:     contentType,
+		DetectedType:    detectedType,
+		Size:            file.Size,
+		Visibility:      visibility,
+		Profile:         bucket.ProcessingProfile,
+		UploaderKeyID:   uploaderKeyID,
+		UploaderKeyName: uploaderKeyName,
+		Replaced:        replaced,
+	}, h.Config.QueueFullPolicy)
+	if err != nil {
+		return uploadError(c, err, h.Config.QueueRetryAfter)
+	}
+	return c.Status(status).JSON(response)
+}
+
+// storedUpload describes a file that has been written to storage and
+// still needs its metadata recorded and its renditions generated
+type storedUpload struct {
+	FileName        string // Storage key, see database.ObjectKey
+	OriginalName    string
+	ContentType     string
+	DetectedType    string // Sniffed from the content by checkContent
+	Size            int64
+	Visibility      string
+	Profile         string // Processing profile of the bucket, empty for database.ProfileFull
+	UploaderKeyID   string
+	UploaderKeyName string
+	ETag            string // Set for multipart uploads
+	Replaced        bool   // An existing object was overwritten, so a full queue defers instead of discarding
+}
+
+var (
+	// errUploadRejected is returned by processUpload when the upload was
+	// discarded because the processing queue is full
+	errUploadRejected = errors.New("processing queue is full")
+
+	// errMetadataNotSaved is returned by processUpload when the metadata
+	// record could not be written; the stored file has been removed
+	errMetadataNotSaved = errors.New("failed to save file metadata")
+)
+
+// processUpload records the metadata of a stored upload and starts generating
+// its renditions, synchronously for small images and through the worker pool
+// otherwise. queueFullPolicy ("reject" or "defer") decides what happens when
+// the processing queue has no room. It returns the upload response and status.
+func (h *FileHandler) processUpload(c *fiber.Ctx, up *storedUpload, queueFullPolicy string) (*models.UploadResponse, int, error) {
+	uniqueFileName := up.FileName
+	bucket, key := database.SplitObjectKey(uniqueFileName)
+
 	// Check file type
 	isImage := utils.IsImage(uniqueFileName)
 	isVideo := utils.IsVideo(uniqueFileName)
 	isAudio := utils.IsAudio(uniqueFileName)
+	fileType := utils.GetFileType(uniqueFileName)
+
+	// The bucket's processing profile may skip some or all renditions
+	process := utils.ProfileProcesses(up.Profile, fileType)
 
-	fileType := "other"
+	// EXIF is read before stripping removes it
+	var imageInfo *database.ImageInfo
 	if isImage {
-		fileType = "image"
-	} else if isVideo {
-		fileType = "video"
-	} else if isAudio {
-		fileType = "audio"
+		imageInfo = h.readImageInfo(uniqueFileName)
+		if h.Config.StripImageMetadata {
+			size, stripped, err := utils.StripStoredImageMetadata(h.Storage, uniqueFileName)
+			if err != nil {
+				log.Printf("Failed to strip the metadata of %s: %v", uniqueFileName, err)
+			} else if stripped {
+				up.Size = size
+			}
+		}
+	}
+
+	// Record metadata before processing starts so workers can update it
+	record := &database.ObjectRecord{
+		FileName:          uniqueFileName,
+		OriginalName:      up.OriginalName,
+		ContentType:       up.ContentType,
+		DetectedType:      up.DetectedType,
+		FileType:          fileType,
+		Size:              up.Size,
+		UploaderIP:        c.IP(),
+		UploadedAt:        time.Now(),
+		Visibility:        up.Visibility,
+		UploaderKeyID:     up.UploaderKeyID,
+		UploaderKeyName:   up.UploaderKeyName,
+		ETag:              up.ETag,
+		Image:             imageInfo,
+		ProcessingProfile: up.Profile,
+	}
+	if bucket != database.DefaultBucket {
+		record.Bucket = bucket
+	}
+
+	// Content stored before under another key reuses that upload's renditions
+	hash, duplicates := h.contentHash(uniqueFileName)
+	record.SHA256 = hash
+	var reused map[string]string
+	if process && len(duplicates) > 0 {
+		reused = h.reuseRenditions(uniqueFileName, up.Profile, duplicates)
+	}
+	if reused != nil {
+		now := time.Now()
+		record.Renditions = reused
+		record.ProcessingStatus = database.ProcessingCompleted
+		record.ProcessedAt = &now
+		process = false
+	}
+
+	if process && (isImage || ((isVideo || isAudio) && utils.CheckFFmpegInstalled())) {
+		record.ProcessingStatus = database.ProcessingPending
+	}
+	if err := h.DB.PutObject(record); err != nil {
+		h.Storage.Delete(uniqueFileName)
+		return nil, 0, fmt.Errorf("%w: %v", errMetadataNotSaved, err)
 	}
 
 	// Prepare response
 	response := models.UploadResponse{
-		Success:     true,
-		Message:     "File uploaded successfully",
-		FileName:    uniqueFileName,
-		FileURL:     fmt.Sprintf("%s/api/files/%s", h.Config.BaseURL, uniqueFileName),
-		MetadataURL: fmt.Sprintf("%s/api/files/metadata/%s", h.Config.BaseURL, uniqueFileName),
-		FileSize:    file.Size,
-		FileType:    fileType,
-		IsImage:     isImage,
-		IsVideo:     isVideo,
-		IsAudio:     isAudio,
+		Success:      true,
+		Message:      "File uploaded successfully",
+		Bucket:       bucket,
+		FileName:     key,
+		OriginalName: up.OriginalName,
+		FileURL:      h.objectURL(uniqueFileName, "download"),
+		MetadataURL:  h.objectURL(uniqueFileName, "metadata"),
+		FileSize:     up.Size,
+		DetectedType: record.DetectedType,
+		FileType:     fileType,
+		IsImage:      isImage,
+		IsVideo:      isVideo,
+		IsAudio:      isAudio,
+		Visibility:   up.Visibility,
+		ETag:         up.ETag,
+		SHA256:       hash,
+		Deduplicated: len(duplicates) > 0,
 	}
 
 	// Generate view URLs
 	viewURLs := &models.ViewURLs{
-		Original: fmt.Sprintf("%s/api/files/view/%s", h.Config.BaseURL, uniqueFileName),
+		Original: h.objectURL(uniqueFileName, "view"),
+	}
+	if reused != nil {
+		response.Message = "File uploaded successfully. Renditions reused from identical content"
+		if isImage {
+			setImageURLs(viewURLs, reused, h.objectURL)
+		}
 	}
 
-	// Get global worker pool for background processing
-	workerPool := utils.GetWorkerPool()
+	// Background job to submit to the worker pool, if any
+	var job *utils.Job
 
 	// If image, create resized versions (non-blocking for large images)
-	if isImage {
-		// For small images (< 2MB), process synchronously for instant response
-		if file.Size < 2*1024*1024 {
-			resizedFiles, err := utils.ResizeImage(fullPath, h.Config.UploadDir, uniqueFileName)
-			if err == nil && len(resizedFiles) > 0 {
-				// Add resized version URLs
-				if thumbnail, ok := resizedFiles["thumbnail"]; ok {
-					viewURLs.Thumbnail = fmt.Sprintf("%s/api/files/view/%s", h.Config.BaseURL, thumbnail)
-				}
-				if small, ok := resizedFiles["small"]; ok {
-					viewURLs.Small = fmt.Sprintf("%s/api/files/view/%s", h.Config.BaseURL, small)
-				}
-				if medium, ok := resizedFiles["medium"]; ok {
-					viewURLs.Medium = fmt.Sprintf("%s/api/files/view/%s", h.Config.BaseURL, medium)
-				}
-				if large, ok := resizedFiles["large"]; ok {
-					viewURLs.Large = fmt.Sprintf("%s/api/files/view/%s", h.Config.BaseURL, large)
-				}
-			}
+	if isImage && process {
+		// For small images (< 2MB), process synchronously for instant response.
+		// A job still running for a replaced object goes first, so the new
+		// one is queued behind it.
+		if up.Size < 2*1024*1024 && !utils.GetWorkerPool().HasActiveJob(uniqueFileName) {
+			resizedFiles, err := utils.ResizeImage(c.UserContext(), h.Storage, uniqueFileName, up.Profile)
+			utils.RecordProcessingResult(h.DB, uniqueFileName, resizedFiles, err)
+			// Add resized version URLs
+			setImageURLs(viewURLs, resizedFiles, h.objectURL)
 		} else {
 			// For large images (>= 2MB), process in worker pool
-			workerPool.Submit(utils.Job{
-				Type:      "image",
-				FilePath:  fullPath,
-				UploadDir: h.Config.UploadDir,
-				FileName:  uniqueFileName,
-			})
+			job = &utils.Job{
+				Type:     "image",
+				FileName: uniqueFileName,
+				Profile:  up.Profile,
+			}
 			response.Message = "File uploaded successfully. Image processing in progress..."
 		}
 	}
 
 	// If video, create multiple resolutions and thumbnail
-	if isVideo && utils.CheckFFmpegInstalled() {
-		// Submit to worker pool for controlled concurrent processing
-		workerPool.Submit(utils.Job{
-			Type:      "video",
-			FilePath:  fullPath,
-			UploadDir: h.Config.UploadDir,
-			FileName:  uniqueFileName,
-		})
+	if isVideo && process && utils.CheckFFmpegInstalled() {
+		// Processed in worker pool for controlled concurrent processing
+		job = &utils.Job{
+			Type:     "video",
+			FileName: uniqueFileName,
+			Profile:  up.Profile,
+		}
 		// Note: Video processing happens in worker pool
 		response.Message = "File uploaded successfully. Video processing queued..."
 	}
 
 	// If audio, create multiple bitrates
-	if isAudio && utils.CheckFFmpegInstalled() {
-		// Submit to worker pool for controlled concurrent processing
-		workerPool.Submit(utils.Job{
-			Type:      "audio",
-			FilePath:  fullPath,
-			UploadDir: h.Config.UploadDir,
-			FileName:  uniqueFileName,
-		})
+	if isAudio && process && utils.CheckFFmpegInstalled() {
+		// Processed in worker pool for controlled concurrent processing
+		job = &utils.Job{
+			Type:     "audio",
+			FileName: uniqueFileName,
+			Profile:  up.Profile,
+		}
 		// Note: Audio processing happens in worker pool
 		response.Message = "File uploaded successfully. Audio processing queued..."
 	}
 
 	response.ViewURLs = viewURLs
 
-	return c.Status(fiber.StatusOK).JSON(response)
+	status := fiber.StatusOK
+
+	// Submit to the global worker pool for background processing
+	if job != nil {
+		workerPool := utils.GetWorkerPool()
+		jobID, err := workerPool.SubmitTimeout(*job, h.Config.JobSubmitTimeout)
+		response.JobStatus = "queued"
+
+		if errors.Is(err, utils.ErrQueueFull) {
+			// Discarding a replacing upload would lose the object it replaced.
+			// queueRejects turned those away before the swap while it could.
+			if queueFullPolicy != "defer" && !up.Replaced {
+				// Drop the upload so the client can retry it as a whole
+				h.discardUpload(uniqueFileName)
+				return nil, 0, errUploadRejected
+			}
+
+			// Keep the upload and process it once the queue has room
+			jobID, err = workerPool.Defer(*job)
+			response.JobStatus = "deferred"
+			response.Message = "File uploaded successfully. Processing deferred until the queue has room..."
+			status = fiber.StatusAccepted
+		}
+
+		if err != nil {
+			// The object stays pending and is picked up by reconciliation on restart
+			log.Printf("Failed to queue %s processing for %s: %v", job.Type, uniqueFileName, err)
+			response.Message = "File uploaded successfully, but processing could not be queued yet"
+			response.JobStatus = ""
+			status = fiber.StatusOK
+		} else {
+			response.JobID = jobID
+			response.JobURL = fmt.Sprintf("%s/api/jobs/%s", h.Config.BaseURL, jobID)
+		}
+	}
+
+	return &response, status, nil
 }
 
-// DownloadFile handles file download
-func (h *FileHandler) DownloadFile(c *fiber.Ctx) error {
-	filename := c.Params("filename")
-	if filename == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-			Success: false,
-			Message: "Filename is required",
-		})
+// queueRejects reports whether processing an upload of size bytes stored
+// under key would be turned away by a full queue. Uploads replacing an
+// object check it before the swap, so a rejected upload leaves the object
+// stored under key in place.
+func (h *FileHandler) queueRejects(key string, size int64, profile string) bool {
+	if h.Config.QueueFullPolicy == "defer" || !h.needsJob(key, size, profile) {
+		return false
 	}
+	return !utils.GetWorkerPool().WaitForRoom(h.Config.JobSubmitTimeout)
+}
 
-	// Prevent directory traversal
-	filename = filepath.Base(filename)
+// needsJob reports whether processUpload may submit a background job for
+// an upload of size bytes stored under key
+func (h *FileHandler) needsJob(key string, size int64, profile string) bool {
+	fileType := utils.GetFileType(key)
+	if !utils.ProfileProcesses(profile, fileType) {
+		return false
+	}
+	switch fileType {
+	case "image":
+		return size >= 2*1024*1024 || utils.GetWorkerPool().HasActiveJob(key)
+	case "video", "audio":
+		return utils.CheckFFmpegInstalled()
+	}
+	return false
+}
 
-	// Create full path
-	fullPath := filepath.Join(h.Config.UploadDir, filename)
+// setImageURLs adds the view URLs of the image renditions to urls
+func setImageURLs(urls *models.ViewURLs, renditions map[string]string, objectURL func(storageKey, endpoint string) string) {
+	if thumbnail, ok := renditions["thumbnail"]; ok {
+		urls.Thumbnail = objectURL(thumbnail, "view")
+	}
+	if small, ok := renditions["small"]; ok {
+		urls.Small = objectURL(small, "view")
+	}
+	if medium, ok := renditions["medium"]; ok {
+		urls.Medium = objectURL(medium, "view")
+	}
+	if large, ok := renditions["large"]; ok {
+		urls.Large = objectURL(large, "view")
+	}
+}
 
-	// Check if file exists
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+// uploadError writes the response for an error returned by processUpload
+func uploadError(c *fiber.Ctx, err error, retryAfter int) error {
+	if errors.Is(err, errUploadRejected) {
+		c.Set("Retry-After", strconv.Itoa(retryAfter))
+		return c.Status(fiber.StatusServiceUnavailable).JSON(models.ErrorResponse{
 			Success: false,
-			Message: "File not found",
+			Message: "Processing queue is full, please retry later",
 		})
 	}
+	return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+		Success: false,
+		Message: "Failed to save file metadata",
+	})
+}
 
-	// Set content disposition header for download
-	c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+// contentMismatch writes the 415 response for an upload rejected by checkContent
+func contentMismatch(c *fiber.Ctx, err error) error {
+	return c.Status(fiber.StatusUnsupportedMediaType).JSON(models.ErrorResponse{
+		Success: false,
+		Message: err.Error(),
+	})
+}
 
-	// Send file
-	return c.SendFile(fullPath)
+// uploaderIdentity returns the API key an upload is attributed to: the key
+// of the request, or the key that minted its upload policy
+func uploaderIdentity(c *fiber.Ctx, policy *auth.UploadPolicy) (string, string) {
+	if key := auth.KeyFromContext(c); key != nil {
+		return key.ID, key.Name
+	}
+	if policy != nil {
+		return policy.KeyID, policy.KeyName
+	}
+	return "", ""
 }
 
-// ViewFile handles file viewing (inline)
-func (h *FileHandler) ViewFile(c *fiber.Ctx) error {
-	filename := c.Params("filename")
-	if filename == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-			Success: false,
-			Message: "Filename is required",
-		})
+// ownsUpload reports whether the request may act on a resumable upload
+// started by the API key ownerKeyID. Uploads started without a key are
+// open to every caller; admin keys may act on any upload.
+func ownsUpload(c *fiber.Ctx, ownerKeyID string) bool {
+	if ownerKeyID == "" {
+		return true
 	}
+	key := auth.KeyFromContext(c)
+	return key != nil && (key.ID == ownerKeyID || auth.HasScope(key, auth.ScopeAdmin))
+}
 
-	// Prevent directory traversal
-	filename = filepath.Base(filename)
+// discardUpload removes a stored upload and its metadata record
+func (h *FileHandler) discardUpload(filename string) {
+	if err := h.Storage.Delete(filename); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("Failed to remove discarded upload %s: %v", filename, err)
+	}
+	if err := h.DB.DeleteObject(filename); err != nil && !errors.Is(err, database.ErrNotFound) {
+		log.Printf("Failed to remove metadata of discarded upload %s: %v", filename, err)
+	}
+}
 
-	// Create full path
-	fullPath := filepath.Join(h.Config.UploadDir, filename)
+// formUpload reads the "file" part of a multipart form
+func formUpload(c *fiber.Ctx) (*incomingUpload, error) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		return nil, errors.New("No file uploaded or invalid form data")
+	}
+	return &incomingUpload{
+		Name:        file.Filename,
+		Size:        file.Size,
+		ContentType: file.Header.Get("Content-Type"),
+		Open: func() (io.ReadCloser, error) {
+			return file.Open()
+		},
+	}, nil
+}
 
-	// Check if file exists
-	fileInfo, err := os.Stat(fullPath)
-	if os.IsNotExist(err) {
-		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
-			Success: false,
-			Message: "File not found",
-		})
+// rawUpload takes the request body as the file content, named by
+// ?filename= or else by the last segment of ?key=
+func rawUpload(c *fiber.Ctx) (*incomingUpload, error) {
+	name := filepath.Base(c.Query("filename", c.Query("key")))
+	if name == "." || name == "/" {
+		return nil, errors.New("filename query parameter is required")
+	}
+	size := int64(c.Request().Header.ContentLength())
+	if size < 0 {
+		return nil, errors.New("Content-Length is required")
 	}
+	return &incomingUpload{
+		Name:        name,
+		Size:        size,
+		ContentType: c.Get(fiber.HeaderContentType),
+		Open: func() (io.ReadCloser, error) {
+			if body := c.Request().BodyStream(); body != nil {
+				return io.NopCloser(body), nil
+			}
+			return io.NopCloser(bytes.NewReader(c.Body())), nil
+		},
+	}, nil
+}
+
+// DownloadFile handles file download (supports Range and conditional requests)
+func (h *FileHandler) DownloadFile(c *fiber.Ctx) error {
+	return h.sendFile(c, database.DefaultBucket, "attachment")
+}
+
+// ViewFile handles file viewing (inline, supports Range and conditional requests)
+func (h *FileHandler) ViewFile(c *fiber.Ctx) error {
+	return h.sendFile(c, database.DefaultBucket, "inline")
+}
 
-	// Open file
-	file, err := os.Open(fullPath)
+// sendFile serves the object named by the route's key from bucket with an
+// inline or attachment Content-Disposition, unless a presigned URL forces
+// another one. The file name offered is the upload's original name, or the
+// one given by ?filename=.
+func (h *FileHandler) sendFile(c *fiber.Ctx, bucket, dispositionType string) error {
+	_, key, err := requestKey(c, bucket)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
-			Success: false,
-			Message: "Failed to open file",
-		})
+		return badRequest(c, err.Error())
 	}
-	defer file.Close()
-
-	// Set content type
-	contentType := utils.GetContentType(filename)
-	c.Set("Content-Type", contentType)
-	c.Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", filename))
-	c.Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
 
-	// Stream file
-	_, err = io.Copy(c.Response().BodyWriter(), file)
+	disposition, err := h.authorizeRead(c, key)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
-			Success: false,
-			Message: "Failed to stream file",
-		})
+		return accessDenied(c, err)
 	}
 
-	return nil
+	served := key
+	if dispositionType == "inline" {
+		served = h.negotiateVariant(c, key)
+	}
+	if disposition == "" {
+		name := c.Query("filename")
+		if name == "" {
+			name = h.downloadName(key)
+			if served != key {
+				name = strings.TrimSuffix(name, path.Ext(name)) + path.Ext(served)
+			}
+		}
+		disposition = contentDisposition(dispositionType, path.Base(name))
+	}
+	return h.serveObject(c, served, disposition)
 }
 
-// GetFileInfo returns file information (deprecated, use GetFileMetadata)
-func (h *FileHandler) GetFileInfo(c *fiber.Ctx) error {
-	filename := c.Params("filename")
-	if filename == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-			Success: false,
-			Message: "Filename is required",
-		})
+// downloadName returns the file name offered to clients saving the object
+// stored under key: the name it was uploaded with, or the last segment of
+// its key. Renditions are named after their original, e.g. "Beach_small.jpg".
+func (h *FileHandler) downloadName(key string) string {
+	rec, err := h.DB.GetObject(key)
+	if err == nil && rec.OriginalName != "" {
+		return rec.OriginalName
 	}
 
-	// Prevent directory traversal
-	filename = filepath.Base(filename)
+	if stem, ok := utils.DerivativeStem(key); ok && errors.Is(err, database.ErrNotFound) {
+		original, err := h.DB.FindObjectByStem(path.Join(path.Dir(key), stem))
+		if err == nil && original.OriginalName != "" {
+			name := path.Base(original.OriginalName)
+			suffix := strings.TrimPrefix(path.Base(key), stem)
+			return strings.TrimSuffix(name, path.Ext(name)) + suffix
+		}
+	}
+	return path.Base(key)
+}
 
-	// Create full path
-	fullPath := filepath.Join(h.Config.UploadDir, filename)
+// GetFileInfo returns file information (deprecated, use GetFileMetadata)
+func (h *FileHandler) GetFileInfo(c *fiber.Ctx) error {
+	filename, _, err := requestKey(c, database.DefaultBucket)
+	if err != nil {
+		return badRequest(c, err.Error())
+	}
+	if _, err := h.authorizeRead(c, filename); err != nil {
+		return accessDenied(c, err)
+	}
 
 	// Check if file exists
-	fileInfo, err := os.Stat(fullPath)
-	if os.IsNotExist(err) {
-		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
-			Success: false,
-			Message: "File not found",
-		})
+	fileInfo, err := h.Storage.Stat(filename)
+	if err != nil {
+		return h.storageError(c, err)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"success":   true,
 		"file_name": filename,
-		"file_size": fileInfo.Size(),
-		"modified":  fileInfo.ModTime(),
+		"file_size": fileInfo.Size,
+		"modified":  fileInfo.ModTime,
 	})
 }
 
 // GetFileMetadata returns detailed file metadata including all URLs
 func (h *FileHandler) GetFileMetadata(c *fiber.Ctx) error {
-	filename := c.Params("filename")
-	if filename == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-			Success: false,
-			Message: "Filename is required",
-		})
-	}
-
-	// Prevent directory traversal
-	filename = filepath.Base(filename)
+	return h.fileMetadata(c, database.DefaultBucket)
+}
 
-	// Create full path
-	fullPath := filepath.Join(h.Config.UploadDir, filename)
+// fileMetadata sends the metadata of the object named by the route's key
+// in bucket. Reading it follows the same rules as viewing the object.
+func (h *FileHandler) fileMetadata(c *fiber.Ctx, bucket string) error {
+	filename, key, err := requestKey(c, bucket)
+	if err != nil {
+		return badRequest(c, err.Error())
+	}
+	if _, err := h.authorizeRead(c, key); err != nil {
+		return accessDenied(c, err)
+	}
 
-	// Check if file exists
-	fileInfo, err := os.Stat(fullPath)
-	if os.IsNotExist(err) {
-		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
-			Success: false,
-			Message: "File not found",
-		})
+	// Uploads made since the metadata store was introduced have a record
+	record, err := h.DB.GetObject(key)
+	if errors.Is(err, database.ErrNotFound) {
+		// Files without a record (renditions, legacy uploads) are probed in storage
+		record, err = h.probeFileMetadata(key)
+	}
+	if err != nil {
+		return h.storageError(c, err)
 	}
 
 	isImage := utils.IsImage(filename)
 	isVideo := utils.IsVideo(filename)
 	isAudio := utils.IsAudio(filename)
-	contentType := utils.GetContentType(filename)
-
-	fileType := "other"
-	if isImage {
-		fileType = "image"
-	} else if isVideo {
-		fileType = "video"
-	} else if isAudio {
-		fileType = "audio"
-	}
 
 	// Build URLs
 	urls := map[string]string{
-		"download": fmt.Sprintf("%s/api/files/%s", h.Config.BaseURL, filename),
-		"view":     fmt.Sprintf("%s/api/files/view/%s", h.Config.BaseURL, filename),
-		"metadata": fmt.Sprintf("%s/api/files/metadata/%s", h.Config.BaseURL, filename),
+		"download": h.objectURL(key, "download"),
+		"view":     h.objectURL(key, "view"),
+		"metadata": h.objectURL(key, "metadata"),
 	}
 
-	ext := filepath.Ext(filename)
-	nameWithoutExt := filename[:len(filename)-len(ext)]
+	// Add URLs for renditions that have been generated
+	for name, renditionFile := range record.Renditions {
+		urlKey := fmt.Sprintf("view_%s", name)
+		if isVideo && name == "thumbnail" {
+			urlKey = "thumbnail"
+		} else if isAudio {
+			urlKey = fmt.Sprintf("audio_%s", name)
+		}
+		urls[urlKey] = h.objectURL(renditionFile, "view")
+	}
 
-	// If image, check for resized versions
+	metadata := models.FileMetadata{
+		Success:          true,
+		Bucket:           bucket,
+		FileName:         filename,
+		OriginalName:     record.OriginalName,
+		FileSize:         record.Size,
+		ContentType:      record.ContentType,
+		DetectedType:     record.DetectedType,
+		FileType:         record.FileType,
+		IsImage:          isImage,
+		IsVideo:          isVideo,
+		IsAudio:          isAudio,
+		UploadedAt:       record.UploadedAt.Format("2006-01-02T15:04:05Z07:00"),
+		UploaderIP:       record.UploaderIP,
+		UploaderKeyID:    record.UploaderKeyID,
+		UploaderKeyName:  record.UploaderKeyName,
+		Visibility:       h.visibility(record),
+		ETag:             record.ETag,
+		SHA256:           record.SHA256,
+		JobID:            record.JobID,
+		ProcessingStatus: record.ProcessingStatus,
+		ProcessingError:  record.ProcessingError,
+		URLs:             urls,
+	}
 	if isImage {
-		resolutions := []string{"thumbnail", "small", "medium", "large"}
-
-		for _, res := range resolutions {
-			resizedFilename := fmt.Sprintf("%s_%s%s", nameWithoutExt, res, ext)
-			resizedPath := filepath.Join(h.Config.UploadDir, resizedFilename)
-			if _, err := os.Stat(resizedPath); err == nil {
-				urls[fmt.Sprintf("view_%s", res)] = fmt.Sprintf("%s/api/files/view/%s", h.Config.BaseURL, resizedFilename)
+		info := record.Image
+		if info == nil {
+			// Uploaded before image metadata was recorded
+			info = h.readImageInfo(record.FileName)
+		}
+		if info != nil {
+			metadata.Image = &models.ImageMetadata{
+				Width:       info.Width,
+				Height:      info.Height,
+				Orientation: info.Orientation,
+				Camera:      info.Camera,
+				TakenAt:     info.TakenAt,
 			}
 		}
 	}
 
-	// If video, check for processed versions
-	if isVideo {
-		// Check for thumbnail
-		thumbnailFilename := fmt.Sprintf("%s_thumbnail.jpg", nameWithoutExt)
-		thumbnailPath := filepath.Join(h.Config.UploadDir, thumbnailFilename)
-		if _, err := os.Stat(thumbnailPath); err == nil {
-			urls["thumbnail"] = fmt.Sprintf("%s/api/files/view/%s", h.Config.BaseURL, thumbnailFilename)
-		}
+	return c.Status(fiber.StatusOK).JSON(metadata)
+}
 
-		// Check for video resolutions
-		resolutions := []string{"360p", "480p", "720p", "1080p"}
-		for _, res := range resolutions {
-			resFilename := fmt.Sprintf("%s_%s%s", nameWithoutExt, res, ext)
-			resPath := filepath.Join(h.Config.UploadDir, resFilename)
-			if _, err := os.Stat(resPath); err == nil {
-				urls[fmt.Sprintf("view_%s", res)] = fmt.Sprintf("%s/api/files/view/%s", h.Config.BaseURL, resFilename)
-			}
+// probeFileMetadata builds a metadata record for a file that has none
+// by inspecting storage and checking which renditions exist
+func (h *FileHandler) probeFileMetadata(filename string) (*database.ObjectRecord, error) {
+	fileInfo, err := h.Storage.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &database.ObjectRecord{
+		FileName:    filename,
+		ContentType: utils.GetContentType(filename),
+		FileType:    utils.GetFileType(filename),
+		Size:        fileInfo.Size,
+		UploadedAt:  fileInfo.ModTime,
+		Renditions:  make(map[string]string),
+	}
+
+	for _, rendition := range utils.GetRenditions(filename) {
+		if _, err := h.Storage.Stat(rendition.FileName); err == nil {
+			record.Renditions[rendition.Name] = rendition.FileName
 		}
 	}
 
-	// If audio, check for different bitrates
-	if isAudio {
-		bitrates := []string{"low", "medium", "high"}
-		for _, quality := range bitrates {
-			audioFilename := fmt.Sprintf("%s_%s.mp3", nameWithoutExt, quality)
-			audioPath := filepath.Join(h.Config.UploadDir, audioFilename)
-			if _, err := os.Stat(audioPath); err == nil {
-				urls[fmt.Sprintf("audio_%s", quality)] = fmt.Sprintf("%s/api/files/view/%s", h.Config.BaseURL, audioFilename)
-			}
+	return record, nil
+}
+
+// DeleteFile removes a file together with all of its renditions
+func (h *FileHandler) DeleteFile(c *fiber.Ctx) error {
+	return h.removeFile(c, database.DefaultBucket)
+}
+
+// removeFile deletes the object named by the route's key from bucket
+// together with its renditions
+func (h *FileHandler) removeFile(c *fiber.Ctx, bucket string) error {
+	filename, key, err := requestKey(c, bucket)
+	if err != nil {
+		return badRequest(c, err.Error())
+	}
+
+	// Check if file exists
+	if _, err := h.Storage.Stat(key); err != nil {
+		return h.storageError(c, err)
+	}
+
+	deleted, jobCancelled, err := h.deleteObject(key)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Failed to delete file",
+		})
+	}
+	for i, storageKey := range deleted {
+		_, deleted[i] = database.SplitObjectKey(storageKey)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(models.DeleteResponse{
+		Success:      true,
+		Message:      "File deleted successfully",
+		FileName:     filename,
+		DeletedFiles: deleted,
+		JobCancelled: jobCancelled,
+	})
+}
+
+// deleteObject removes filename with its metadata and renditions and
+// returns the deleted files and whether pending processing was cancelled
+func (h *FileHandler) deleteObject(filename string) ([]string, bool, error) {
+	// Stop pending processing so renditions are not recreated after deletion
+	jobCancelled := utils.GetWorkerPool().Cancel(filename)
+
+	// The record goes only once the object is gone, so a failed delete
+	// leaves both in place to be retried
+	var deleted []string
+	err := h.Storage.Delete(filename)
+	if err == nil {
+		deleted = append(deleted, filename)
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return nil, jobCancelled, err
+	}
+
+	if err := h.DB.DeleteObject(filename); err != nil && !errors.Is(err, database.ErrNotFound) {
+		log.Printf("Failed to delete metadata for %s: %v", filename, err)
+	}
+
+	return append(deleted, h.deleteRenditions(filename)...), jobCancelled, nil
+}
+
+// deleteRenditions removes the renditions generated for filename and its
+// cached image transforms
+func (h *FileHandler) deleteRenditions(filename string) []string {
+	h.purgeTransforms(filename)
+
+	var deleted []string
+	for _, rendition := range utils.GetRenditions(filename) {
+		err := h.Storage.Delete(rendition.FileName)
+		if err == nil {
+			deleted = append(deleted, rendition.FileName)
+		} else if !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Failed to delete rendition %s: %v", rendition.FileName, err)
 		}
 	}
+	return deleted
+}
 
-	metadata := models.FileMetadata{
-		Success:     true,
-		FileName:    filename,
-		FileSize:    fileInfo.Size(),
-		ContentType: contentType,
-		FileType:    fileType,
-		IsImage:     isImage,
-		IsVideo:     isVideo,
-		IsAudio:     isAudio,
-		UploadedAt:  fileInfo.ModTime().Format("2006-01-02T15:04:05Z07:00"),
-		URLs:        urls,
+// storageError maps a storage driver error to an HTTP error response
+func (h *FileHandler) storageError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "File not found",
+		})
 	}
+	return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+		Success: false,
+		Message: "Storage error",
+	})
+}
 
-	return c.Status(fiber.StatusOK).JSON(metadata)
+// readImageInfo returns the dimensions and EXIF fields of the image stored
+// under key, nil when it cannot be read
+func (h *FileHandler) readImageInfo(key string) *database.ImageInfo {
+	info, err := utils.ReadImageInfo(h.Storage, key)
+	if err != nil {
+		log.Printf("Failed to read the image metadata of %s: %v", key, err)
+		return nil
+	}
+	return info
 }
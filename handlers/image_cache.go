@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cacheTouchInterval is how stale the access time of a cached transform
+// may get before a hit refreshes it, so hits rarely cost a write
+const cacheTouchInterval = time.Hour
+
+// cachedTransform is a file of the transform cache
+type cachedTransform struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// touchCached marks a cached transform as recently used. The modification
+// time orders entries for eviction.
+func (h *FileHandler) touchCached(cachePath string, info os.FileInfo) {
+	if h.Config.ImageCacheMaxSize == 0 || time.Since(info.ModTime()) < cacheTouchInterval {
+		return
+	}
+	now := time.Now()
+	if err := os.Chtimes(cachePath, now, now); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to touch cached transform %s: %v", cachePath, err)
+	}
+}
+
+// cacheAdded accounts for a transform of size bytes just rendered to
+// cachePath and evicts the least recently used other entries once the
+// cache grows past IMAGE_CACHE_MAX_SIZE. Purged objects are only noticed
+// by the next eviction, which measures the cache again.
+func (h *FileHandler) cacheAdded(cachePath string, size int64) {
+	limit := h.Config.ImageCacheMaxSize
+	if limit == 0 {
+		return
+	}
+
+	h.cacheMu.Lock()
+	defer h.cacheMu.Unlock()
+
+	if h.cacheMeasured {
+		h.cacheSize += size
+		if h.cacheSize <= limit {
+			return
+		}
+	}
+
+	entries, total, err := h.listCache()
+	if err != nil {
+		log.Printf("Failed to measure the transform cache: %v", err)
+		return
+	}
+	h.cacheSize, h.cacheMeasured = total, true
+	if total <= limit {
+		return
+	}
+
+	// Evict down to 90% of the limit, so the next renders do not each
+	// trigger another scan
+	target := limit / 10 * 9
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	evicted := 0
+	for _, entry := range entries {
+		if h.cacheSize <= target {
+			break
+		}
+		// About to be served
+		if entry.path == cachePath {
+			continue
+		}
+		if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to evict cached transform %s: %v", entry.path, err)
+			continue
+		}
+		h.cacheSize -= entry.size
+		evicted++
+		// Only succeeds once the object has no cached transforms left
+		os.Remove(filepath.Dir(entry.path))
+	}
+	log.Printf("[Image cache] Evicted %d transforms, %d bytes cached", evicted, h.cacheSize)
+}
+
+// listCache returns the cached transforms and their total size. Renders
+// still being written are left out.
+func (h *FileHandler) listCache() ([]cachedTransform, int64, error) {
+	var entries []cachedTransform
+	var total int64
+	err := filepath.WalkDir(h.Config.ImageCacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// Evicted or purged meanwhile
+			return nil
+		}
+		entries = append(entries, cachedTransform{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	return entries, total, err
+}
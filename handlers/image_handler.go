@@ -0,0 +1,450 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"object-storage-server/auth"
+	"object-storage-server/database"
+	"object-storage-server/models"
+	"object-storage-server/storage"
+	"object-storage-server/utils"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxTransformSourcePixels is the largest source image transforms decode,
+// as a full decode holds four bytes per pixel in memory
+const maxTransformSourcePixels = 50_000_000
+
+// errImageTooLarge is returned for source images over maxTransformSourcePixels
+var errImageTooLarge = errors.New("image is too large to transform")
+
+// ImageSignRequest is the body of POST /api/img/sign
+type ImageSignRequest struct {
+	Bucket   string `json:"bucket"` // Defaults to the default bucket
+	FileName string `json:"file_name"`
+	Width    int    `json:"w"`
+	Height   int    `json:"h"`
+	Fit      string `json:"fit"` // "contain" (default), "cover" or "fill"
+	Quality  int    `json:"q"`   // JPEG, WebP and AVIF quality, defaults to 85
+	Format   string `json:"fmt"` // "jpg", "png", "gif", "webp" or "avif", defaults to the source format
+}
+
+// TransformImage serves an image of the default bucket resized and
+// re-encoded on the fly, see transformImage
+func (h *FileHandler) TransformImage(c *fiber.Ctx) error {
+	return h.transformImage(c, database.DefaultBucket)
+}
+
+// TransformBucketImage serves a transformed image of the bucket, like TransformImage
+func (h *FileHandler) TransformBucketImage(c *fiber.Ctx) error {
+	bucket, err := h.bucket(c.Params("bucket"))
+	if err != nil {
+		return bucketError(c, err)
+	}
+	return h.transformImage(c, bucket.Name)
+}
+
+// transformImage serves the image named by the wildcard route parameter
+// resized and re-encoded according to ?w=&h=&fit=&q=&fmt=. Results are
+// cached on disk below IMAGE_CACHE_DIR until the object changes. Reading
+// the source follows the same rules as viewing it.
+func (h *FileHandler) transformImage(c *fiber.Ctx, bucket string) error {
+	_, key, err := requestKey(c, bucket)
+	if err != nil {
+		return badRequest(c, err.Error())
+	}
+	if utils.GetFileType(key) != "image" {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Only images can be transformed",
+		})
+	}
+
+	t, err := h.parseTransform(c.Query, key)
+	if err != nil {
+		return badRequest(c, err.Error())
+	}
+	if err := h.authorizeTransform(c, key, t); err != nil {
+		return accessDenied(c, err)
+	}
+	if _, err := h.authorizeRead(c, key); err != nil {
+		return accessDenied(c, err)
+	}
+
+	info, err := h.Storage.Stat(key)
+	if err != nil {
+		return h.storageError(c, err)
+	}
+
+	cachePath := h.transformCachePath(key, t, info)
+	etag := `"` + strings.TrimSuffix(filepath.Base(cachePath), filepath.Ext(cachePath)) + `"`
+	modTime := info.ModTime.UTC().Truncate(time.Second)
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderLastModified, modTime.Format(http.TimeFormat))
+
+	switch checkPreconditions(c, etag, modTime) {
+	case fiber.StatusNotModified:
+		return c.SendStatus(fiber.StatusNotModified)
+	case fiber.StatusPreconditionFailed:
+		return c.Status(fiber.StatusPreconditionFailed).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Precondition failed",
+		})
+	}
+
+	cached, err := os.Stat(cachePath)
+	if err != nil {
+		if err := h.renderTransform(key, t, cachePath); err != nil {
+			return h.transformError(c, key, err)
+		}
+		if cached, err = os.Stat(cachePath); err != nil {
+			return h.transformError(c, key, err)
+		}
+	} else {
+		h.touchCached(cachePath, cached)
+	}
+
+	name := strings.TrimSuffix(path.Base(key), path.Ext(key)) + "." + t.Format
+	c.Set(fiber.HeaderContentType, t.ContentType())
+	c.Set(fiber.HeaderContentDisposition, contentDisposition("inline", name))
+	return h.sendBody(c, cached.Size(), func() (io.ReadCloser, error) {
+		return os.Open(cachePath)
+	})
+}
+
+// parseTransform reads the transform parameters of an image stored under
+// key through query. Missing parameters keep the source size and format.
+func (h *FileHandler) parseTransform(query func(key string, defaultValue ...string) string, key string) (utils.ImageTransform, error) {
+	t := utils.ImageTransform{
+		Fit:     utils.FitContain,
+		Quality: utils.DefaultImageQuality,
+		Format:  utils.ImageFormat(path.Ext(key)),
+	}
+
+	maxDimension := h.Config.ImageTransformMaxDimension
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"w", &t.Width}, {"h", &t.Height}} {
+		v := query(param.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxDimension {
+			return t, fmt.Errorf("%s must be between 0 and %d pixels", param.name, maxDimension)
+		}
+		*param.value = n
+	}
+
+	if fit := query("fit"); fit != "" {
+		switch fit {
+		case utils.FitContain, utils.FitCover, utils.FitFill:
+			t.Fit = fit
+		default:
+			return t, errors.New("fit must be \"contain\", \"cover\" or \"fill\"")
+		}
+	}
+	if t.Fit != utils.FitContain && (t.Width == 0 || t.Height == 0) {
+		return t, fmt.Errorf("fit=%s needs both w and h", t.Fit)
+	}
+	if t.Width == 0 || t.Height == 0 {
+		// The fit does not matter with a single side, keep one cache entry
+		t.Fit = utils.FitContain
+	}
+
+	if q := query("q"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 1 || n > 100 {
+			return t, errors.New("q must be between 1 and 100")
+		}
+		t.Quality = n
+	}
+
+	if format := strings.ToLower(query("fmt")); format != "" {
+		switch format {
+		case "jpg", "jpeg":
+			t.Format = "jpg"
+		case "png", "gif", "webp", "avif":
+			t.Format = format
+		default:
+			return t, errors.New("fmt must be \"jpg\", \"png\", \"gif\", \"webp\" or \"avif\"")
+		}
+		if !utils.CanEncodeImage(t.Format) {
+			return t, fmt.Errorf("fmt=%s is not available on this server", t.Format)
+		}
+	}
+	if t.Format == "png" || t.Format == "gif" {
+		// Quality only applies to lossy formats
+		t.Quality = 0
+	}
+	return t, nil
+}
+
+// authorizeTransform checks that the transform of the image stored under
+// key may be served. Signed URLs may ask for any transform. Unsigned ones
+// are refused with IMAGE_TRANSFORM_SIGNED or without IMAGE_TRANSFORM_SIZES,
+// and otherwise limited to the allowed sizes, qualities and formats, so
+// every object has a bounded number of cached variants.
+func (h *FileHandler) authorizeTransform(c *fiber.Ctx, key string, t utils.ImageTransform) error {
+	if signature := c.Query(auth.ParamTransformSignature); signature != "" {
+		if !h.Signer.VerifyTransform(c.Path(), t.Canonical(), signature) {
+			return &accessError{status: fiber.StatusForbidden, message: "Invalid transform signature"}
+		}
+		return nil
+	}
+
+	sizes := h.Config.ImageTransformSizes
+	if h.Config.ImageTransformSigned || len(sizes) == 0 {
+		return &accessError{status: fiber.StatusForbidden, message: "Image transforms need a URL signed with POST /api/img/sign"}
+	}
+
+	size := fmt.Sprintf("%dx%d", t.Width, t.Height)
+	if t.Fit != utils.FitContain {
+		size += ":" + t.Fit
+	}
+	if !slices.Contains(sizes, size) {
+		return &accessError{
+			status:  fiber.StatusForbidden,
+			message: fmt.Sprintf("Size %s is not allowed, use one of %s", size, strings.Join(sizes, ", ")),
+		}
+	}
+
+	// PNG and GIF carry no quality
+	qualities := h.Config.ImageTransformQualities
+	if t.Quality != 0 && t.Quality != utils.DefaultImageQuality && !slices.Contains(qualities, strconv.Itoa(t.Quality)) {
+		message := fmt.Sprintf("Quality %d is not allowed", t.Quality)
+		if len(qualities) > 0 {
+			message += ", use " + strings.Join(qualities, ", ") + " or leave q out"
+		}
+		return &accessError{status: fiber.StatusForbidden, message: message}
+	}
+
+	formats := h.Config.ImageTransformFormats
+	if t.Format != utils.ImageFormat(path.Ext(key)) && !slices.ContainsFunc(formats, func(format string) bool {
+		return format == t.Format || (format == "jpeg" && t.Format == "jpg")
+	}) {
+		message := fmt.Sprintf("Converting to %s is not allowed", t.Format)
+		if len(formats) > 0 {
+			message += ", use " + strings.Join(formats, ", ") + " or leave fmt out"
+		}
+		return &accessError{status: fiber.StatusForbidden, message: message}
+	}
+	return nil
+}
+
+// renderTransform writes the result of t applied to the image stored
+// under key to cachePath. At most IMAGE_TRANSFORM_CONCURRENCY transforms
+// run at a time; the result is written to a temporary file first, so
+// concurrent requests never read a partial image.
+func (h *FileHandler) renderTransform(key string, t utils.ImageTransform, cachePath string) error {
+	h.transforms <- struct{}{}
+	defer func() { <-h.transforms }()
+
+	// Another request may have rendered it while this one waited
+	if _, err := os.Stat(cachePath); err == nil {
+		return nil
+	}
+
+	width, height, err := utils.ImageDimensions(h.Storage, key)
+	if err != nil {
+		return err
+	}
+	if int64(width)*int64(height) > maxTransformSourcePixels {
+		return errImageTooLarge
+	}
+
+	dir := filepath.Dir(cachePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := utils.TransformStoredImage(h.Storage, key, t, h.Config.ImageTransformMaxDimension, tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), cachePath); err != nil {
+		return err
+	}
+	h.cacheAdded(cachePath, info.Size())
+	return nil
+}
+
+// transformError writes the response for an error returned by renderTransform
+func (h *FileHandler) transformError(c *fiber.Ctx, key string, err error) error {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return h.storageError(c, err)
+	case errors.Is(err, errImageTooLarge):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(models.ErrorResponse{
+			Success: false,
+			Message: fmt.Sprintf("Images over %d pixels cannot be transformed", maxTransformSourcePixels),
+		})
+	}
+	log.Printf("Failed to transform %s: %v", key, err)
+	return c.Status(fiber.StatusUnprocessableEntity).JSON(models.ErrorResponse{
+		Success: false,
+		Message: "Image could not be transformed",
+	})
+}
+
+// transformCachePath returns where the result of t applied to the object
+// stored under key is cached. The size and modification time of the object
+// are part of the name, so a replaced object is never served stale.
+func (h *FileHandler) transformCachePath(key string, t utils.ImageTransform, info *storage.ObjectInfo) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%d\n%d", t.Canonical(), info.Size, info.ModTime.UnixNano())))
+	return filepath.Join(h.transformCacheDir(key), hex.EncodeToString(sum[:16])+"."+t.Format)
+}
+
+// transformCacheDir returns the directory caching the transforms of the
+// object stored under key
+func (h *FileHandler) transformCacheDir(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(h.Config.ImageCacheDir, name[:2], name)
+}
+
+// purgeTransforms removes the cached transforms of the object stored under key
+func (h *FileHandler) purgeTransforms(key string) {
+	if err := os.RemoveAll(h.transformCacheDir(key)); err != nil {
+		log.Printf("Failed to purge cached transforms of %s: %v", key, err)
+	}
+}
+
+// SignImageURL returns a signed transform URL for an image. Signed URLs
+// do not expire and may ask for transforms outside the unsigned allowlist.
+func (h *FileHandler) SignImageURL(c *fiber.Ctx) error {
+	var req ImageSignRequest
+	if err := c.BodyParser(&req); err != nil {
+		return badRequest(c, "Invalid request body")
+	}
+	if req.FileName == "" {
+		return badRequest(c, "file_name must be a stored file name")
+	}
+
+	bucket, err := h.bucket(req.Bucket)
+	if err != nil {
+		return bucketError(c, err)
+	}
+	key, err := objectStorageKey(bucket.Name, req.FileName)
+	if err != nil {
+		return badRequest(c, "Invalid file_name: "+err.Error())
+	}
+	if utils.GetFileType(key) != "image" {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Only images can be transformed",
+		})
+	}
+
+	params := map[string]string{"fit": req.Fit, "fmt": req.Format}
+	for name, n := range map[string]int{"w": req.Width, "h": req.Height, "q": req.Quality} {
+		if n != 0 {
+			params[name] = strconv.Itoa(n)
+		}
+	}
+	t, err := h.parseTransform(func(name string, _ ...string) string { return params[name] }, key)
+	if err != nil {
+		return badRequest(c, err.Error())
+	}
+
+	if _, err := h.Storage.Stat(key); err != nil {
+		return h.storageError(c, err)
+	}
+
+	path := objectPath(key, "img")
+	query := url.Values{}
+	if t.Width > 0 {
+		query.Set("w", strconv.Itoa(t.Width))
+	}
+	if t.Height > 0 {
+		query.Set("h", strconv.Itoa(t.Height))
+	}
+	if t.Fit != utils.FitContain {
+		query.Set("fit", t.Fit)
+	}
+	if t.Quality > 0 {
+		query.Set("q", strconv.Itoa(t.Quality))
+	}
+	query.Set("fmt", t.Format)
+	query.Set(auth.ParamTransformSignature, h.Signer.SignTransform(path, t.Canonical()))
+
+	return c.JSON(models.SignedImageResponse{
+		Success: true,
+		URL:     fmt.Sprintf("%s%s?%s", h.Config.BaseURL, path, query.Encode()),
+	})
+}
+
+// negotiateVariant returns the key of the variant of the image rendition
+// stored under key that the request's Accept header prefers, or key itself
+// when no stored variant is named there. Wildcards such as "image/*" do not
+// select a variant, as clients sending only those may not decode it.
+// Responses for image renditions vary by Accept.
+func (h *FileHandler) negotiateVariant(c *fiber.Ctx, key string) string {
+	if !utils.IsImage(key) || !utils.IsDerivative(key) {
+		return key
+	}
+	c.Vary(fiber.HeaderAccept)
+
+	accept := c.Get(fiber.HeaderAccept)
+	best, bestQuality := key, 0.0
+	for _, format := range utils.VariantFormats {
+		quality := acceptQuality(accept, "image/"+format)
+		if quality <= bestQuality {
+			continue
+		}
+		variant := utils.VariantName(key, format)
+		if _, err := h.Storage.Stat(variant); err == nil {
+			best, bestQuality = variant, quality
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the q-value an Accept header gives mediaType by
+// name, 0 when it is not listed
+func acceptQuality(header, mediaType string) float64 {
+	for _, entry := range strings.Split(header, ",") {
+		params := strings.Split(entry, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), mediaType) {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		return quality
+	}
+	return 0
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"errors"
+	"object-storage-server/config"
+	"object-storage-server/database"
+	"object-storage-server/models"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type JobHandler struct {
+	Config *config.Config
+	DB     *database.DB
+}
+
+func NewJobHandler(cfg *config.Config, db *database.DB) *JobHandler {
+	return &JobHandler{Config: cfg, DB: db}
+}
+
+// GetJob returns the status of a background processing job
+func (h *JobHandler) GetJob(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if id == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Job ID is required",
+		})
+	}
+
+	job, err := h.DB.GetJob(id)
+	if errors.Is(err, database.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Job not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Failed to load job",
+		})
+	}
+
+	bucket, fileName := database.SplitObjectKey(job.FileName)
+	status := models.JobStatus{
+		Success:  true,
+		ID:       job.ID,
+		Type:     job.Type,
+		Bucket:   bucket,
+		FileName: fileName,
+		Status:   job.Status,
+		Error:    job.Error,
+		QueuedAt: job.QueuedAt.Format(time.RFC3339),
+	}
+
+	for _, r := range job.Renditions {
+		_, renditionFile := database.SplitObjectKey(r.FileName)
+		rendition := models.JobRendition{
+			Name:     r.Name,
+			FileName: renditionFile,
+			Status:   r.Status,
+			Error:    r.Error,
+		}
+		if r.Status == database.RenditionSucceeded {
+			rendition.URL = h.Config.BaseURL + objectPath(r.FileName, "view")
+		}
+		status.Renditions = append(status.Renditions, rendition)
+	}
+
+	// Timing: time spent waiting in the queue and time spent processing
+	now := time.Now()
+	waitEnd := now
+	if job.StartedAt != nil {
+		status.StartedAt = job.StartedAt.Format(time.RFC3339)
+		waitEnd = *job.StartedAt
+	} else if job.FinishedAt != nil {
+		waitEnd = *job.FinishedAt // Cancelled before it started
+	}
+	status.WaitMs = waitEnd.Sub(job.QueuedAt).Milliseconds()
+
+	if job.StartedAt != nil {
+		runEnd := now
+		if job.FinishedAt != nil {
+			runEnd = *job.FinishedAt
+		}
+		status.DurationMs = runEnd.Sub(*job.StartedAt).Milliseconds()
+	}
+	if job.FinishedAt != nil {
+		status.FinishedAt = job.FinishedAt.Format(time.RFC3339)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(status)
+}
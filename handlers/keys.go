@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"object-storage-server/database"
+	"object-storage-server/storage"
+	"object-storage-server/utils"
+	"path"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Policies for uploads whose client chosen key is already taken
+const (
+	conflictReject    = "reject"    // 409 Conflict
+	conflictOverwrite = "overwrite" // Replace the object and drop its renditions
+	conflictRename    = "rename"    // Store as "<name>-1.<ext>", "<name>-2.<ext>", ...
+)
+
+// maxRenameAttempts bounds the suffixes tried by conflictRename
+const maxRenameAttempts = 1000
+
+// reservedKeySegments are first key segments of the default bucket that
+// would collide with the /api/files routes or the other buckets' objects
+var reservedKeySegments = []string{"view", "info", "metadata", strings.TrimSuffix(database.BucketKeyPrefix, "/")}
+
+var (
+	// errKeyExists is returned by claimKey when the key is taken and the
+	// conflict policy does not allow replacing it
+	errKeyExists = errors.New("an object with this key already exists")
+
+	// errKeyClash is returned by claimKey when another original shares the
+	// key's name without extension, so their renditions would overwrite
+	// each other
+	errKeyClash = errors.New("an object with this key and another extension already exists")
+
+	// errKeyBusy is returned by claimKey while another upload to the key,
+	// or to the same key with another extension, is in progress
+	errKeyBusy = errors.New("another upload to this key is in progress")
+)
+
+// validConflictPolicy reports whether policy is a known conflict policy
+func validConflictPolicy(policy string) bool {
+	switch policy {
+	case conflictReject, conflictOverwrite, conflictRename:
+		return true
+	}
+	return false
+}
+
+// checkUploadKey validates a key a client wants to store an upload under in bucket
+func checkUploadKey(bucket, key string) error {
+	if err := utils.ValidateObjectKey(key); err != nil {
+		return err
+	}
+	if utils.IsDerivative(key) {
+		return errors.New("keys ending in a rendition suffix such as \"_small\" or \"_720p\" are reserved")
+	}
+	if bucket == database.DefaultBucket {
+		first, _, _ := strings.Cut(key, "/")
+		for _, reserved := range reservedKeySegments {
+			if first == reserved {
+				return fmt.Errorf("keys may not start with %q", reserved)
+			}
+		}
+	}
+	return nil
+}
+
+// requestKey returns the object key of the wildcard route parameter and its
+// storage key in bucket
+func requestKey(c *fiber.Ctx, bucket string) (string, string, error) {
+	key, err := url.PathUnescape(c.Params("*"))
+	if err != nil {
+		return "", "", errors.New("Invalid key encoding")
+	}
+	if key == "" {
+		return "", "", errors.New("Filename is required")
+	}
+	storageKey, err := objectStorageKey(bucket, key)
+	if err != nil {
+		return "", "", err
+	}
+	return key, storageKey, nil
+}
+
+// objectStorageKey validates the key of an existing object in bucket and
+// returns its storage key. Keys of the default bucket may not reach into
+// the objects of other buckets.
+func objectStorageKey(bucket, key string) (string, error) {
+	if err := utils.ValidateObjectKey(key); err != nil {
+		return "", err
+	}
+	if bucket == database.DefaultBucket && strings.HasPrefix(key, database.BucketKeyPrefix) {
+		return "", fmt.Errorf("keys may not start with %q", database.BucketKeyPrefix)
+	}
+	return database.ObjectKey(bucket, key), nil
+}
+
+// claimKey reserves storageKey for an upload according to the conflict
+// policy and returns the storage key to write to, which differs from
+// storageKey after a rename. The reservation is released by calling the
+// returned function once the upload has been recorded or abandoned.
+func (h *FileHandler) claimKey(storageKey, policy string) (string, func(), error) {
+	h.keysMu.Lock()
+	defer h.keysMu.Unlock()
+
+	ext := path.Ext(storageKey)
+	base := strings.TrimSuffix(storageKey, ext)
+	candidate := storageKey
+	for i := 1; ; i++ {
+		err := h.keyAvailable(candidate)
+		if err == nil || (errors.Is(err, errKeyExists) && policy == conflictOverwrite) {
+			break
+		}
+		if policy != conflictRename || !keyConflict(err) {
+			return "", nil, err
+		}
+		if i == maxRenameAttempts {
+			return "", nil, errKeyExists
+		}
+		candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+
+	stem := strings.TrimSuffix(candidate, ext)
+	h.uploading[stem] = true
+	release := func() {
+		h.keysMu.Lock()
+		delete(h.uploading, stem)
+		h.keysMu.Unlock()
+	}
+	return candidate, release, nil
+}
+
+// keyAvailable checks that no stored object or upload in progress uses
+// storageKey or its name without extension. Callers hold keysMu.
+func (h *FileHandler) keyAvailable(storageKey string) error {
+	stem := strings.TrimSuffix(storageKey, path.Ext(storageKey))
+	if h.uploading[stem] {
+		return errKeyBusy
+	}
+
+	_, err := h.Storage.Stat(storageKey)
+	if err == nil {
+		return errKeyExists
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+
+	rec, err := h.DB.FindObjectByStem(stem)
+	if err == nil && rec.FileName != storageKey {
+		return errKeyClash
+	}
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// keyConflict reports whether err is one of the conflicts returned by claimKey
+func keyConflict(err error) bool {
+	return errors.Is(err, errKeyExists) || errors.Is(err, errKeyClash) || errors.Is(err, errKeyBusy)
+}
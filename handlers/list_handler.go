@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"object-storage-server/database"
+	"object-storage-server/models"
+	"object-storage-server/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 1000
+)
+
+// ListFiles returns a page of the files stored in the default bucket.
+// Files are ordered by name, which for UUID v7 names is also upload order.
+func (h *FileHandler) ListFiles(c *fiber.Ctx) error {
+	return h.listFiles(c, database.DefaultBucket)
+}
+
+// listFiles returns a page of the files stored in bucket
+func (h *FileHandler) listFiles(c *fiber.Ctx, bucket string) error {
+	limit := c.QueryInt("limit", defaultListLimit)
+	if limit <= 0 || limit > maxListLimit {
+		return badRequest(c, fmt.Sprintf("limit must be between 1 and %d", maxListLimit))
+	}
+
+	order := c.Query("order", "desc")
+	if order != "asc" && order != "desc" {
+		return badRequest(c, "order must be asc or desc")
+	}
+
+	fileType := c.Query("file_type")
+	switch fileType {
+	case "", "image", "video", "audio", "other":
+	default:
+		return badRequest(c, "file_type must be one of image, video, audio, other")
+	}
+
+	uploadedAfter, err := parseTimeQuery(c, "uploaded_after")
+	if err != nil {
+		return badRequest(c, err.Error())
+	}
+	uploadedBefore, err := parseTimeQuery(c, "uploaded_before")
+	if err != nil {
+		return badRequest(c, err.Error())
+	}
+
+	minSize, err := parseSizeQuery(c, "min_size")
+	if err != nil {
+		return badRequest(c, err.Error())
+	}
+	maxSize, err := parseSizeQuery(c, "max_size")
+	if err != nil {
+		return badRequest(c, err.Error())
+	}
+
+	var cursor string
+	if raw := c.Query("cursor"); raw != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(raw)
+		if err != nil {
+			return badRequest(c, "Invalid cursor")
+		}
+		cursor = string(decoded)
+	}
+
+	originalsOnly := c.QueryBool("originals_only", false)
+
+	// With a delimiter, keys continuing past it below prefix are rolled up
+	// into common prefixes, like folders
+	prefix := c.Query("prefix")
+	delimiter := c.Query("delimiter")
+
+	bucketPrefix := database.ObjectKey(bucket, "")
+	objects, err := h.Storage.List(bucketPrefix + prefix)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Failed to list files",
+		})
+	}
+
+	if order == "desc" {
+		for i, j := 0, len(objects)-1; i < j; i, j = i+1, j-1 {
+			objects[i], objects[j] = objects[j], objects[i]
+		}
+	}
+
+	files := make([]models.FileSummary, 0, limit)
+	var prefixes []string
+	var last string // Last file or common prefix in the page
+	hasMore := false
+
+	for _, obj := range objects {
+		// The default bucket lives at the root, next to all other buckets
+		if bucket == database.DefaultBucket && strings.HasPrefix(obj.Key, database.BucketKeyPrefix) {
+			continue
+		}
+		storageKey := obj.Key
+		obj.Key = strings.TrimPrefix(obj.Key, bucketPrefix)
+
+		// Resume after the cursor key
+		if cursor != "" {
+			if order == "asc" && obj.Key <= cursor {
+				continue
+			}
+			if order == "desc" && obj.Key >= cursor {
+				continue
+			}
+		}
+
+		isDerivative := utils.IsDerivative(obj.Key)
+		if originalsOnly && isDerivative {
+			continue
+		}
+		if fileType != "" && utils.GetFileType(obj.Key) != fileType {
+			continue
+		}
+		if minSize >= 0 && obj.Size < minSize {
+			continue
+		}
+		if maxSize >= 0 && obj.Size > maxSize {
+			continue
+		}
+
+		uploadedAt, ok := utils.ParseUploadTime(obj.Key)
+		if !ok {
+			uploadedAt = obj.ModTime
+		}
+		if !uploadedAfter.IsZero() && uploadedAt.Before(uploadedAfter) {
+			continue
+		}
+		if !uploadedBefore.IsZero() && !uploadedAt.Before(uploadedBefore) {
+			continue
+		}
+
+		commonPrefix := ""
+		if delimiter != "" {
+			if i := strings.Index(obj.Key[len(prefix):], delimiter); i >= 0 {
+				commonPrefix = obj.Key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		// A common prefix is listed once, and not again after a page ending with it
+		if commonPrefix != "" && (commonPrefix == last || commonPrefix == cursor) {
+			continue
+		}
+
+		if len(files)+len(prefixes) == limit {
+			hasMore = true
+			break
+		}
+
+		if commonPrefix != "" {
+			prefixes = append(prefixes, commonPrefix)
+			last = commonPrefix
+			continue
+		}
+		last = obj.Key
+		files = append(files, models.FileSummary{
+			FileName:     obj.Key,
+			FileSize:     obj.Size,
+			ContentType:  utils.GetContentType(obj.Key),
+			FileType:     utils.GetFileType(obj.Key),
+			IsDerivative: isDerivative,
+			UploadedAt:   uploadedAt.Format(time.RFC3339),
+			ViewURL:      h.objectURL(storageKey, "view"),
+			MetadataURL:  h.objectURL(storageKey, "metadata"),
+		})
+	}
+
+	response := models.ListResponse{
+		Success:  true,
+		Files:    files,
+		Prefixes: prefixes,
+		Count:    len(files),
+		HasMore:  hasMore,
+	}
+	if hasMore {
+		response.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// parseTimeQuery parses an optional RFC 3339 query parameter
+func parseTimeQuery(c *fiber.Ctx, name string) (time.Time, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+	}
+	return t, nil
+}
+
+// parseSizeQuery parses an optional byte size query parameter, returning -1 when absent
+func parseSizeQuery(c *fiber.Ctx, name string) (int64, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return -1, nil
+	}
+	size, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return size, nil
+}
+
+// badRequest sends a 400 error response with message
+func badRequest(c *fiber.Ctx, message string) error {
+	return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+		Success: false,
+		Message: message,
+	})
+}
@@ -0,0 +1,616 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"object-storage-server/config"
+	"object-storage-server/database"
+	"object-storage-server/models"
+	"object-storage-server/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// S3 multipart limits
+const (
+	minPartNumber   = 1
+	maxPartNumber   = 10000
+	minPartSize     = 5 * 1024 * 1024 // Every part but the last
+	maxListParts    = 1000
+	partTempPattern = ".part-*"
+)
+
+// MultipartInitRequest is the body of POST /api/multipart
+type MultipartInitRequest struct {
+	FileName    string `json:"file_name"`    // Original name, used for the extension
+	ContentType string `json:"content_type"` // Used when the extension is unknown
+	Bucket      string `json:"bucket"`       // Defaults to the default bucket
+	Visibility  string `json:"visibility"`   // "public" or "private", defaults to the bucket's
+}
+
+// MultipartCompleteRequest is the body of POST /api/multipart/:id/complete
+type MultipartCompleteRequest struct {
+	Parts []models.MultipartPart `json:"parts"`
+}
+
+// MultipartHandler implements S3-style multipart uploads. Parts are kept
+// below UploadDir until the upload is completed, when they are joined into
+// a single object that goes through the regular upload processing.
+type MultipartHandler struct {
+	Config *config.Config
+	DB     *database.DB
+	Files  *FileHandler
+
+	dir        string
+	mu         sync.Mutex
+	completing map[string]bool // Uploads being assembled or aborted
+}
+
+func NewMultipartHandler(cfg *config.Config, db *database.DB, files *FileHandler) (*MultipartHandler, error) {
+	dir := filepath.Join(cfg.UploadDir, ".multipart")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create multipart directory: %w", err)
+	}
+	h := &MultipartHandler{Config: cfg, DB: db, Files: files, dir: dir, completing: make(map[string]bool)}
+	files.onBucketRemoved(h.abortBucket)
+	return h, nil
+}
+
+// Initiate starts a multipart upload and returns its upload ID
+func (h *MultipartHandler) Initiate(c *fiber.Ctx) error {
+	var req MultipartInitRequest
+	if err := c.BodyParser(&req); err != nil {
+		return badRequest(c, "Invalid request body")
+	}
+
+	name := filepath.Base(req.FileName)
+	if req.FileName == "" || name == "." || name == "/" {
+		return badRequest(c, "file_name is required")
+	}
+
+	bucket, err := h.Files.bucket(req.Bucket)
+	if err != nil {
+		return bucketError(c, err)
+	}
+
+	// Type rules are checked up front, size rules once the parts are known
+	contentType := utils.GetContentType(name)
+	if contentType == "application/octet-stream" && req.ContentType != "" {
+		contentType = req.ContentType
+	}
+	if violation := h.Files.checkFileRules(bucket, name, contentType, 0); violation != nil {
+		return ruleError(c, violation)
+	}
+	visibility := req.Visibility
+	if visibility == "" {
+		visibility = bucket.Visibility
+	}
+	if visibility != database.VisibilityPublic && visibility != database.VisibilityPrivate {
+		return badRequest(c, "visibility must be \"public\" or \"private\"")
+	}
+
+	now := time.Now()
+	upload := &database.MultipartUploadRecord{
+		ID:           strings.ReplaceAll(uuid.Must(uuid.NewV7()).String(), "-", ""),
+		OriginalName: name,
+		ContentType:  req.ContentType,
+		Visibility:   visibility,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if bucket.Name != database.DefaultBucket {
+		upload.Bucket = bucket.Name
+	}
+	upload.UploaderKeyID, upload.UploaderKeyName = uploaderIdentity(c, nil)
+
+	if err := os.Mkdir(h.uploadDir(upload.ID), 0755); err != nil {
+		return h.internalError(c, "Failed to create upload", err)
+	}
+	if err := h.DB.PutMultipartUpload(upload); err != nil {
+		os.RemoveAll(h.uploadDir(upload.ID))
+		return h.internalError(c, "Failed to create upload", err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(models.MultipartUploadResponse{
+		Success:   true,
+		UploadID:  upload.ID,
+		Bucket:    bucket.Name,
+		FileName:  name,
+		PartsURL:  fmt.Sprintf("%s/api/multipart/%s/parts", h.Config.BaseURL, upload.ID),
+		ExpiresAt: now.Add(h.Config.MultipartUploadExpiry).UTC().Format(time.RFC3339),
+	})
+}
+
+// UploadPart stores the raw request body as part :part of an upload.
+// Parts may be sent in parallel and in any order; sending a part number
+// again replaces it. A Content-MD5 header is verified when present.
+func (h *MultipartHandler) UploadPart(c *fiber.Ctx) error {
+	id := c.Params("id")
+	partNumber, err := strconv.Atoi(c.Params("part"))
+	if err != nil || partNumber < minPartNumber || partNumber > maxPartNumber {
+		return badRequest(c, fmt.Sprintf("Part number must be between %d and %d", minPartNumber, maxPartNumber))
+	}
+
+	var expected []byte
+	if header := c.Get("Content-MD5"); header != "" {
+		expected, err = base64.StdEncoding.DecodeString(header)
+		if err != nil || len(expected) != md5.Size {
+			return badRequest(c, "Invalid Content-MD5 header")
+		}
+	}
+
+	if int64(c.Request().Header.ContentLength()) > h.Config.MaxFileSize {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(models.ErrorResponse{
+			Success: false,
+			Message: fmt.Sprintf("Part size exceeds maximum allowed size of %d bytes", h.Config.MaxFileSize),
+		})
+	}
+
+	if _, err := h.load(c, id); err != nil {
+		return h.notFound(c, err)
+	}
+
+	tmp, err := os.CreateTemp(h.uploadDir(id), partTempPattern)
+	if err != nil {
+		return h.notFound(c, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	var body io.Reader = c.Request().BodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+	sum := md5.New()
+	// Read one byte past the limit to detect oversized bodies
+	size, copyErr := io.Copy(io.MultiWriter(tmp, sum), io.LimitReader(body, h.Config.MaxFileSize+1))
+	if err := tmp.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	if copyErr != nil {
+		return h.internalError(c, "Failed to write part", copyErr)
+	}
+	if size > h.Config.MaxFileSize {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(models.ErrorResponse{
+			Success: false,
+			Message: fmt.Sprintf("Part size exceeds maximum allowed size of %d bytes", h.Config.MaxFileSize),
+		})
+	}
+	digest := sum.Sum(nil)
+	if expected != nil && !bytes.Equal(digest, expected) {
+		return badRequest(c, "Content-MD5 does not match the part")
+	}
+
+	// Part files are named after their ETag, so concurrent uploads of the
+	// same part number never leave a record pointing at the other's data
+	part := &database.MultipartPartRecord{
+		PartNumber:   partNumber,
+		ETag:         hex.EncodeToString(digest),
+		Size:         size,
+		LastModified: time.Now(),
+	}
+	if err := os.Rename(tmp.Name(), h.partPath(id, part)); err != nil {
+		return h.notFound(c, err)
+	}
+	previous, err := h.DB.PutMultipartPart(id, part)
+	if err != nil {
+		return h.notFound(c, err)
+	}
+	// The replaced part's data is no longer referenced, unless a Complete
+	// that started before the record changed is still joining it
+	if previous != nil && previous.ETag != part.ETag && !h.busyWith(id) {
+		if err := os.Remove(h.partPath(id, previous)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove replaced part %d of multipart upload %s: %v", partNumber, id, err)
+		}
+	}
+
+	c.Set(fiber.HeaderETag, quoteETag(part.ETag))
+	return c.JSON(models.MultipartPartResponse{
+		Success:       true,
+		MultipartPart: partInfo(part),
+	})
+}
+
+// ListParts returns the parts received so far, ordered by part number.
+// ?limit= caps the page size and ?cursor= continues after a part number.
+func (h *MultipartHandler) ListParts(c *fiber.Ctx) error {
+	id := c.Params("id")
+	limit := c.QueryInt("limit", maxListParts)
+	if limit <= 0 || limit > maxListParts {
+		return badRequest(c, fmt.Sprintf("limit must be between 1 and %d", maxListParts))
+	}
+	cursor := 0
+	if raw := c.Query("cursor"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return badRequest(c, "Invalid cursor")
+		}
+		cursor = n
+	}
+
+	if _, err := h.load(c, id); err != nil {
+		return h.notFound(c, err)
+	}
+	// Fetch one extra part to know whether another page follows
+	records, err := h.DB.ListMultipartParts(id, cursor, limit+1)
+	if err != nil {
+		return h.internalError(c, "Failed to list parts", err)
+	}
+
+	response := models.MultipartListPartsResponse{
+		Success:  true,
+		UploadID: id,
+		Parts:    make([]models.MultipartPart, 0, len(records)),
+	}
+	if len(records) > limit {
+		records = records[:limit]
+		response.HasMore = true
+		response.NextCursor = strconv.Itoa(records[limit-1].PartNumber)
+	}
+	for i := range records {
+		response.Parts = append(response.Parts, partInfo(&records[i]))
+	}
+	response.Count = len(response.Parts)
+	return c.JSON(response)
+}
+
+// Complete joins the listed parts, in order, into the final object. Every
+// part but the last must be at least 5 MB. The response carries the
+// composite ETag: the MD5 of the concatenated part MD5s and the part count.
+func (h *MultipartHandler) Complete(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var req MultipartCompleteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return badRequest(c, "Invalid request body")
+	}
+	if len(req.Parts) == 0 {
+		return badRequest(c, "parts must list at least one part")
+	}
+
+	if !h.begin(id) {
+		return h.busy(c)
+	}
+	defer h.end(id)
+
+	upload, err := h.load(c, id)
+	if err != nil {
+		return h.notFound(c, err)
+	}
+	bucket, err := h.Files.bucket(upload.Bucket)
+	if err != nil {
+		return bucketError(c, err)
+	}
+	records, err := h.DB.ListMultipartParts(id, 0, 0)
+	if err != nil {
+		return h.internalError(c, "Failed to list parts", err)
+	}
+	received := make(map[int]*database.MultipartPartRecord, len(records))
+	for i := range records {
+		received[records[i].PartNumber] = &records[i]
+	}
+
+	// Validate the requested part list the way S3 does
+	parts := make([]*database.MultipartPartRecord, 0, len(req.Parts))
+	composite := md5.New()
+	var total int64
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			return badRequest(c, "parts must be listed in ascending part number order")
+		}
+		part, ok := received[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, "\"") != part.ETag {
+			return badRequest(c, fmt.Sprintf("Part %d was not uploaded or its ETag does not match", p.PartNumber))
+		}
+		if part.Size < minPartSize && i < len(req.Parts)-1 {
+			return badRequest(c, fmt.Sprintf("Part %d is smaller than the minimum part size of %d bytes", p.PartNumber, minPartSize))
+		}
+		digest, _ := hex.DecodeString(part.ETag)
+		composite.Write(digest)
+		total += part.Size
+		parts = append(parts, part)
+	}
+	if maxSize := h.Files.bucketMaxFileSize(bucket); total > maxSize {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(models.ErrorResponse{
+			Success: false,
+			Message: fmt.Sprintf("File size exceeds maximum allowed size of %d bytes", maxSize),
+		})
+	}
+	etag := fmt.Sprintf("%x-%d", composite.Sum(nil), len(parts))
+
+	ruleType := utils.GetContentType(upload.OriginalName)
+	if ruleType == "application/octet-stream" && upload.ContentType != "" {
+		ruleType = upload.ContentType
+	}
+	if violation := h.Files.checkFileRules(bucket, upload.OriginalName, ruleType, total); violation != nil {
+		return ruleError(c, violation)
+	}
+
+	// The upload stays open, so a part with the wrong content can be re-sent
+	header, err := readHeader(h.partPath(id, parts[0]))
+	if err != nil {
+		return h.internalError(c, "Failed to read parts", err)
+	}
+	fileName, detectedType, err := h.Files.checkContent(utils.GenerateUniqueFileName(upload.OriginalName), header, true)
+	if err != nil {
+		return contentMismatch(c, err)
+	}
+	fileName = database.ObjectKey(bucket.Name, fileName)
+
+	joined := h.joinParts(id, parts)
+	size, detectedType, err := h.Files.putChecked(bucket, fileName, detectedType, joined, total)
+	joined.Close() // Stops the reading goroutine if Put gave up early
+	var violation *database.RuleViolation
+	if errors.As(err, &violation) {
+		return ruleError(c, violation)
+	}
+	if errors.Is(err, errContentMismatch) {
+		return contentMismatch(c, err)
+	}
+	if errors.Is(err, errShortBody) {
+		err = fmt.Errorf("assembled %d of %d bytes", size, total)
+	}
+	if err != nil {
+		return h.internalError(c, "Failed to assemble parts", err)
+	}
+
+	// Prefer the extension-based type, fall back to what the client declared
+	contentType := utils.GetContentType(fileName)
+	if contentType == "application/octet-stream" && upload.ContentType != "" {
+		contentType = upload.ContentType
+	}
+
+	// Like tus, a fully uploaded file is never dropped because of a full queue
+	response, status, err := h.Files.processUpload(c, &storedUpload{
+		FileName:        fileName,
+		OriginalName:    upload.OriginalName,
+		ContentType:     contentType,
+		DetectedType:    detectedType,
+		Size:            total,
+		Visibility:      upload.Visibility,
+		Profile:         bucket.ProcessingProfile,
+		UploaderKeyID:   upload.UploaderKeyID,
+		UploaderKeyName: upload.UploaderKeyName,
+		ETag:            etag,
+	}, "defer")
+	if err != nil {
+		return uploadError(c, err, h.Config.QueueRetryAfter)
+	}
+
+	h.remove(id)
+	c.Set(fiber.HeaderETag, quoteETag(etag))
+	return c.Status(status).JSON(response)
+}
+
+// Abort discards an upload and all of its parts
+func (h *MultipartHandler) Abort(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if !h.begin(id) {
+		return h.busy(c)
+	}
+	defer h.end(id)
+
+	if _, err := h.load(c, id); err != nil {
+		return h.notFound(c, err)
+	}
+	h.remove(id)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// RunCleanup periodically aborts uploads that received no part within
+// MultipartUploadExpiry, until stop is closed
+func (h *MultipartHandler) RunCleanup(stop <-chan struct{}) {
+	interval := h.Config.MultipartUploadExpiry / 2
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	h.cleanup()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.cleanup()
+		}
+	}
+}
+
+// cleanup aborts expired uploads and removes part directories left
+// without an upload record
+func (h *MultipartHandler) cleanup() {
+	uploads, err := h.DB.ListMultipartUploads()
+	if err != nil {
+		log.Printf("[Multipart] Failed to list uploads: %v", err)
+		return
+	}
+
+	active := make(map[string]bool, len(uploads))
+	cutoff := time.Now().Add(-h.Config.MultipartUploadExpiry)
+	for _, upload := range uploads {
+		if upload.UpdatedAt.After(cutoff) || !h.begin(upload.ID) {
+			active[upload.ID] = true
+			continue
+		}
+		log.Printf("[Multipart] Aborting upload %s (%s), idle since %s",
+			upload.ID, upload.OriginalName, upload.UpdatedAt.Format(time.RFC3339))
+		h.remove(upload.ID)
+		h.end(upload.ID)
+	}
+
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		log.Printf("[Multipart] Failed to read %s: %v", h.dir, err)
+		return
+	}
+	for _, entry := range entries {
+		// Directories of uploads initiated after the listing are still young
+		info, err := entry.Info()
+		if active[entry.Name()] || err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(h.dir, entry.Name())); err != nil {
+			log.Printf("[Multipart] Failed to remove %s: %v", entry.Name(), err)
+		}
+	}
+}
+
+// abortBucket aborts the uploads targeting a deleted bucket. Uploads being
+// completed are left to fail on the missing bucket.
+func (h *MultipartHandler) abortBucket(bucket string) {
+	uploads, err := h.DB.ListMultipartUploads()
+	if err != nil {
+		log.Printf("[Multipart] Failed to list uploads of bucket %s: %v", bucket, err)
+		return
+	}
+	for _, upload := range uploads {
+		if upload.Bucket != bucket || !h.begin(upload.ID) {
+			continue
+		}
+		log.Printf("[Multipart] Aborting upload %s (%s), its bucket %s was deleted", upload.ID, upload.OriginalName, bucket)
+		h.remove(upload.ID)
+		h.end(upload.ID)
+	}
+}
+
+// joinParts streams the content of parts one after another
+func (h *MultipartHandler) joinParts(id string, parts []*database.MultipartPartRecord) *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		for _, part := range parts {
+			f, err := os.Open(h.partPath(id, part))
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(pw, f)
+			f.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+// remove deletes the upload record, its part records and part files
+func (h *MultipartHandler) remove(id string) {
+	if err := h.DB.DeleteMultipartUpload(id); err != nil && !errors.Is(err, database.ErrNotFound) {
+		log.Printf("Failed to delete multipart upload %s: %v", id, err)
+	}
+	if err := os.RemoveAll(h.uploadDir(id)); err != nil {
+		log.Printf("Failed to remove parts of multipart upload %s: %v", id, err)
+	}
+}
+
+// begin marks upload id as being completed or aborted. It returns false
+// when another request already does so.
+func (h *MultipartHandler) begin(id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.completing[id] {
+		return false
+	}
+	h.completing[id] = true
+	return true
+}
+
+// end releases the mark set by begin
+func (h *MultipartHandler) end(id string) {
+	h.mu.Lock()
+	delete(h.completing, id)
+	h.mu.Unlock()
+}
+
+// busyWith reports whether upload id is being completed or aborted
+func (h *MultipartHandler) busyWith(id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.completing[id]
+}
+
+// load returns the upload record. Uploads initiated by another API key
+// are reported as not found, see ownsUpload.
+func (h *MultipartHandler) load(c *fiber.Ctx, id string) (*database.MultipartUploadRecord, error) {
+	upload, err := h.DB.GetMultipartUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if !ownsUpload(c, upload.UploaderKeyID) {
+		return nil, database.ErrNotFound
+	}
+	return upload, nil
+}
+
+// uploadDir returns the directory holding the parts of upload id
+func (h *MultipartHandler) uploadDir(id string) string {
+	return filepath.Join(h.dir, filepath.Base(id))
+}
+
+// partPath returns the file holding the data of part
+func (h *MultipartHandler) partPath(id string, part *database.MultipartPartRecord) string {
+	return filepath.Join(h.uploadDir(id), fmt.Sprintf("%05d-%s", part.PartNumber, part.ETag))
+}
+
+// busy responds with 409 while another request completes or aborts the upload
+func (h *MultipartHandler) busy(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+		Success: false,
+		Message: "Upload is already being completed or aborted",
+	})
+}
+
+// notFound maps a failed lookup to 404
+func (h *MultipartHandler) notFound(c *fiber.Ctx, err error) error {
+	if errors.Is(err, database.ErrNotFound) || os.IsNotExist(err) {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Upload not found",
+		})
+	}
+	return h.internalError(c, "Failed to load upload", err)
+}
+
+// internalError logs err and responds with 500
+func (h *MultipartHandler) internalError(c *fiber.Ctx, message string, err error) error {
+	log.Printf("multipart: %s: %v", message, err)
+	return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+		Success: false,
+		Message: message,
+	})
+}
+
+// partInfo converts a part record to its API representation
+func partInfo(part *database.MultipartPartRecord) models.MultipartPart {
+	return models.MultipartPart{
+		PartNumber:   part.PartNumber,
+		ETag:         quoteETag(part.ETag),
+		Size:         part.Size,
+		LastModified: part.LastModified.UTC().Format(time.RFC3339),
+	}
+}
+
+// quoteETag wraps an entity tag in double quotes as HTTP requires
+func quoteETag(etag string) string {
+	return "\"" + etag + "\""
+}
@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"object-storage-server/auth"
+	"object-storage-server/database"
+	"object-storage-server/models"
+	"object-storage-server/utils"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultPresignExpiry is used when a presign request does not ask for a lifetime
+const defaultPresignExpiry = time.Hour
+
+// PresignRequest is the body of POST /api/presign
+type PresignRequest struct {
+	Bucket             string `json:"bucket"` // Defaults to the default bucket
+	FileName           string `json:"file_name"`
+	Type               string `json:"type"`                // "download" (default) or "view"
+	ExpiresIn          int64  `json:"expires_in"`          // Seconds, defaults to one hour
+	BindIP             bool   `json:"bind_ip"`             // Only the requesting IP may use the URL
+	IP                 string `json:"ip"`                  // Only this IP may use the URL
+	ContentDisposition string `json:"content_disposition"` // Forced Content-Disposition header
+}
+
+// PresignUploadRequest is the body of POST /api/presign/upload
+type PresignUploadRequest struct {
+	Bucket       string   `json:"bucket"`        // Defaults to the default bucket
+	ExpiresIn    int64    `json:"expires_in"`    // Seconds, defaults to one hour
+	MaxSize      int64    `json:"max_size"`      // Bytes, defaults to MAX_FILE_SIZE
+	ContentTypes []string `json:"content_types"` // e.g. ["image/jpeg", "video/*"]
+	Extensions   []string `json:"extensions"`    // e.g. [".jpg", ".png"]
+	KeyPrefix    string   `json:"key_prefix"`    // e.g. "avatars-"
+	Visibility   string   `json:"visibility"`    // "public" or "private"
+}
+
+// keyPrefixPattern restricts upload key prefixes to flat, URL safe names
+var keyPrefixPattern = regexp.MustCompile(`^[A-Za-z0-9-]{0,64}$`)
+
+// accessError denies a request with an HTTP status and message
+type accessError struct {
+	status  int
+	message string
+}
+
+func (e *accessError) Error() string {
+	return e.message
+}
+
+// PresignURL mints an expiring, HMAC-signed download or view URL for a file
+func (h *FileHandler) PresignURL(c *fiber.Ctx) error {
+	var req PresignRequest
+	if err := c.BodyParser(&req); err != nil {
+		return badRequest(c, "Invalid request body")
+	}
+
+	if req.FileName == "" {
+		return badRequest(c, "file_name must be a stored file name")
+	}
+
+	bucket, err := h.bucket(req.Bucket)
+	if err != nil {
+		return bucketError(c, err)
+	}
+	key, err := objectStorageKey(bucket.Name, req.FileName)
+	if err != nil {
+		return badRequest(c, "Invalid file_name: "+err.Error())
+	}
+
+	var path string
+	switch req.Type {
+	case "", "download":
+		path = objectPath(key, "download")
+	case "view":
+		path = objectPath(key, "view")
+	default:
+		return badRequest(c, "type must be \"download\" or \"view\"")
+	}
+
+	expiry, err := h.presignExpiry(req.ExpiresIn)
+	if err != nil {
+		return badRequest(c, err.Error())
+	}
+
+	opts := auth.PresignOptions{
+		Expires:     time.Now().Add(expiry),
+		Disposition: req.ContentDisposition,
+	}
+	switch {
+	case req.IP != "":
+		if net.ParseIP(req.IP) == nil {
+			return badRequest(c, "ip must be a valid IP address")
+		}
+		opts.IP = req.IP
+	case req.BindIP:
+		opts.IP = c.IP()
+	}
+	if opts.Disposition != "" && !validDisposition(opts.Disposition) {
+		return badRequest(c, "content_disposition must start with \"inline\" or \"attachment\"")
+	}
+
+	if _, err := h.Storage.Stat(key); err != nil {
+		return h.storageError(c, err)
+	}
+
+	query := h.Signer.Sign(path, opts)
+	return c.JSON(models.PresignResponse{
+		Success:   true,
+		URL:       fmt.Sprintf("%s%s?%s", h.Config.BaseURL, path, query.Encode()),
+		Method:    fiber.MethodGet,
+		ExpiresAt: opts.Expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// PresignUpload mints a signed upload policy. The returned URL accepts
+// multipart POST and raw PUT uploads until it expires, without an API key.
+func (h *FileHandler) PresignUpload(c *fiber.Ctx) error {
+	var req PresignUploadRequest
+	if err := c.BodyParser(&req); err != nil {
+		return badRequest(c, "Invalid request body")
+	}
+
+	bucket, err := h.bucket(req.Bucket)
+	if err != nil {
+		return bucketError(c, err)
+	}
+	expiry, err := h.presignExpiry(req.ExpiresIn)
+	if err != nil {
+		return badRequest(c, err.Error())
+	}
+	if maxSize := h.bucketMaxFileSize(bucket); req.MaxSize < 0 || req.MaxSize > maxSize {
+		return badRequest(c, fmt.Sprintf("max_size must be between 0 and %d bytes", maxSize))
+	}
+	if !keyPrefixPattern.MatchString(req.KeyPrefix) {
+		return badRequest(c, "key_prefix may only contain letters, digits and dashes (max 64)")
+	}
+	if req.Visibility != "" && req.Visibility != database.VisibilityPublic && req.Visibility != database.VisibilityPrivate {
+		return badRequest(c, "visibility must be \"public\" or \"private\"")
+	}
+
+	extensions := make([]string, 0, len(req.Extensions))
+	for _, ext := range req.Extensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext != "" && !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		extensions = append(extensions, ext)
+	}
+
+	policy := &auth.UploadPolicy{
+		Bucket:       bucket.Name,
+		Expires:      time.Now().Add(expiry).Unix(),
+		MaxSize:      req.MaxSize,
+		ContentTypes: req.ContentTypes,
+		Extensions:   extensions,
+		KeyPrefix:    req.KeyPrefix,
+		Visibility:   req.Visibility,
+	}
+	if key := auth.KeyFromContext(c); key != nil {
+		policy.KeyID = key.ID
+		policy.KeyName = key.Name
+	}
+
+	params, err := h.Signer.SignPolicy(policy)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Failed to sign upload policy",
+		})
+	}
+	query := url.Values{}
+	for name, value := range params {
+		query.Set(name, value)
+	}
+
+	return c.JSON(models.PresignUploadResponse{
+		Success:   true,
+		URL:       fmt.Sprintf("%s?%s", h.uploadURL(bucket.Name), query.Encode()),
+		Methods:   []string{fiber.MethodPost, fiber.MethodPut},
+		ExpiresAt: time.Unix(policy.Expires, 0).UTC().Format(time.RFC3339),
+	})
+}
+
+// authorizeUpload checks that the request may upload. Requests carrying a
+// presigned policy are authorized by it and get the verified policy back;
+// all others need an API key with the upload scope.
+func (h *FileHandler) authorizeUpload(c *fiber.Ctx) (*auth.UploadPolicy, error) {
+	if encoded := c.Query(auth.ParamPolicy); encoded != "" {
+		policy, err := h.Signer.VerifyPolicy(encoded, c.Query(auth.ParamSignature))
+		if err != nil {
+			return nil, &accessError{status: fiber.StatusForbidden, message: err.Error()}
+		}
+		return policy, nil
+	}
+
+	if !h.Config.AuthEnabled {
+		return nil, nil
+	}
+	key := auth.KeyFromContext(c)
+	if key == nil {
+		c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+		return nil, &accessError{status: fiber.StatusUnauthorized, message: "API key required"}
+	}
+	if !auth.HasScope(key, auth.ScopeUpload) {
+		return nil, &accessError{status: fiber.StatusForbidden, message: fmt.Sprintf("API key lacks the %q scope", auth.ScopeUpload)}
+	}
+	return nil, nil
+}
+
+// presignExpiry validates a requested lifetime in seconds, 0 meaning the default
+func (h *FileHandler) presignExpiry(seconds int64) (time.Duration, error) {
+	if seconds < 0 {
+		return 0, errors.New("expires_in must be positive")
+	}
+	expiry := defaultPresignExpiry
+	if seconds > 0 {
+		expiry = time.Duration(seconds) * time.Second
+	}
+	if expiry > h.Config.PresignMaxExpiry {
+		return 0, fmt.Errorf("expires_in must not exceed %d seconds", int64(h.Config.PresignMaxExpiry/time.Second))
+	}
+	return expiry, nil
+}
+
+// authorizeRead checks that the request may read filename. A presigned URL
+// grants access on its own; without one, private objects need an API key
+// with the read scope. It returns the Content-Disposition forced by the
+// presigned URL, if any.
+func (h *FileHandler) authorizeRead(c *fiber.Ctx, filename string) (string, error) {
+	if c.Query(auth.ParamSignature) != "" {
+		opts, err := h.Signer.Verify(c.Path(), func(key string) string { return c.Query(key) }, c.IP())
+		if err != nil {
+			return "", &accessError{status: fiber.StatusForbidden, message: err.Error()}
+		}
+		return opts.Disposition, nil
+	}
+
+	if h.objectVisibility(filename) != database.VisibilityPrivate {
+		return "", nil
+	}
+
+	key := auth.KeyFromContext(c)
+	if h.Config.AuthEnabled && key != nil && auth.HasScope(key, auth.ScopeRead) {
+		return "", nil
+	}
+	if h.Config.AuthEnabled && key == nil {
+		c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+		return "", &accessError{status: fiber.StatusUnauthorized, message: "This file is private, use an API key or a presigned URL"}
+	}
+	return "", &accessError{status: fiber.StatusForbidden, message: "This file is private, use a presigned URL"}
+}
+
+// accessDenied writes the response for an error returned by authorizeRead
+func accessDenied(c *fiber.Ctx, err error) error {
+	var denied *accessError
+	if !errors.As(err, &denied) {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Failed to authorize request",
+		})
+	}
+	return c.Status(denied.status).JSON(models.ErrorResponse{
+		Success: false,
+		Message: denied.message,
+	})
+}
+
+// objectVisibility returns the visibility of filename. Renditions share
+// the visibility of their original.
+func (h *FileHandler) objectVisibility(filename string) string {
+	rec, err := h.DB.GetObject(filename)
+	if errors.Is(err, database.ErrNotFound) {
+		if stem, ok := utils.DerivativeStem(filename); ok {
+			rec, err = h.DB.FindObjectByStem(path.Join(path.Dir(filename), stem))
+		}
+	}
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			log.Printf("Failed to load metadata for %s: %v", filename, err)
+			// Fail closed, a broken record must not expose a private file
+			return database.VisibilityPrivate
+		}
+		return h.bucketVisibility(filename)
+	}
+	return h.visibility(rec)
+}
+
+// visibility returns the visibility of rec, applying the configured default
+// to records created before visibility was recorded
+func (h *FileHandler) visibility(rec *database.ObjectRecord) string {
+	if rec.Visibility == "" {
+		return h.Config.DefaultVisibility
+	}
+	return rec.Visibility
+}
+
+// validDisposition reports whether value is a well-formed inline or
+// attachment Content-Disposition that cannot inject other headers
+func validDisposition(value string) bool {
+	if strings.ContainsAny(value, "\r\n") {
+		return false
+	}
+	kind, _, _ := strings.Cut(value, ";")
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	return kind == "inline" || kind == "attachment"
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"object-storage-server/database"
+	"object-storage-server/models"
+	"object-storage-server/storage"
+	"object-storage-server/utils"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// errShortBody is returned by putChecked when the body ends before its
+// declared size
+var errShortBody = errors.New("request body is shorter than Content-Length")
+
+// Scopes of upload rules, as reported in models.RuleErrorResponse
+const (
+	ruleScopeServer = "server"
+	ruleScopeBucket = "bucket"
+)
+
+// serverRules returns the upload rules configured for the whole server
+func (h *FileHandler) serverRules() *database.UploadRules {
+	return &database.UploadRules{
+		AllowedTypes:     h.Config.AllowedTypes,
+		DeniedTypes:      h.Config.DeniedTypes,
+		MaxSizes:         h.Config.MaxSizeByType,
+		MaxImageWidth:    h.Config.MaxImageWidth,
+		MaxImageHeight:   h.Config.MaxImageHeight,
+		MaxVideoDuration: int64(h.Config.MaxVideoDuration / time.Second),
+	}
+}
+
+// checkRules runs check against the server-wide rules, then against the
+// rules of bucket, and returns the first violation
+func (h *FileHandler) checkRules(bucket *database.BucketRecord, check func(rules *database.UploadRules) *database.RuleViolation) *database.RuleViolation {
+	if violation := check(h.serverRules()); violation != nil {
+		violation.Scope = ruleScopeServer
+		return violation
+	}
+	if violation := check(&bucket.UploadRules); violation != nil {
+		violation.Scope = ruleScopeBucket
+		return violation
+	}
+	return nil
+}
+
+// checkFileRules checks the type and size of an upload called name to bucket
+func (h *FileHandler) checkFileRules(bucket *database.BucketRecord, name, contentType string, size int64) *database.RuleViolation {
+	return h.checkRules(bucket, func(rules *database.UploadRules) *database.RuleViolation {
+		return rules.CheckFile(path.Ext(name), contentType, size)
+	})
+}
+
+// mediaRulesApply reports whether an image dimension or video duration
+// rule of the server or bucket applies to name. Such uploads are staged in
+// a local file and measured before they are stored, see checkStaged.
+func (h *FileHandler) mediaRulesApply(bucket *database.BucketRecord, name string) bool {
+	server := h.serverRules()
+	switch utils.GetFileType(name) {
+	case "image":
+		return server.MaxImageWidth != 0 || server.MaxImageHeight != 0 || bucket.MaxImageWidth != 0 || bucket.MaxImageHeight != 0
+	case "video":
+		return (server.MaxVideoDuration != 0 || bucket.MaxVideoDuration != 0) && utils.CheckFFprobeInstalled()
+	}
+	return false
+}
+
+// checkMediaRules checks the pixel dimensions of an image or the duration
+// of a video called name, read from the local file at localPath, against
+// the rules of bucket. Files that cannot be measured pass; video durations
+// need ffprobe.
+func (h *FileHandler) checkMediaRules(bucket *database.BucketRecord, name, localPath string) *database.RuleViolation {
+	if !h.mediaRulesApply(bucket, name) {
+		return nil
+	}
+
+	switch utils.GetFileType(name) {
+	case "image":
+		width, height, err := utils.LocalImageDimensions(localPath)
+		if err != nil {
+			log.Printf("Failed to read the dimensions of %s: %v", name, err)
+			return nil
+		}
+		return h.checkRules(bucket, func(rules *database.UploadRules) *database.RuleViolation {
+			return rules.CheckImage(width, height)
+		})
+
+	case "video":
+		duration, err := utils.MediaDuration(localPath)
+		if err != nil {
+			log.Printf("Failed to read the duration of %s: %v", name, err)
+			return nil
+		}
+		return h.checkRules(bucket, func(rules *database.UploadRules) *database.RuleViolation {
+			return rules.CheckVideo(duration)
+		})
+	}
+	return nil
+}
+
+// checkStaged runs the checks that need the whole upload called name,
+// staged in the local file at localPath: probeContentType, then the
+// dimension and duration rules of bucket. A violation is returned as a
+// *database.RuleViolation. It returns the detected type to record.
+func (h *FileHandler) checkStaged(bucket *database.BucketRecord, name, detected, localPath string) (string, error) {
+	detected, err := h.probeContentType(name, detected, localPath)
+	if err != nil {
+		return "", err
+	}
+	if violation := h.checkMediaRules(bucket, name, localPath); violation != nil {
+		return "", violation
+	}
+	return detected, nil
+}
+
+// putChecked stores body under storageKey like Storage.Put, once
+// stageChecked accepted it, so a rejected upload never replaces the object
+// stored under its key. It returns the size stored and the detected type
+// to record.
+func (h *FileHandler) putChecked(bucket *database.BucketRecord, storageKey, detected string, body io.Reader, size int64) (int64, string, error) {
+	staged, detected, cleanup, err := h.stageChecked(bucket, storageKey, detected, body, size)
+	defer cleanup()
+	if err != nil {
+		return 0, "", err
+	}
+	written, err := storage.MoveFile(h.Storage, storageKey, staged)
+	return written, detected, err
+}
+
+// stageChecked writes body to a local file below UploadDir and runs
+// checkStaged on it. errShortBody is returned when body holds fewer than
+// size bytes. It returns the path of the file, to be stored with
+// storage.MoveFile, and the detected type to record. cleanup removes the
+// file if it was not moved and must always be called.
+func (h *FileHandler) stageChecked(bucket *database.BucketRecord, storageKey, detected string, body io.Reader, size int64) (string, string, func(), error) {
+	tmp, err := os.CreateTemp(h.Config.UploadDir, ".tmp-upload-*")
+	if err != nil {
+		return "", "", func() {}, err
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+	written, err := io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", "", cleanup, err
+	}
+	if written != size {
+		return "", "", cleanup, errShortBody
+	}
+
+	detected, err = h.checkStaged(bucket, storageKey, detected, tmp.Name())
+	if err != nil {
+		return "", "", cleanup, err
+	}
+	return tmp.Name(), detected, cleanup, nil
+}
+
+// ruleError writes the response for an upload breaking an upload rule:
+// 415 for type rules, 413 for size limits and 422 for dimensions and durations
+func ruleError(c *fiber.Ctx, violation *database.RuleViolation) error {
+	status := fiber.StatusUnprocessableEntity
+	switch violation.Rule {
+	case database.RuleDeniedTypes, database.RuleAllowedTypes:
+		status = fiber.StatusUnsupportedMediaType
+	case database.RuleMaxSize:
+		status = fiber.StatusRequestEntityTooLarge
+	}
+	return c.Status(status).JSON(models.RuleErrorResponse{
+		Success: false,
+		Message: violation.Error(),
+		Scope:   violation.Scope,
+		Rule:    violation.Rule,
+		Match:   violation.Match,
+		Limit:   violation.Limit,
+		Actual:  violation.Actual,
+	})
+}
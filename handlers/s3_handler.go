@@ -0,0 +1,765 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"object-storage-server/auth"
+	"object-storage-server/config"
+	"object-storage-server/database"
+	"object-storage-server/storage"
+	"object-storage-server/utils"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	s3Namespace     = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat    = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys       = 1000
+	s3LocalsRequest = "s3_sigv4"
+)
+
+// S3Handler exposes a subset of the Amazon S3 REST API (path-style
+// addressing, SigV4 authentication) on top of the regular storage and
+// upload processing. API keys act as S3 credentials.
+type S3Handler struct {
+	Config *config.Config
+	DB     *database.DB
+	Files  *FileHandler
+}
+
+func NewS3Handler(cfg *config.Config, db *database.DB, files *FileHandler) (*S3Handler, error) {
+	// Uploads are buffered next to the stored objects before they are verified
+	if err := os.MkdirAll(cfg.UploadDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	return &S3Handler{Config: cfg, DB: db, Files: files}, nil
+}
+
+// s3Error is the XML error body returned by S3
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestID string   `xml:"RequestId"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListObjectsResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// Authenticate verifies SigV4 signed requests and attaches the signing API
+// key to the request. Unsigned requests continue anonymously.
+func (h *S3Handler) Authenticate(c *fiber.Ctx) error {
+	c.Set("x-amz-request-id", strings.ToUpper(strings.ReplaceAll(uuid.NewString(), "-", "")[:16]))
+
+	req := &auth.SigV4Request{
+		Method:   c.Method(),
+		Path:     string(c.Request().URI().PathOriginal()),
+		RawQuery: string(c.Request().URI().QueryString()),
+		Header:   func(name string) string { return c.Get(name) },
+	}
+	if !auth.IsSigV4(req) {
+		if c.Get(fiber.HeaderAuthorization) != "" || c.Query("Signature") != "" {
+			return h.error(c, fiber.StatusBadRequest, "InvalidRequest", "Only AWS Signature Version 4 is supported")
+		}
+		return c.Next()
+	}
+
+	result, err := h.Files.Signer.VerifySigV4(h.DB, req, time.Now())
+	switch {
+	case err == nil:
+	case errors.Is(err, auth.ErrSigV4Malformed):
+		return h.error(c, fiber.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header or query parameters are malformed")
+	case errors.Is(err, auth.ErrSigV4UnknownKey):
+		return h.error(c, fiber.StatusForbidden, "InvalidAccessKeyId", "The access key ID does not exist")
+	case errors.Is(err, auth.ErrSigV4Mismatch):
+		return h.error(c, fiber.StatusForbidden, "SignatureDoesNotMatch", "The request signature does not match")
+	case errors.Is(err, auth.ErrSigV4Skewed):
+		return h.error(c, fiber.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server time is too large")
+	case errors.Is(err, auth.ErrSigV4Expired):
+		return h.error(c, fiber.StatusForbidden, "AccessDenied", "Request has expired")
+	default:
+		log.Printf("Failed to verify SigV4 signature: %v", err)
+		return h.error(c, fiber.StatusInternalServerError, "InternalError", "Failed to verify the request signature")
+	}
+
+	auth.SetKey(c, result.Key)
+	c.Locals(s3LocalsRequest, result)
+	return c.Next()
+}
+
+// ListBuckets lists the default bucket, named S3_API_BUCKET, and all created buckets
+func (h *S3Handler) ListBuckets(c *fiber.Ctx) error {
+	key := auth.KeyFromContext(c)
+	if h.Config.AuthEnabled && key == nil {
+		return h.error(c, fiber.StatusForbidden, "AccessDenied", "Access Denied")
+	}
+
+	created, err := h.DB.GetOrCreateSetting("s3_bucket_created_at", func() (string, error) {
+		return time.Now().UTC().Format(s3TimeFormat), nil
+	})
+	if err != nil {
+		log.Printf("Failed to load bucket creation date: %v", err)
+	}
+
+	buckets, err := h.DB.ListBuckets()
+	if err != nil {
+		log.Printf("Failed to load buckets: %v", err)
+		return h.error(c, fiber.StatusInternalServerError, "InternalError", "Failed to list buckets")
+	}
+
+	owner := s3Owner{ID: "anonymous", DisplayName: "anonymous"}
+	if key != nil {
+		owner = s3Owner{ID: key.ID, DisplayName: key.Name}
+	}
+	result := s3ListBucketsResult{
+		Xmlns:   s3Namespace,
+		Owner:   owner,
+		Buckets: []s3Bucket{{Name: h.Config.S3APIBucket, CreationDate: created}},
+	}
+	for _, bucket := range buckets {
+		result.Buckets = append(result.Buckets, s3Bucket{
+			Name:         bucket.Name,
+			CreationDate: bucket.CreatedAt.UTC().Format(s3TimeFormat),
+		})
+	}
+	return c.XML(result)
+}
+
+// CreateBucket creates a bucket with the default settings. The settings
+// can be changed through PATCH /api/buckets/:bucket.
+func (h *S3Handler) CreateBucket(c *fiber.Ctx) error {
+	if !h.allowed(c, auth.ScopeAdmin) {
+		return h.accessDenied(c)
+	}
+	name := c.Params("bucket")
+	if _, ok := h.bucket(c); ok {
+		return h.error(c, fiber.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it")
+	}
+	if err := h.Files.validBucketName(name); err != nil {
+		return h.error(c, fiber.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid")
+	}
+
+	if err := h.DB.CreateBucket(h.Files.newBucket(name)); err != nil {
+		if errors.Is(err, database.ErrExists) {
+			return h.error(c, fiber.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it")
+		}
+		log.Printf("Failed to create bucket %s: %v", name, err)
+		return h.error(c, fiber.StatusInternalServerError, "InternalError", "Failed to create the bucket")
+	}
+	c.Set(fiber.HeaderLocation, "/"+name)
+	c.Status(fiber.StatusOK)
+	return nil
+}
+
+// DeleteBucket removes an empty bucket. The default bucket cannot be deleted.
+func (h *S3Handler) DeleteBucket(c *fiber.Ctx) error {
+	bucket, ok := h.bucket(c)
+	if !ok {
+		return h.noSuchBucket(c)
+	}
+	if !h.allowed(c, auth.ScopeAdmin) {
+		return h.accessDenied(c)
+	}
+	if bucket.Name == database.DefaultBucket {
+		return h.error(c, fiber.StatusConflict, "OperationAborted", "The default bucket cannot be deleted")
+	}
+
+	_, err := h.Files.removeBucket(bucket.Name, false)
+	if errors.Is(err, errBucketNotEmpty) {
+		return h.error(c, fiber.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty")
+	}
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		log.Printf("Failed to delete bucket %s: %v", bucket.Name, err)
+		return h.error(c, fiber.StatusInternalServerError, "InternalError", "Failed to delete the bucket")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ListObjects implements ListObjectsV2 (GET) and HeadBucket (HEAD)
+func (h *S3Handler) ListObjects(c *fiber.Ctx) error {
+	bucket, ok := h.bucket(c)
+	if !ok {
+		return h.noSuchBucket(c)
+	}
+	if !h.allowed(c, auth.ScopeRead) {
+		return h.accessDenied(c)
+	}
+	if c.Method() == fiber.MethodHead {
+		return c.SendStatus(fiber.StatusOK)
+	}
+	if c.Query("list-type") != "2" {
+		return h.error(c, fiber.StatusNotImplemented, "NotImplemented", "Only ListObjectsV2 (list-type=2) is supported")
+	}
+
+	maxKeys := s3MaxKeys
+	if raw := c.Query("max-keys"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return h.error(c, fiber.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer")
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	encodingType := c.Query("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		return h.error(c, fiber.StatusBadRequest, "InvalidArgument", "encoding-type must be url")
+	}
+
+	prefix, delimiter := c.Query("prefix"), c.Query("delimiter")
+	result := s3ListObjectsResult{
+		Xmlns:             s3Namespace,
+		Name:              c.Params("bucket"),
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		EncodingType:      encodingType,
+		ContinuationToken: c.Query("continuation-token"),
+		StartAfter:        c.Query("start-after"),
+	}
+
+	// Resume after the continuation token, or else after start-after
+	after := result.StartAfter
+	if result.ContinuationToken != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			return h.error(c, fiber.StatusBadRequest, "InvalidArgument", "The continuation token is not valid")
+		}
+		after = string(decoded)
+	}
+
+	bucketPrefix := database.ObjectKey(bucket.Name, "")
+	objects, err := h.Files.Storage.List(bucketPrefix + prefix)
+	if err != nil {
+		log.Printf("Failed to list objects: %v", err)
+		return h.error(c, fiber.StatusInternalServerError, "InternalError", "Failed to list objects")
+	}
+
+	encode := func(s string) string {
+		if encodingType == "url" {
+			return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+		}
+		return s
+	}
+
+	var last string
+	for _, obj := range objects {
+		// The default bucket lives at the root, next to all other buckets
+		if bucket.Name == database.DefaultBucket && strings.HasPrefix(obj.Key, database.BucketKeyPrefix) {
+			continue
+		}
+		storageKey := obj.Key
+		obj.Key = strings.TrimPrefix(obj.Key, bucketPrefix)
+
+		// Renditions are derived data and not part of the bucket listing
+		if utils.IsDerivative(obj.Key) || obj.Key <= after {
+			continue
+		}
+
+		// Keys sharing the part up to the delimiter collapse into one prefix
+		if delimiter != "" {
+			if i := strings.Index(obj.Key[len(prefix):], delimiter); i >= 0 {
+				common := obj.Key[:len(prefix)+i+len(delimiter)]
+				if common == last || strings.HasPrefix(after, common) {
+					continue
+				}
+				if result.KeyCount == maxKeys {
+					result.IsTruncated = true
+					break
+				}
+				result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(common)})
+				result.KeyCount++
+				last = common
+				continue
+			}
+		}
+
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		result.Contents = append(result.Contents, s3Object{
+			Key:          encode(obj.Key),
+			LastModified: obj.ModTime.UTC().Format(s3TimeFormat),
+			ETag:         h.etag(storageKey, &obj),
+			Size:         obj.Size,
+			StorageClass: "STANDARD",
+		})
+		result.KeyCount++
+		last = obj.Key
+	}
+
+	if result.IsTruncated {
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+	if encodingType == "url" {
+		result.Prefix, result.Delimiter, result.StartAfter = encode(prefix), encode(delimiter), encode(result.StartAfter)
+	}
+	return c.XML(result)
+}
+
+// GetObject implements GetObject (GET) and HeadObject (HEAD), including
+// conditional and single range requests
+func (h *S3Handler) GetObject(c *fiber.Ctx) error {
+	bucket, ok := h.bucket(c)
+	if !ok {
+		return h.noSuchBucket(c)
+	}
+	key, ok := h.objectKey(c, bucket)
+	if !ok {
+		return h.noSuchKey(c)
+	}
+	// Like /api/files, private objects need a key even without AUTH_ENABLED
+	if h.Files.objectVisibility(key) == database.VisibilityPrivate {
+		if k := auth.KeyFromContext(c); k == nil || !auth.HasScope(k, auth.ScopeRead) {
+			return h.accessDenied(c)
+		}
+	}
+
+	info, err := h.Files.Storage.Stat(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return h.noSuchKey(c)
+	}
+	if err != nil {
+		log.Printf("Failed to stat %s: %v", key, err)
+		return h.error(c, fiber.StatusInternalServerError, "InternalError", "Storage error")
+	}
+
+	etag := h.etag(key, info)
+	modTime := info.ModTime.UTC().Truncate(time.Second)
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderLastModified, modTime.Format(http.TimeFormat))
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+
+	switch checkPreconditions(c, etag, modTime) {
+	case fiber.StatusNotModified:
+		return c.SendStatus(fiber.StatusNotModified)
+	case fiber.StatusPreconditionFailed:
+		return h.error(c, fiber.StatusPreconditionFailed, "PreconditionFailed", "At least one of the preconditions you specified did not hold")
+	}
+
+	contentType := h.Files.servedContentType(key)
+	// Response overrides, as used by presigned download links. Like S3 they
+	// need a signed request, so nobody can have an upload served as a page.
+	contentTypeOverride, dispositionOverride := c.Query("response-content-type"), c.Query("response-content-disposition")
+	if contentTypeOverride != "" || dispositionOverride != "" {
+		if c.Locals(s3LocalsRequest) == nil {
+			return h.error(c, fiber.StatusBadRequest, "InvalidRequest", "Request specific response headers cannot be used for anonymous GET requests")
+		}
+		if contentTypeOverride != "" {
+			if !validResponseContentType(contentTypeOverride) {
+				return h.error(c, fiber.StatusBadRequest, "InvalidArgument", "response-content-type is not a valid content type for objects")
+			}
+			contentType = contentTypeOverride
+		}
+		if dispositionOverride != "" {
+			if !validResponseDisposition(dispositionOverride) {
+				return h.error(c, fiber.StatusBadRequest, "InvalidArgument", "response-content-disposition must be inline or attachment")
+			}
+			c.Set(fiber.HeaderContentDisposition, dispositionOverride)
+		}
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+
+	// S3 serves a single range; several ranges get the whole object
+	if rangeApplies(c, etag, modTime) {
+		ranges, err := parseRange(c.Get(fiber.HeaderRange), info.Size)
+		if err != nil {
+			return h.error(c, fiber.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+		}
+		if len(ranges) == 1 {
+			r := ranges[0]
+			c.Status(fiber.StatusPartialContent)
+			c.Set(fiber.HeaderContentRange, r.contentRange(info.Size))
+			return h.Files.sendBody(c, r.length, func() (io.ReadCloser, error) {
+				return h.Files.Storage.GetRange(key, r.start, r.length)
+			})
+		}
+	}
+	return h.Files.sendBody(c, info.Size, func() (io.ReadCloser, error) {
+		return h.Files.Storage.Get(key)
+	})
+}
+
+// validResponseContentType reports whether value may be requested with
+// response-content-type: a well-formed media type other than markup
+func validResponseContentType(value string) bool {
+	mediaType, _, err := mime.ParseMediaType(value)
+	return err == nil && !isMarkupType(mediaType)
+}
+
+// validResponseDisposition reports whether value may be requested with
+// response-content-disposition: a well-formed inline or attachment disposition
+func validResponseDisposition(value string) bool {
+	dispositionType, _, err := mime.ParseMediaType(value)
+	return err == nil && (dispositionType == "inline" || dispositionType == "attachment")
+}
+
+// PutObject stores the request body under the key chosen by the client and
+// runs it through the same processing as UploadFile. The body is buffered
+// and verified against x-amz-content-sha256 and Content-MD5 before it
+// replaces an existing object.
+func (h *S3Handler) PutObject(c *fiber.Ctx) error {
+	bucket, ok := h.bucket(c)
+	if !ok {
+		return h.noSuchBucket(c)
+	}
+	if c.Get("X-Amz-Copy-Source") != "" || c.Query("uploadId") != "" {
+		return h.error(c, fiber.StatusNotImplemented, "NotImplemented", "CopyObject and multipart uploads are not supported, use /api/multipart")
+	}
+	name, err := url.PathUnescape(c.Params("*"))
+	if err == nil {
+		err = checkUploadKey(bucket.Name, name)
+	}
+	if err != nil {
+		return h.error(c, fiber.StatusBadRequest, "InvalidArgument", "Invalid object key: "+err.Error())
+	}
+	key := database.ObjectKey(bucket.Name, name)
+	if !h.allowed(c, auth.ScopeUpload) {
+		return h.accessDenied(c)
+	}
+
+	visibility := bucket.Visibility
+	switch acl := c.Get("X-Amz-Acl"); acl {
+	case "":
+	case "private":
+		visibility = database.VisibilityPrivate
+	case "public-read":
+		visibility = database.VisibilityPublic
+	default:
+		return h.error(c, fiber.StatusNotImplemented, "NotImplemented", "Only the private and public-read canned ACLs are supported")
+	}
+
+	var expectedMD5 []byte
+	if header := c.Get("Content-MD5"); header != "" {
+		var err error
+		expectedMD5, err = base64.StdEncoding.DecodeString(header)
+		if err != nil || len(expectedMD5) != md5.Size {
+			return h.error(c, fiber.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified is not valid")
+		}
+	}
+
+	// Signed requests state how the payload is protected, anonymous ones may too
+	payloadHash := c.Get("X-Amz-Content-Sha256")
+	result, _ := c.Locals(s3LocalsRequest).(*auth.SigV4Result)
+	if result != nil {
+		payloadHash = result.PayloadHash
+	}
+
+	var body io.Reader = c.Request().BodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+	size := int64(c.Request().Header.ContentLength())
+	var sha hash.Hash
+	switch payloadHash {
+	case auth.StreamingPayload, auth.StreamingPayloadTrailer, auth.StreamingUnsignedTrailer:
+		if result == nil {
+			if payloadHash != auth.StreamingUnsignedTrailer {
+				return h.error(c, fiber.StatusBadRequest, "InvalidRequest", "Signed streaming payloads require a signed request")
+			}
+			result = &auth.SigV4Result{PayloadHash: payloadHash}
+		}
+		decoded, err := strconv.ParseInt(c.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil {
+			return h.error(c, fiber.StatusLengthRequired, "MissingContentLength", "x-amz-decoded-content-length is required for aws-chunked uploads")
+		}
+		size = decoded
+		body = auth.NewChunkedReader(body, result)
+	case "", auth.UnsignedPayload:
+	default:
+		if _, err := hex.DecodeString(payloadHash); err != nil || len(payloadHash) != 2*sha256.Size {
+			return h.error(c, fiber.StatusBadRequest, "InvalidArgument", "x-amz-content-sha256 is not valid")
+		}
+		sha = sha256.New()
+	}
+	if size < 0 {
+		return h.error(c, fiber.StatusLengthRequired, "MissingContentLength", "You must provide the Content-Length HTTP header")
+	}
+	if maxSize := h.Files.bucketMaxFileSize(bucket); size > maxSize {
+		return h.error(c, fiber.StatusBadRequest, "EntityTooLarge", fmt.Sprintf("Your proposed upload exceeds the maximum allowed size of %d bytes", maxSize))
+	}
+
+	contentType := c.Get(fiber.HeaderContentType)
+	if contentType == "" || contentType == "binary/octet-stream" || contentType == "application/octet-stream" {
+		contentType = utils.GetContentType(key)
+	}
+	if violation := h.Files.checkFileRules(bucket, key, contentType, size); violation != nil {
+		return h.ruleError(c, violation)
+	}
+
+	// PUT replaces an existing object like on_conflict=overwrite, but may not
+	// clash with another original of the same name or an upload in progress
+	_, release, err := h.Files.claimKey(key, conflictOverwrite)
+	if keyConflict(err) {
+		return h.error(c, fiber.StatusConflict, "OperationAborted", err.Error())
+	}
+	if err != nil {
+		log.Printf("Failed to check the key of S3 upload %s: %v", key, err)
+		return h.error(c, fiber.StatusInternalServerError, "InternalError", "Failed to store the object")
+	}
+	defer release()
+
+	tmp, err := os.CreateTemp(h.Config.UploadDir, ".tmp-s3-*")
+	if err != nil {
+		log.Printf("Failed to buffer S3 upload: %v", err)
+		return h.error(c, fiber.StatusInternalServerError, "InternalError", "Failed to store the object")
+	}
+	defer os.Remove(tmp.Name())
+
+	sum := md5.New()
+	writers := []io.Writer{tmp, sum}
+	if sha != nil {
+		writers = append(writers, sha)
+	}
+	written, copyErr := io.Copy(io.MultiWriter(writers...), io.LimitReader(body, size))
+	if err := tmp.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	switch {
+	case errors.Is(copyErr, auth.ErrSigV4Mismatch):
+		return h.error(c, fiber.StatusForbidden, "SignatureDoesNotMatch", "A chunk signature does not match")
+	case errors.Is(copyErr, auth.ErrSigV4ChunkInvalid):
+		return h.error(c, fiber.StatusBadRequest, "IncompleteBody", "The aws-chunked body is malformed")
+	case copyErr != nil:
+		log.Printf("Failed to receive S3 upload %s: %v", key, copyErr)
+		return h.error(c, fiber.StatusBadRequest, "IncompleteBody", "The request body could not be read")
+	case written != size:
+		return h.error(c, fiber.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header")
+	case sha != nil && hex.EncodeToString(sha.Sum(nil)) != strings.ToLower(payloadHash):
+		return h.error(c, fiber.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match what was computed")
+	}
+	digest := sum.Sum(nil)
+	if expectedMD5 != nil && !bytes.Equal(digest, expectedMD5) {
+		return h.error(c, fiber.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received")
+	}
+
+	header, err := readHeader(tmp.Name())
+	if err != nil {
+		log.Printf("Failed to read S3 upload %s: %v", key, err)
+		return h.error(c, fiber.StatusInternalServerError, "InternalError", "Failed to store the object")
+	}
+	_, detectedType, err := h.Files.checkContent(key, header, false)
+	if err != nil {
+		return h.error(c, fiber.StatusBadRequest, "InvalidArgument", err.Error())
+	}
+
+	detectedType, err = h.Files.checkStaged(bucket, key, detectedType, tmp.Name())
+	var violation *database.RuleViolation
+	if errors.As(err, &violation) {
+		return h.ruleError(c, violation)
+	}
+	if err != nil {
+		return h.error(c, fiber.StatusBadRequest, "InvalidArgument", err.Error())
+	}
+
+	_, statErr := h.Files.Storage.Stat(key)
+	replaced := statErr == nil
+	if replaced && h.Files.queueRejects(key, size, bucket.ProcessingProfile) {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(h.Config.QueueRetryAfter))
+		return h.error(c, fiber.StatusServiceUnavailable, "SlowDown", "Processing queue is full, please reduce your request rate")
+	}
+	if _, err := storage.MoveFile(h.Files.Storage, key, tmp.Name()); err != nil {
+		log.Printf("Failed to store S3 upload %s: %v", key, err)
+		return h.error(c, fiber.StatusInternalServerError, "InternalError", "Failed to store the object")
+	}
+	// Renditions of the replaced object are stale
+	if replaced {
+		utils.GetWorkerPool().Cancel(key)
+		h.Files.deleteRenditions(key)
+	}
+
+	uploaderKeyID, uploaderKeyName := uploaderIdentity(c, nil)
+	etag := hex.EncodeToString(digest)
+	_, originalName := database.SplitObjectKey(key)
+	_, _, err = h.Files.processUpload(c, &storedUpload{
+		FileName:        key,
+		OriginalName:    originalName,
+		ContentType:     contentType,
+		DetectedType:    detectedType,
+		Size:            size,
+		Visibility:      visibility,
+		Profile:         bucket.ProcessingProfile,
+		UploaderKeyID:   uploaderKeyID,
+		UploaderKeyName: uploaderKeyName,
+		ETag:            etag,
+		Replaced:        replaced,
+	}, h.Config.QueueFullPolicy)
+	if errors.Is(err, errUploadRejected) {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(h.Config.QueueRetryAfter))
+		return h.error(c, fiber.StatusServiceUnavailable, "SlowDown", "Processing queue is full, please reduce your request rate")
+	}
+	if err != nil {
+		return h.error(c, fiber.StatusInternalServerError, "InternalError", "Failed to save object metadata")
+	}
+
+	c.Set(fiber.HeaderETag, quoteETag(etag))
+	c.Status(fiber.StatusOK)
+	return nil
+}
+
+// DeleteObject removes an object and its renditions. Like S3 it succeeds
+// for keys that do not exist.
+func (h *S3Handler) DeleteObject(c *fiber.Ctx) error {
+	bucket, ok := h.bucket(c)
+	if !ok {
+		return h.noSuchBucket(c)
+	}
+	if !h.allowed(c, auth.ScopeDelete) {
+		return h.accessDenied(c)
+	}
+	key, ok := h.objectKey(c, bucket)
+	if !ok {
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+
+	if _, _, err := h.Files.deleteObject(key); err != nil {
+		log.Printf("Failed to delete %s: %v", key, err)
+		return h.error(c, fiber.StatusInternalServerError, "InternalError", "Failed to delete the object")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// NotImplemented answers S3 operations this endpoint does not support
+func (h *S3Handler) NotImplemented(c *fiber.Ctx) error {
+	return h.error(c, fiber.StatusNotImplemented, "NotImplemented", "A header or operation you provided implies functionality that is not implemented")
+}
+
+// allowed reports whether the request may perform an operation needing
+// scope. Anonymous requests are allowed while authentication is disabled.
+func (h *S3Handler) allowed(c *fiber.Ctx, scope string) bool {
+	if key := auth.KeyFromContext(c); key != nil {
+		return auth.HasScope(key, scope)
+	}
+	return !h.Config.AuthEnabled
+}
+
+// objectKey returns the storage key of the decoded object key in bucket.
+// Keys follow the rules of client chosen keys, see utils.ValidateObjectKey.
+func (h *S3Handler) objectKey(c *fiber.Ctx, bucket *database.BucketRecord) (string, bool) {
+	key, err := url.PathUnescape(c.Params("*"))
+	if err != nil {
+		return "", false
+	}
+	storageKey, err := objectStorageKey(bucket.Name, key)
+	return storageKey, err == nil
+}
+
+// etag returns the quoted entity tag of key: the content MD5 or composite
+// multipart ETag when recorded, otherwise the one used by /api/files
+func (h *S3Handler) etag(key string, info *storage.ObjectInfo) string {
+	if rec, err := h.DB.GetObject(key); err == nil && rec.ETag != "" {
+		return quoteETag(rec.ETag)
+	}
+	return objectETag(info)
+}
+
+// bucket returns the bucket named in the path. S3_API_BUCKET names the
+// default bucket, all other names the bucket created under that name.
+func (h *S3Handler) bucket(c *fiber.Ctx) (*database.BucketRecord, bool) {
+	name := c.Params("bucket")
+	if name == h.Config.S3APIBucket {
+		return h.Files.defaultBucket(), true
+	}
+	bucket, err := h.DB.GetBucket(name)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			log.Printf("Failed to load bucket %s: %v", name, err)
+		}
+		return nil, false
+	}
+	return bucket, true
+}
+
+func (h *S3Handler) noSuchBucket(c *fiber.Ctx) error {
+	return h.error(c, fiber.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+}
+
+func (h *S3Handler) noSuchKey(c *fiber.Ctx) error {
+	return h.error(c, fiber.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+}
+
+func (h *S3Handler) accessDenied(c *fiber.Ctx) error {
+	return h.error(c, fiber.StatusForbidden, "AccessDenied", "Access Denied")
+}
+
+// error writes an S3 XML error response
+func (h *S3Handler) error(c *fiber.Ctx, status int, code, message string) error {
+	return c.Status(status).XML(s3Error{
+		Code:      code,
+		Message:   message,
+		Resource:  c.Path(),
+		RequestID: string(c.Response().Header.Peek("x-amz-request-id")),
+	})
+}
+
+// ruleError writes the S3 error for an object breaking an upload rule
+func (h *S3Handler) ruleError(c *fiber.Ctx, violation *database.RuleViolation) error {
+	if violation.Rule == database.RuleMaxSize {
+		return h.error(c, fiber.StatusBadRequest, "EntityTooLarge", violation.Error())
+	}
+	return h.error(c, fiber.StatusBadRequest, "InvalidArgument", violation.Error())
+}
@@ -0,0 +1,366 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"object-storage-server/models"
+	"object-storage-server/storage"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// errUnsatisfiableRange is returned when none of the requested ranges overlap the object
+var errUnsatisfiableRange = errors.New("unsatisfiable range")
+
+// byteRange is a part of an object requested with a Range header
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+// contentRange formats the Content-Range header value for r
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// serveObject streams the object stored under key with the given
+// Content-Disposition header value. It sets ETag and Last-Modified, answers
+// If-None-Match/If-Modified-Since with 304 and If-Match/If-Unmodified-Since
+// with 412, and serves Range requests (also guarded by If-Range) with 206,
+// using multipart/byteranges when several ranges are requested.
+func (h *FileHandler) serveObject(c *fiber.Ctx, key, disposition string) error {
+	info, err := h.Storage.Stat(key)
+	if err != nil {
+		return h.storageError(c, err)
+	}
+
+	etag := objectETag(info)
+	modTime := info.ModTime.UTC().Truncate(time.Second)
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderLastModified, modTime.Format(http.TimeFormat))
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+
+	switch checkPreconditions(c, etag, modTime) {
+	case fiber.StatusNotModified:
+		return c.SendStatus(fiber.StatusNotModified)
+	case fiber.StatusPreconditionFailed:
+		return c.Status(fiber.StatusPreconditionFailed).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Precondition failed",
+		})
+	}
+
+	contentType := h.servedContentType(key)
+	c.Set(fiber.HeaderContentDisposition, disposition)
+
+	var ranges []byteRange
+	if c.Method() == fiber.MethodGet && rangeApplies(c, etag, modTime) {
+		ranges, err = parseRange(c.Get(fiber.HeaderRange), info.Size)
+		if err != nil {
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", info.Size))
+			return c.Status(fiber.StatusRequestedRangeNotSatisfiable).JSON(models.ErrorResponse{
+				Success: false,
+				Message: "Requested range not satisfiable",
+			})
+		}
+	}
+
+	switch len(ranges) {
+	case 0:
+		c.Set(fiber.HeaderContentType, contentType)
+		return h.sendBody(c, info.Size, func() (io.ReadCloser, error) {
+			return h.Storage.Get(key)
+		})
+	case 1:
+		r := ranges[0]
+		c.Status(fiber.StatusPartialContent)
+		c.Set(fiber.HeaderContentType, contentType)
+		c.Set(fiber.HeaderContentRange, r.contentRange(info.Size))
+		return h.sendBody(c, r.length, func() (io.ReadCloser, error) {
+			return h.Storage.GetRange(key, r.start, r.length)
+		})
+	default:
+		return h.sendRanges(c, key, contentType, ranges, info.Size)
+	}
+}
+
+// sendBody streams n bytes from the reader returned by open.
+// HEAD requests only get the headers and never open the object.
+func (h *FileHandler) sendBody(c *fiber.Ctx, n int64, open func() (io.ReadCloser, error)) error {
+	if c.Method() == fiber.MethodHead {
+		c.Response().Header.SetContentLength(int(n))
+		return nil
+	}
+
+	body, err := open()
+	if err != nil {
+		return h.storageError(c, err)
+	}
+	// fasthttp closes the reader once the body is written
+	return c.SendStream(body, int(n))
+}
+
+// sendRanges streams several ranges of key as a multipart/byteranges body
+func (h *FileHandler) sendRanges(c *fiber.Ctx, key, contentType string, ranges []byteRange, size int64) error {
+	partHeader := func(r byteRange) textproto.MIMEHeader {
+		return textproto.MIMEHeader{
+			fiber.HeaderContentType:  {contentType},
+			fiber.HeaderContentRange: {r.contentRange(size)},
+		}
+	}
+
+	// Write the part headers once to learn the boundary and the body length
+	var counter countingWriter
+	mw := multipart.NewWriter(&counter)
+	var total int64
+	for _, r := range ranges {
+		mw.CreatePart(partHeader(r))
+		total += r.length
+	}
+	mw.Close()
+	total += int64(counter)
+	boundary := mw.Boundary()
+
+	c.Status(fiber.StatusPartialContent)
+	c.Set(fiber.HeaderContentType, "multipart/byteranges; boundary="+boundary)
+
+	return h.sendBody(c, total, func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			mw := multipart.NewWriter(pw)
+			mw.SetBoundary(boundary)
+			for _, r := range ranges {
+				part, err := mw.CreatePart(partHeader(r))
+				if err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				body, err := h.Storage.GetRange(key, r.start, r.length)
+				if err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				_, err = io.Copy(part, body)
+				body.Close()
+				if err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+			pw.CloseWithError(mw.Close())
+		}()
+		return pr, nil
+	})
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// contentDisposition builds a Content-Disposition header value of type
+// "inline" or "attachment" for filename. Names that are not plain ASCII get
+// an RFC 5987 filename* parameter next to an ASCII fallback for old clients.
+func contentDisposition(dispositionType, filename string) string {
+	filename = strings.ToValidUTF8(filename, "_")
+
+	var fallback strings.Builder
+	plain := true
+	for _, r := range filename {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+			plain = false
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+
+	value := fmt.Sprintf("%s; filename=\"%s\"", dispositionType, fallback.String())
+	if !plain {
+		value += "; filename*=UTF-8''" + encodeRFC5987(filename)
+	}
+	return value
+}
+
+// encodeRFC5987 percent-encodes s as an RFC 5987 ext-value, leaving only attr-chars
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0x0f])
+		}
+	}
+	return b.String()
+}
+
+// objectETag derives a strong entity tag from the object's size and modification time
+func objectETag(info *storage.ObjectInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.ModTime.UnixNano(), info.Size)
+}
+
+// checkPreconditions evaluates the conditional request headers in the order
+// of RFC 9110 section 13.2.2. It returns 304, 412 or 0 when the request
+// should be served normally.
+func checkPreconditions(c *fiber.Ctx, etag string, modTime time.Time) int {
+	if ifMatch := c.Get(fiber.HeaderIfMatch); ifMatch != "" {
+		if !etagListMatches(ifMatch, etag, false) {
+			return fiber.StatusPreconditionFailed
+		}
+	} else if t, ok := parseHTTPDate(c.Get(fiber.HeaderIfUnmodifiedSince)); ok && modTime.After(t) {
+		return fiber.StatusPreconditionFailed
+	}
+
+	safe := c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead
+	if ifNoneMatch := c.Get(fiber.HeaderIfNoneMatch); ifNoneMatch != "" {
+		if etagListMatches(ifNoneMatch, etag, true) {
+			if safe {
+				return fiber.StatusNotModified
+			}
+			return fiber.StatusPreconditionFailed
+		}
+	} else if t, ok := parseHTTPDate(c.Get(fiber.HeaderIfModifiedSince)); ok && safe && !modTime.After(t) {
+		return fiber.StatusNotModified
+	}
+	return 0
+}
+
+// rangeApplies reports whether a Range header should be honoured, which is
+// the case unless an If-Range validator no longer matches the object
+func rangeApplies(c *fiber.Ctx, etag string, modTime time.Time) bool {
+	if c.Get(fiber.HeaderRange) == "" {
+		return false
+	}
+	ifRange := c.Get(fiber.HeaderIfRange)
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "\"") || strings.HasPrefix(ifRange, "W/") {
+		return etagListMatches(ifRange, etag, false)
+	}
+	t, ok := parseHTTPDate(ifRange)
+	return ok && modTime.Equal(t)
+}
+
+// etagListMatches reports whether the comma separated entity tags in header
+// contain etag. Weak comparison ignores the W/ prefix, strong comparison
+// never matches weak tags.
+func etagListMatches(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHTTPDate parses an HTTP date header value
+func parseHTTPDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(value)
+	return t, err == nil
+}
+
+// parseRange parses a "bytes=" Range header for an object of the given size.
+// Malformed headers, other units and requests whose ranges add up to more
+// than the object are ignored and return no ranges, so the full object is
+// served. errUnsatisfiableRange is returned when no range overlaps the object.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	var total int64
+	unsatisfiable := false
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r byteRange
+		if first == "" {
+			// Suffix range: the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				unsatisfiable = true
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				unsatisfiable = true
+				continue
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+
+		ranges = append(ranges, r)
+		total += r.length
+	}
+
+	if len(ranges) == 0 {
+		if unsatisfiable {
+			return nil, errUnsatisfiableRange
+		}
+		return nil, nil
+	}
+	if total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
@@ -0,0 +1,566 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"object-storage-server/config"
+	"object-storage-server/database"
+	"object-storage-server/models"
+	"object-storage-server/storage"
+	"object-storage-server/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// tus protocol constants
+const (
+	tusVersion         = "1.0.0"
+	tusExtensions      = "creation,termination,checksum"
+	tusChecksumAlgos   = "sha1,md5,sha256"
+	tusOffsetMediaType = "application/offset+octet-stream"
+
+	// Status code defined by the tus checksum extension
+	statusChecksumMismatch = 460
+)
+
+// TusHandler implements the tus 1.0 resumable upload protocol. Chunks are
+// appended to a data file below UploadDir; once complete the file goes
+// through the same metadata and processing path as regular uploads.
+type TusHandler struct {
+	Config *config.Config
+	DB     *database.DB
+	Files  *FileHandler
+
+	dir   string
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex // Serializes PATCH requests per upload
+}
+
+func NewTusHandler(cfg *config.Config, db *database.DB, files *FileHandler) (*TusHandler, error) {
+	dir := filepath.Join(cfg.UploadDir, ".tus")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create tus directory: %w", err)
+	}
+	h := &TusHandler{Config: cfg, DB: db, Files: files, dir: dir, locks: make(map[string]*sync.Mutex)}
+	files.onBucketRemoved(h.abortBucket)
+	return h, nil
+}
+
+// Options advertises the supported tus version and extensions
+func (h *TusHandler) Options(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Tus-Version", tusVersion)
+	c.Set("Tus-Extension", tusExtensions)
+	c.Set("Tus-Checksum-Algorithm", tusChecksumAlgos)
+	c.Set("Tus-Max-Size", strconv.FormatInt(h.Config.MaxFileSize, 10))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// CheckVersion rejects requests for other protocol versions and adds the
+// Tus-Resumable header to every response
+func (h *TusHandler) CheckVersion(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", tusVersion)
+	if c.Method() != fiber.MethodOptions && c.Get("Tus-Resumable") != tusVersion {
+		c.Set("Tus-Version", tusVersion)
+		return c.Status(fiber.StatusPreconditionFailed).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Unsupported tus version, expected Tus-Resumable: " + tusVersion,
+		})
+	}
+	return c.Next()
+}
+
+// Create starts a new upload (creation extension)
+func (h *TusHandler) Create(c *fiber.Ctx) error {
+	if c.Get("Upload-Defer-Length") != "" {
+		return badRequest(c, "Upload-Defer-Length is not supported")
+	}
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return badRequest(c, "Upload-Length header is required")
+	}
+
+	rawMeta := c.Get("Upload-Metadata")
+	meta, err := parseTusMetadata(rawMeta)
+	if err != nil {
+		return badRequest(c, err.Error())
+	}
+	if meta["filename"] == "" {
+		return badRequest(c, "Upload-Metadata must contain a filename")
+	}
+
+	// The bucket named in the metadata applies its size limit, rules,
+	// default visibility and processing profile
+	bucket, err := h.Files.bucket(meta["bucket"])
+	if err != nil {
+		return bucketError(c, err)
+	}
+	if maxSize := h.Files.bucketMaxFileSize(bucket); length > maxSize {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(models.ErrorResponse{
+			Success: false,
+			Message: fmt.Sprintf("File size exceeds maximum allowed size of %d bytes", maxSize),
+		})
+	}
+
+	// Type and size rules are checked before any data is sent
+	contentType := utils.GetContentType(meta["filename"])
+	if contentType == "application/octet-stream" && meta["filetype"] != "" {
+		contentType = meta["filetype"]
+	}
+	if violation := h.Files.checkFileRules(bucket, meta["filename"], contentType, length); violation != nil {
+		return ruleError(c, violation)
+	}
+	visibility := meta["visibility"]
+	if visibility == "" {
+		visibility = bucket.Visibility
+	}
+	if visibility != database.VisibilityPublic && visibility != database.VisibilityPrivate {
+		return badRequest(c, "visibility must be \"public\" or \"private\"")
+	}
+
+	now := time.Now()
+	upload := &database.TusUploadRecord{
+		ID:         strings.ReplaceAll(uuid.Must(uuid.NewV7()).String(), "-", ""),
+		Length:     length,
+		Metadata:   meta,
+		RawMeta:    rawMeta,
+		Visibility: visibility,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if bucket.Name != database.DefaultBucket {
+		upload.Bucket = bucket.Name
+	}
+	upload.UploaderKeyID, upload.UploaderKeyName = uploaderIdentity(c, nil)
+
+	data, err := os.OpenFile(h.dataPath(upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return h.internalError(c, "Failed to create upload", err)
+	}
+	data.Close()
+
+	if err := h.DB.PutTusUpload(upload); err != nil {
+		os.Remove(h.dataPath(upload.ID))
+		return h.internalError(c, "Failed to create upload", err)
+	}
+
+	c.Set(fiber.HeaderLocation, fmt.Sprintf("%s/api/tus/%s", h.Config.BaseURL, upload.ID))
+	c.Set("Upload-Offset", "0")
+
+	// Zero byte files are complete as soon as they are created
+	if length == 0 {
+		if err := h.complete(c, upload); err != nil {
+			return h.completeError(c, upload, err)
+		}
+	}
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+// Head reports the current offset of an upload
+func (h *TusHandler) Head(c *fiber.Ctx) error {
+	upload, offset, err := h.load(c, c.Params("id"))
+	if err != nil {
+		return h.notFound(c, err)
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.RawMeta != "" {
+		c.Set("Upload-Metadata", upload.RawMeta)
+	}
+	h.setResultHeaders(c, upload)
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// Patch appends a chunk at the given offset, verifying its checksum when
+// an Upload-Checksum header is sent
+func (h *TusHandler) Patch(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if c.Get(fiber.HeaderContentType) != tusOffsetMediaType {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Content-Type must be " + tusOffsetMediaType,
+		})
+	}
+
+	lock := h.lock(id)
+	if !lock.TryLock() {
+		return c.Status(fiber.StatusLocked).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Upload is being written by another request",
+		})
+	}
+	defer lock.Unlock()
+
+	upload, offset, err := h.load(c, id)
+	if err != nil {
+		h.forget(id)
+		return h.notFound(c, err)
+	}
+
+	requested, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return badRequest(c, "Upload-Offset header is required")
+	}
+	if requested != offset || upload.CompletedAt != nil {
+		if upload.CompletedAt != nil {
+			h.forget(id)
+		}
+		c.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Success: false,
+			Message: fmt.Sprintf("Upload-Offset does not match the current offset %d", offset),
+		})
+	}
+
+	var checksum hash.Hash
+	var expected []byte
+	if header := c.Get("Upload-Checksum"); header != "" {
+		checksum, expected, err = parseTusChecksum(header)
+		if err != nil {
+			return badRequest(c, err.Error())
+		}
+	}
+
+	remaining := upload.Length - offset
+	if length := int64(c.Request().Header.ContentLength()); length > remaining {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Chunk exceeds Upload-Length",
+		})
+	}
+
+	data, err := os.OpenFile(h.dataPath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		return h.internalError(c, "Failed to open upload", err)
+	}
+	if _, err := data.Seek(offset, io.SeekStart); err != nil {
+		data.Close()
+		return h.internalError(c, "Failed to open upload", err)
+	}
+
+	var body io.Reader = c.Request().BodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+	var dst io.Writer = data
+	if checksum != nil {
+		dst = io.MultiWriter(data, checksum)
+	}
+
+	// Without a checksum, whatever arrived before a dropped connection is
+	// kept so the client can resume from there
+	written, copyErr := io.Copy(dst, io.LimitReader(body, remaining))
+	if checksum != nil && (copyErr != nil || !bytes.Equal(checksum.Sum(nil), expected)) {
+		data.Truncate(offset)
+		data.Close()
+		if copyErr == nil {
+			return c.Status(statusChecksumMismatch).JSON(models.ErrorResponse{
+				Success: false,
+				Message: "Checksum mismatch",
+			})
+		}
+		return h.internalError(c, "Failed to write chunk", copyErr)
+	}
+	if err := data.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	if copyErr != nil {
+		return h.internalError(c, "Failed to write chunk", copyErr)
+	}
+
+	offset += written
+	upload.UpdatedAt = time.Now()
+	if err := h.DB.PutTusUpload(upload); err != nil {
+		log.Printf("Failed to update tus upload %s: %v", id, err)
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if offset == upload.Length {
+		if err := h.complete(c, upload); err != nil {
+			return h.completeError(c, upload, err)
+		}
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Terminate discards an upload and its received data (termination extension)
+func (h *TusHandler) Terminate(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if _, _, err := h.load(c, id); err != nil {
+		return h.notFound(c, err)
+	}
+
+	lock := h.lock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := h.DB.DeleteTusUpload(id); err != nil {
+		// Terminated by a concurrent request
+		h.forget(id)
+		return h.notFound(c, err)
+	}
+	if err := os.Remove(h.dataPath(id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove tus data for %s: %v", id, err)
+	}
+	h.forget(id)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// complete hands a fully received upload to storage and processing
+func (h *TusHandler) complete(c *fiber.Ctx, upload *database.TusUploadRecord) error {
+	bucket, err := h.Files.bucket(upload.Bucket)
+	if err != nil {
+		// The bucket was deleted while the upload was in progress
+		h.discard(upload.ID)
+		return err
+	}
+
+	name := filepath.Base(upload.Metadata["filename"])
+	header, err := readHeader(h.dataPath(upload.ID))
+	if err != nil {
+		return err
+	}
+	fileName, detectedType, err := h.Files.checkContent(utils.GenerateUniqueFileName(name), header, true)
+	if err != nil {
+		// Resuming cannot change the content, so the upload is dropped
+		h.discard(upload.ID)
+		return err
+	}
+	fileName = database.ObjectKey(bucket.Name, fileName)
+
+	detectedType, err = h.Files.checkStaged(bucket, fileName, detectedType, h.dataPath(upload.ID))
+	if errors.Is(err, errContentMismatch) {
+		h.discard(upload.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := storage.MoveFile(h.Files.Storage, fileName, h.dataPath(upload.ID)); err != nil {
+		return err
+	}
+
+	// Prefer the extension-based type, fall back to what the client declared
+	contentType := utils.GetContentType(fileName)
+	if contentType == "application/octet-stream" && upload.Metadata["filetype"] != "" {
+		contentType = upload.Metadata["filetype"]
+	}
+
+	// A finished multi-GB upload is never thrown away, so a full
+	// processing queue always defers instead of rejecting
+	response, _, err := h.Files.processUpload(c, &storedUpload{
+		FileName:        fileName,
+		OriginalName:    name,
+		ContentType:     contentType,
+		DetectedType:    detectedType,
+		Size:            upload.Length,
+		Visibility:      upload.Visibility,
+		Profile:         bucket.ProcessingProfile,
+		UploaderKeyID:   upload.UploaderKeyID,
+		UploaderKeyName: upload.UploaderKeyName,
+	}, "defer")
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	upload.FileName = fileName
+	upload.JobID = response.JobID
+	upload.CompletedAt = &now
+	upload.UpdatedAt = now
+	if err := h.DB.PutTusUpload(upload); err != nil {
+		log.Printf("Failed to update tus upload %s: %v", upload.ID, err)
+	}
+	h.forget(upload.ID)
+	h.setResultHeaders(c, upload)
+	return nil
+}
+
+// completeError writes the response for an error returned by complete
+func (h *TusHandler) completeError(c *fiber.Ctx, upload *database.TusUploadRecord, err error) error {
+	if errors.Is(err, errContentMismatch) {
+		return contentMismatch(c, err)
+	}
+	if errors.Is(err, database.ErrNotFound) {
+		return bucketError(c, err)
+	}
+	var violation *database.RuleViolation
+	if errors.As(err, &violation) {
+		h.discard(upload.ID)
+		return ruleError(c, violation)
+	}
+	return h.internalError(c, "Failed to store completed upload", err)
+}
+
+// discard removes the record and received data of an upload that cannot complete
+func (h *TusHandler) discard(id string) {
+	if err := h.DB.DeleteTusUpload(id); err != nil && !errors.Is(err, database.ErrNotFound) {
+		log.Printf("Failed to delete tus upload %s: %v", id, err)
+	}
+	if err := os.Remove(h.dataPath(id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove tus data for %s: %v", id, err)
+	}
+	h.forget(id)
+}
+
+// abortBucket discards the unfinished uploads targeting a deleted bucket,
+// waiting for chunks still being written to them
+func (h *TusHandler) abortBucket(bucket string) {
+	uploads, err := h.DB.ListTusUploads()
+	if err != nil {
+		log.Printf("Failed to list tus uploads of bucket %s: %v", bucket, err)
+		return
+	}
+	for _, upload := range uploads {
+		if upload.Bucket != bucket || upload.CompletedAt != nil {
+			continue
+		}
+		lock := h.lock(upload.ID)
+		lock.Lock()
+		log.Printf("tus: Discarding upload %s, its bucket %s was deleted", upload.ID, bucket)
+		h.discard(upload.ID)
+		lock.Unlock()
+	}
+}
+
+// setResultHeaders points clients at the stored file of a completed upload
+func (h *TusHandler) setResultHeaders(c *fiber.Ctx, upload *database.TusUploadRecord) {
+	if upload.CompletedAt == nil {
+		return
+	}
+	_, key := database.SplitObjectKey(upload.FileName)
+	c.Set("Upload-File-Name", key)
+	c.Set("Upload-Metadata-URL", h.Files.objectURL(upload.FileName, "metadata"))
+	if upload.JobID != "" {
+		c.Set("Upload-Job-URL", fmt.Sprintf("%s/api/jobs/%s", h.Config.BaseURL, upload.JobID))
+	}
+}
+
+// load returns the upload record and its current offset. Uploads started
+// by another API key are reported as not found, see ownsUpload.
+func (h *TusHandler) load(c *fiber.Ctx, id string) (*database.TusUploadRecord, int64, error) {
+	upload, err := h.DB.GetTusUpload(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ownsUpload(c, upload.UploaderKeyID) {
+		return nil, 0, database.ErrNotFound
+	}
+	if upload.CompletedAt != nil {
+		return upload, upload.Length, nil
+	}
+
+	info, err := os.Stat(h.dataPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	return upload, info.Size(), nil
+}
+
+// lock returns the mutex guarding writes to upload id
+func (h *TusHandler) lock(id string) *sync.Mutex {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	lock, ok := h.locks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		h.locks[id] = lock
+	}
+	return lock
+}
+
+// forget drops the mutex of an upload that accepts no more writes. A
+// request still holding it finishes normally and later requests see the
+// completed or missing record under a fresh mutex
+func (h *TusHandler) forget(id string) {
+	h.mu.Lock()
+	delete(h.locks, id)
+	h.mu.Unlock()
+}
+
+// dataPath returns the file holding the received bytes of upload id
+func (h *TusHandler) dataPath(id string) string {
+	return filepath.Join(h.dir, filepath.Base(id))
+}
+
+// notFound maps a failed lookup to 404
+func (h *TusHandler) notFound(c *fiber.Ctx, err error) error {
+	if errors.Is(err, database.ErrNotFound) || os.IsNotExist(err) {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Success: false,
+			Message: "Upload not found",
+		})
+	}
+	return h.internalError(c, "Failed to load upload", err)
+}
+
+// internalError logs err and responds with 500
+func (h *TusHandler) internalError(c *fiber.Ctx, message string, err error) error {
+	log.Printf("tus: %s: %v", message, err)
+	return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+		Success: false,
+		Message: message,
+	})
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated
+// "key base64value" pairs, the value being optional
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if header == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid Upload-Metadata header")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q", key)
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+// parseTusChecksum parses an Upload-Checksum header ("<algorithm> <base64 digest>")
+func parseTusChecksum(header string) (hash.Hash, []byte, error) {
+	algo, encoded, ok := strings.Cut(header, " ")
+	if !ok {
+		return nil, nil, errors.New("invalid Upload-Checksum header")
+	}
+	expected, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, errors.New("invalid Upload-Checksum digest")
+	}
+
+	switch algo {
+	case "sha1":
+		return sha1.New(), expected, nil
+	case "md5":
+		return md5.New(), expected, nil
+	case "sha256":
+		return sha256.New(), expected, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported checksum algorithm %q (supported: %s)", algo, tusChecksumAlgos)
+	}
+}
@@ -4,12 +4,20 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"object-storage-server/auth"
 	"object-storage-server/config"
+	"object-storage-server/database"
 	_ "object-storage-server/docs" // Swagger docs
 	"object-storage-server/handlers"
 	"object-storage-server/routes"
+	"object-storage-server/storage"
+	"object-storage-server/utils"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/compress"
@@ -30,11 +38,36 @@ func main() {
 	// Load configuration
 	cfg := config.LoadConfig()
 
-	// Ensure upload directory exists
-	if err := os.MkdirAll(cfg.UploadDir, 0755); err != nil {
-		log.Fatal("Failed to create upload directory:", err)
+	// "object-storage-server apikey ..." manages API keys instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		os.Exit(runAPIKeyCommand(cfg, os.Args[2:]))
 	}
 
+	// Initialize storage backend (creates the upload directory for local storage)
+	store, err := storage.New(cfg)
+	if err != nil {
+		log.Fatal("Failed to initialize storage:", err)
+	}
+
+	// Open embedded metadata store
+	db, err := database.Open(cfg.DatabasePath)
+	if err != nil {
+		log.Fatal("Failed to open metadata database:", err)
+	}
+	defer db.Close()
+
+	// Store identical content once, shared through reference counts
+	if cfg.Deduplication {
+		store = storage.NewDedupDriver(store, db)
+	}
+
+	// Modern formats stored next to image renditions
+	utils.SetRenditionFormats(cfg.RenditionFormats)
+
+	// Start background processing workers and resume unfinished work
+	workerPool := utils.InitWorkerPool(store, db, cfg.WorkerCount, cfg.JobQueueSize)
+	go workerPool.Recover(cfg.ReconcileOnStartup)
+
 	// Create Fiber app with optimized settings for concurrent connections
 	app := fiber.New(fiber.Config{
 		BodyLimit:             int(cfg.MaxFileSize), // 4GB max per request
@@ -49,6 +82,9 @@ func main() {
 		WriteTimeout:          0, // No timeout for large file downloads
 	})
 
+	// Set once a shutdown signal arrives
+	var shuttingDown atomic.Bool
+
 	// Middleware
 	// 1. Recovery from panics
 	app.Use(recover.New())
@@ -61,6 +97,10 @@ func main() {
 	// 3. Compression for responses (gzip)
 	app.Use(compress.New(compress.Config{
 		Level: compress.LevelBestSpeed, // Balance between speed and compression
+		// Byte ranges refer to the uncompressed object, never compress partial responses
+		Next: func(c *fiber.Ctx) bool {
+			return c.Get(fiber.HeaderRange) != ""
+		},
 	}))
 
 	// 4. Rate limiter to prevent abuse (100 requests per minute per IP)
@@ -81,15 +121,65 @@ func main() {
 	// 5. CORS
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: cfg.AllowedHosts,
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization",
-		AllowMethods: "GET, POST, PUT, DELETE, OPTIONS",
+		AllowHeaders: "Origin, Content-Type, Accept, Authorization, X-API-Key, " +
+			"Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, Upload-Checksum, Upload-Defer-Length, Content-MD5, " +
+			"X-Amz-Date, X-Amz-Content-Sha256, X-Amz-Acl, X-Amz-Decoded-Content-Length",
+		AllowMethods: "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS",
+		ExposeHeaders: "Location, ETag, X-Amz-Request-Id, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Tus-Checksum-Algorithm, " +
+			"Upload-Offset, Upload-Length, Upload-Metadata, Upload-File-Name, Upload-Metadata-URL, Upload-Job-URL",
 	}))
 
+	// 6. API key authentication (scopes are enforced per route)
+	authn := auth.NewAuthenticator(db, cfg.AuthEnabled)
+	app.Use("/api", authn.Middleware())
+
+	// 7. Refuse new writes while shutting down, reads are still served
+	app.Use(func(c *fiber.Ctx) error {
+		if shuttingDown.Load() && c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(cfg.QueueRetryAfter))
+			c.Set(fiber.HeaderConnection, "close")
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"success": false,
+				"message": "Server is shutting down, please retry later",
+			})
+		}
+		return c.Next()
+	})
+
 	// Initialize handlers
-	fileHandler := handlers.NewFileHandler(cfg)
+	signingSecret, err := auth.LoadSigningSecret(db, cfg.SigningSecret)
+	if err != nil {
+		log.Fatal("Failed to load URL signing secret:", err)
+	}
+	signer := auth.NewSigner(signingSecret)
+	fileHandler := handlers.NewFileHandler(cfg, store, db, signer)
+	jobHandler := handlers.NewJobHandler(cfg, db)
+	apiKeyHandler := handlers.NewAPIKeyHandler(db, signer)
+	tusHandler, err := handlers.NewTusHandler(cfg, db, fileHandler)
+	if err != nil {
+		log.Fatal("Failed to initialize resumable uploads:", err)
+	}
+	multipartHandler, err := handlers.NewMultipartHandler(cfg, db, fileHandler)
+	if err != nil {
+		log.Fatal("Failed to initialize multipart uploads:", err)
+	}
+
+	s3Handler, err := handlers.NewS3Handler(cfg, db, fileHandler)
+	if err != nil {
+		log.Fatal("Failed to initialize S3 endpoint:", err)
+	}
+
+	// Abort multipart uploads abandoned for longer than MULTIPART_UPLOAD_EXPIRY
+	stopCleanup := make(chan struct{})
+	go multipartHandler.RunCleanup(stopCleanup)
+
+	// Remove finished job records older than JOB_RETENTION
+	if cfg.JobRetention > 0 {
+		go workerPool.RunRetention(cfg.JobRetention, stopCleanup)
+	}
 
 	// Setup routes
-	routes.SetupRoutes(app, fileHandler)
+	routes.SetupRoutes(app, authn, fileHandler, jobHandler, apiKeyHandler, tusHandler, multipartHandler, s3Handler)
 
 	// Swagger documentation - must be after routes
 	app.Get("/docs/*", swagger.New(swagger.Config{
@@ -101,10 +191,55 @@ func main() {
 	// Start server
 	addr := fmt.Sprintf(":%s", cfg.ServerPort)
 	log.Printf("🚀 Object Storage Server running on %s", cfg.BaseURL)
-	log.Printf("📁 Upload directory: %s", cfg.UploadDir)
+	log.Printf("📁 Storage driver: %s (upload directory: %s)", cfg.StorageDriver, cfg.UploadDir)
+	if cfg.Deduplication {
+		log.Printf("🧬 Content deduplication enabled")
+	}
 	log.Printf("📊 Max file size: %d bytes (%.2f MB)", cfg.MaxFileSize, float64(cfg.MaxFileSize)/(1024*1024))
+	if cfg.MaxVideoDuration > 0 && !utils.CheckFFprobeInstalled() {
+		log.Printf("⚠️  MAX_VIDEO_DURATION is set but ffprobe is not installed, video durations are not checked")
+	}
+	for _, format := range utils.RenditionFormats() {
+		if !utils.CanEncodeImage(format) {
+			log.Printf("⚠️  RENDITION_FORMATS includes %s but ffmpeg cannot encode it, those variants will fail", format)
+		}
+	}
+	if cfg.AuthEnabled {
+		log.Printf("🔑 API key authentication enabled")
+	} else {
+		log.Printf("⚠️  API key authentication disabled (set AUTH_ENABLED=true to require keys)")
+	}
+	log.Printf("⚙️  Workers: %d, job queue size: %d, queue full policy: %s", cfg.WorkerCount, cfg.JobQueueSize, cfg.QueueFullPolicy)
+
+	go func() {
+		if err := app.Listen(addr); err != nil {
+			log.Fatal("Failed to start server:", err)
+		}
+	}()
+
+	// Wait for SIGINT (Ctrl+C) or SIGTERM (docker stop)
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	sig := <-quit
+	signal.Stop(quit)
+
+	log.Printf("🛑 Received %s, shutting down (request timeout %s, job drain timeout %s)",
+		sig, cfg.ShutdownTimeout, cfg.JobDrainTimeout)
+	shuttingDown.Store(true)
+
+	// Stop accepting connections and let in-flight requests finish
+	if err := app.ShutdownWithTimeout(cfg.ShutdownTimeout); err != nil {
+		log.Printf("HTTP shutdown did not complete: %v", err)
+	}
+
+	close(stopCleanup)
 
-	if err := app.Listen(addr); err != nil {
-		log.Fatal("Failed to start server:", err)
+	// Drain the job queue, unfinished jobs stay queued for the next start
+	if workerPool.Shutdown(cfg.JobDrainTimeout) {
+		log.Println("All processing jobs finished")
+	} else {
+		log.Println("Unfinished processing jobs will resume on next start")
 	}
+
+	log.Println("Server stopped")
 }
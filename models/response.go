@@ -12,39 +12,236 @@ type ViewURLs struct {
 	Video480p  string `json:"480p,omitempty"`
 	Video360p  string `json:"360p,omitempty"`
 	// Audio bitrates
-	AudioHigh   string `json:"high,omitempty"`
-	AudioMedium string `json:"medium,omitempty"`
-	AudioLow    string `json:"low,omitempty"`
+	AudioHigh   string `json:"audio_high,omitempty"`
+	AudioMedium string `json:"audio_medium,omitempty"`
+	AudioLow    string `json:"audio_low,omitempty"`
 }
 
 type UploadResponse struct {
-	Success     bool      `json:"success"`
-	Message     string    `json:"message"`
-	FileName    string    `json:"file_name,omitempty"`
-	FileURL     string    `json:"file_url,omitempty"`
-	ViewURLs    *ViewURLs `json:"view_urls,omitempty"`
-	MetadataURL string    `json:"metadata_url,omitempty"`
-	FileSize    int64     `json:"file_size,omitempty"`
-	FileType    string    `json:"file_type,omitempty"` // "image", "video", "audio", "other"
-	IsImage     bool      `json:"is_image,omitempty"`
-	IsVideo     bool      `json:"is_video,omitempty"`
-	IsAudio     bool      `json:"is_audio,omitempty"`
+	Success      bool      `json:"success"`
+	Message      string    `json:"message"`
+	Bucket       string    `json:"bucket,omitempty"`
+	FileName     string    `json:"file_name,omitempty"`
+	OriginalName string    `json:"original_name,omitempty"` // File name sent by the client
+	FileURL      string    `json:"file_url,omitempty"`
+	ViewURLs     *ViewURLs `json:"view_urls,omitempty"`
+	MetadataURL  string    `json:"metadata_url,omitempty"`
+	FileSize     int64     `json:"file_size,omitempty"`
+	DetectedType string    `json:"detected_type,omitempty"` // MIME type sniffed from the content
+	FileType     string    `json:"file_type,omitempty"`     // "image", "video", "audio", "other"
+	IsImage      bool      `json:"is_image,omitempty"`
+	IsVideo      bool      `json:"is_video,omitempty"`
+	IsAudio      bool      `json:"is_audio,omitempty"`
+	JobID        string    `json:"job_id,omitempty"`
+	JobURL       string    `json:"job_url,omitempty"`
+	JobStatus    string    `json:"job_status,omitempty"`   // "queued" or "deferred"
+	Visibility   string    `json:"visibility,omitempty"`   // "public" or "private"
+	ETag         string    `json:"etag,omitempty"`         // Composite ETag of multipart uploads
+	SHA256       string    `json:"sha256,omitempty"`       // Set when deduplication is enabled
+	Deduplicated bool      `json:"deduplicated,omitempty"` // The content was already stored
 }
 
 type FileMetadata struct {
-	Success     bool              `json:"success"`
-	FileName    string            `json:"file_name"`
-	FileSize    int64             `json:"file_size"`
-	ContentType string            `json:"content_type"`
-	FileType    string            `json:"file_type"` // "image", "video", "audio", "other"
-	IsImage     bool              `json:"is_image"`
-	IsVideo     bool              `json:"is_video"`
-	IsAudio     bool              `json:"is_audio"`
-	UploadedAt  string            `json:"uploaded_at"`
-	URLs        map[string]string `json:"urls"`
+	Success          bool              `json:"success"`
+	Bucket           string            `json:"bucket"`
+	FileName         string            `json:"file_name"`
+	OriginalName     string            `json:"original_name,omitempty"`
+	FileSize         int64             `json:"file_size"`
+	ContentType      string            `json:"content_type"`
+	DetectedType     string            `json:"detected_type,omitempty"` // MIME type sniffed from the content
+	FileType         string            `json:"file_type"`               // "image", "video", "audio", "other"
+	IsImage          bool              `json:"is_image"`
+	IsVideo          bool              `json:"is_video"`
+	IsAudio          bool              `json:"is_audio"`
+	UploadedAt       string            `json:"uploaded_at"`
+	UploaderIP       string            `json:"uploader_ip,omitempty"`
+	UploaderKeyID    string            `json:"uploader_key_id,omitempty"`
+	UploaderKeyName  string            `json:"uploader_key_name,omitempty"`
+	Visibility       string            `json:"visibility,omitempty"` // "public" or "private"
+	ETag             string            `json:"etag,omitempty"`       // Composite ETag of multipart uploads
+	SHA256           string            `json:"sha256,omitempty"`
+	JobID            string            `json:"job_id,omitempty"`
+	ProcessingStatus string            `json:"processing_status,omitempty"` // "pending", "completed", "failed"
+	ProcessingError  string            `json:"processing_error,omitempty"`
+	Image            *ImageMetadata    `json:"image,omitempty"` // Images only
+	URLs             map[string]string `json:"urls"`
+}
+
+// ImageMetadata holds the dimensions and EXIF fields of an image
+type ImageMetadata struct {
+	Width       int    `json:"width"`  // As displayed, after EXIF orientation
+	Height      int    `json:"height"` // As displayed, after EXIF orientation
+	Orientation int    `json:"orientation,omitempty"`
+	Camera      string `json:"camera,omitempty"`   // e.g. "Apple iPhone 13"
+	TakenAt     string `json:"taken_at,omitempty"` // RFC 3339, without zone when the camera recorded none
+}
+
+type FileSummary struct {
+	FileName     string `json:"file_name"`
+	FileSize     int64  `json:"file_size"`
+	ContentType  string `json:"content_type"`
+	FileType     string `json:"file_type"` // "image", "video", "audio", "other"
+	IsDerivative bool   `json:"is_derivative"`
+	UploadedAt   string `json:"uploaded_at"`
+	ViewURL      string `json:"view_url"`
+	MetadataURL  string `json:"metadata_url"`
+}
+
+type ListResponse struct {
+	Success    bool          `json:"success"`
+	Files      []FileSummary `json:"files"`
+	Prefixes   []string      `json:"prefixes,omitempty"` // Common prefixes when listing with a delimiter
+	Count      int           `json:"count"`
+	HasMore    bool          `json:"has_more"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+type DeleteResponse struct {
+	Success      bool     `json:"success"`
+	Message      string   `json:"message"`
+	FileName     string   `json:"file_name"`
+	DeletedFiles []string `json:"deleted_files"`
+	JobCancelled bool     `json:"job_cancelled"`
+}
+
+type JobRendition struct {
+	Name     string `json:"name"`
+	FileName string `json:"file_name"`
+	Status   string `json:"status"` // "succeeded", "failed", "skipped"
+	URL      string `json:"url,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type JobStatus struct {
+	Success    bool           `json:"success"`
+	ID         string         `json:"id"`
+	Type       string         `json:"type"` // "image", "video", "audio"
+	Bucket     string         `json:"bucket"`
+	FileName   string         `json:"file_name"`
+	Status     string         `json:"status"` // "queued", "running", "succeeded", "failed", "cancelled"
+	Error      string         `json:"error,omitempty"`
+	Renditions []JobRendition `json:"renditions,omitempty"`
+	QueuedAt   string         `json:"queued_at"`
+	StartedAt  string         `json:"started_at,omitempty"`
+	FinishedAt string         `json:"finished_at,omitempty"`
+	WaitMs     int64          `json:"wait_ms"`
+	DurationMs int64          `json:"duration_ms,omitempty"`
+}
+
+type APIKeyInfo struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Prefix    string   `json:"prefix"`
+	Scopes    []string `json:"scopes"`
+	CreatedAt string   `json:"created_at"`
+	RevokedAt string   `json:"revoked_at,omitempty"`
+}
+
+type APIKeyResponse struct {
+	Success bool       `json:"success"`
+	Message string     `json:"message"`
+	Key     string     `json:"key,omitempty"` // Only returned once, on creation
+	Data    APIKeyInfo `json:"data"`
+
+	// SigV4 credentials for the S3 endpoint, only returned on creation
+	S3AccessKeyID     string `json:"s3_access_key_id,omitempty"`
+	S3SecretAccessKey string `json:"s3_secret_access_key,omitempty"`
+}
+
+type APIKeyListResponse struct {
+	Success bool         `json:"success"`
+	Keys    []APIKeyInfo `json:"keys"`
+}
+
+type PresignResponse struct {
+	Success   bool   `json:"success"`
+	URL       string `json:"url"`
+	Method    string `json:"method"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+type SignedImageResponse struct {
+	Success bool   `json:"success"`
+	URL     string `json:"url"`
+}
+
+type PresignUploadResponse struct {
+	Success   bool     `json:"success"`
+	URL       string   `json:"url"`
+	Methods   []string `json:"methods"` // POST (multipart "file" field) or PUT (raw body, ?filename=)
+	ExpiresAt string   `json:"expires_at"`
+}
+
+type MultipartUploadResponse struct {
+	Success   bool   `json:"success"`
+	UploadID  string `json:"upload_id"`
+	Bucket    string `json:"bucket"`
+	FileName  string `json:"file_name"` // Original name the object will be stored under
+	PartsURL  string `json:"parts_url"`
+	ExpiresAt string `json:"expires_at"` // Aborted automatically when no part arrives before then
+}
+
+type MultipartPart struct {
+	PartNumber   int    `json:"part_number"`
+	ETag         string `json:"etag"`
+	Size         int64  `json:"size,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+type MultipartPartResponse struct {
+	Success bool `json:"success"`
+	MultipartPart
+}
+
+type MultipartListPartsResponse struct {
+	Success    bool            `json:"success"`
+	UploadID   string          `json:"upload_id"`
+	Parts      []MultipartPart `json:"parts"`
+	Count      int             `json:"count"`
+	HasMore    bool            `json:"has_more"`
+	NextCursor string          `json:"next_cursor,omitempty"` // Part number to pass as ?cursor=
+}
+
+type BucketInfo struct {
+	Name              string           `json:"name"`
+	IsDefault         bool             `json:"is_default"`
+	Visibility        string           `json:"visibility"`              // Default for uploads: "public" or "private"
+	MaxFileSize       int64            `json:"max_file_size"`           // Effective limit in bytes
+	AllowedTypes      []string         `json:"allowed_types,omitempty"` // Empty allows every type
+	DeniedTypes       []string         `json:"denied_types,omitempty"`
+	MaxSizes          map[string]int64 `json:"max_sizes,omitempty"`          // Bytes by type
+	MaxImageWidth     int              `json:"max_image_width,omitempty"`    // Pixels
+	MaxImageHeight    int              `json:"max_image_height,omitempty"`   // Pixels
+	MaxVideoDuration  int64            `json:"max_video_duration,omitempty"` // Seconds
+	ProcessingProfile string           `json:"processing_profile"`           // "full", "thumbnail" or "none"
+	FilesURL          string           `json:"files_url"`
+	CreatedAt         string           `json:"created_at,omitempty"`
+}
+
+type BucketResponse struct {
+	Success bool       `json:"success"`
+	Message string     `json:"message,omitempty"`
+	Data    BucketInfo `json:"data"`
+}
+
+type BucketListResponse struct {
+	Success bool         `json:"success"`
+	Buckets []BucketInfo `json:"buckets"`
+	Count   int          `json:"count"`
 }
 
 type ErrorResponse struct {
 	Success bool   `json:"success"`
 	Message string `json:"message"`
 }
+
+// RuleErrorResponse is returned for uploads breaking an upload rule
+type RuleErrorResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Scope   string `json:"scope"`           // "server" or "bucket"
+	Rule    string `json:"rule"`            // e.g. "max_size" or "max_image_width"
+	Match   string `json:"match,omitempty"` // Type entry of the rule, e.g. "image/*"
+	Limit   int64  `json:"limit,omitempty"`
+	Actual  int64  `json:"actual,omitempty"`
+}
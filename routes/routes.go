@@ -1,23 +1,89 @@
 package routes
 
 import (
+	"object-storage-server/auth"
 	"object-storage-server/handlers"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-func SetupRoutes(app *fiber.App, fileHandler *handlers.FileHandler) {
-	// API routes
+func SetupRoutes(app *fiber.App, authn *auth.Authenticator, fileHandler *handlers.FileHandler, jobHandler *handlers.JobHandler, apiKeyHandler *handlers.APIKeyHandler, tusHandler *handlers.TusHandler, multipartHandler *handlers.MultipartHandler, s3Handler *handlers.S3Handler) {
+	// API routes (API keys are checked by the middleware registered in main.go)
 	api := app.Group("/api")
 
+	read := authn.Require(auth.ScopeRead)
+
 	// File operations
-	api.Post("/upload", fileHandler.UploadFile)
-	api.Get("/files/:filename", fileHandler.DownloadFile)
-	api.Get("/files/view/:filename", fileHandler.ViewFile)
-	api.Get("/files/info/:filename", fileHandler.GetFileInfo)         // Deprecated
-	api.Get("/files/metadata/:filename", fileHandler.GetFileMetadata) // New metadata endpoint
+	api.Post("/upload", fileHandler.UploadFile) // API key or presigned policy, checked by the handler
+	api.Put("/upload", fileHandler.UploadFile)
+	api.Get("/files", read, fileHandler.ListFiles)
+	// Keys may contain slashes; view/, info/ and metadata/ must come before the catch-all
+	api.Get("/files/view/*", fileHandler.ViewFile)                  // Public, private or presigned
+	api.Get("/files/info/*", read, fileHandler.GetFileInfo)         // Deprecated
+	api.Get("/files/metadata/*", read, fileHandler.GetFileMetadata) // New metadata endpoint
+	api.Get("/files/*", fileHandler.DownloadFile)                   // Public, private or presigned
+	api.Delete("/files/*", authn.Require(auth.ScopeDelete), fileHandler.DeleteFile)
+	api.Post("/presign", read, fileHandler.PresignURL)
+	api.Post("/presign/upload", authn.Require(auth.ScopeUpload), fileHandler.PresignUpload)
+
+	// On-the-fly image transforms
+	api.Get("/img/*", fileHandler.TransformImage) // Public or private, optionally signed
+	api.Post("/img/sign", read, fileHandler.SignImageURL)
+
+	// Buckets; "default" is the bucket behind the /api/files routes above
+	buckets := api.Group("/buckets")
+	buckets.Get("", read, fileHandler.ListBuckets)
+	buckets.Post("", authn.Require(auth.ScopeAdmin), fileHandler.CreateBucket)
+	buckets.Get("/:bucket", read, fileHandler.GetBucket)
+	buckets.Patch("/:bucket", authn.Require(auth.ScopeAdmin), fileHandler.UpdateBucket)
+	buckets.Delete("/:bucket", authn.Require(auth.ScopeAdmin), fileHandler.DeleteBucket)
+	buckets.Post("/:bucket/files", fileHandler.UploadBucketFile) // API key or presigned policy, checked by the handler
+	buckets.Put("/:bucket/files", fileHandler.UploadBucketFile)
+	buckets.Get("/:bucket/files", read, fileHandler.ListBucketFiles)
+	buckets.Get("/:bucket/files/*", fileHandler.DownloadBucketFile) // Public, private or presigned
+	buckets.Get("/:bucket/view/*", fileHandler.ViewBucketFile)      // Public, private or presigned
+	buckets.Get("/:bucket/metadata/*", read, fileHandler.GetBucketFileMetadata)
+	buckets.Get("/:bucket/img/*", fileHandler.TransformBucketImage) // Public or private, optionally signed
+	buckets.Delete("/:bucket/files/*", authn.Require(auth.ScopeDelete), fileHandler.DeleteBucketFile)
+
+	// Resumable uploads (tus 1.0)
+	api.Options("/tus", tusHandler.Options)
+	api.Options("/tus/:id", tusHandler.Options)
+	tus := api.Group("/tus", tusHandler.CheckVersion, authn.Require(auth.ScopeUpload))
+	tus.Post("", tusHandler.Create)
+	tus.Head("/:id", tusHandler.Head)
+	tus.Patch("/:id", tusHandler.Patch)
+	tus.Delete("/:id", tusHandler.Terminate)
+
+	// S3-style multipart uploads
+	multipart := api.Group("/multipart", authn.Require(auth.ScopeUpload))
+	multipart.Post("", multipartHandler.Initiate)
+	multipart.Put("/:id/parts/:part", multipartHandler.UploadPart)
+	multipart.Get("/:id/parts", multipartHandler.ListParts)
+	multipart.Post("/:id/complete", multipartHandler.Complete)
+	multipart.Delete("/:id", multipartHandler.Abort)
+
+	// Background processing jobs
+	api.Get("/jobs/:id", read, jobHandler.GetJob)
+
+	// API key management
+	admin := api.Group("/admin", authn.Require(auth.ScopeAdmin))
+	admin.Post("/keys", apiKeyHandler.CreateAPIKey)
+	admin.Get("/keys", apiKeyHandler.ListAPIKeys)
+	admin.Delete("/keys/:id", apiKeyHandler.RevokeAPIKey)
+
+	// S3-compatible API (path-style, SigV4 signed with API key credentials)
+	s3 := app.Group("/s3", s3Handler.Authenticate)
+	s3.Get("/", s3Handler.ListBuckets)
+	s3.Get("/:bucket", s3Handler.ListObjects) // ListObjectsV2, HEAD: HeadBucket
+	s3.Put("/:bucket", s3Handler.CreateBucket)
+	s3.Delete("/:bucket", s3Handler.DeleteBucket)
+	s3.Get("/:bucket/*", s3Handler.GetObject) // GetObject, HEAD: HeadObject
+	s3.Put("/:bucket/*", s3Handler.PutObject)
+	s3.Delete("/:bucket/*", s3Handler.DeleteObject)
+	s3.All("/*", s3Handler.NotImplemented)
 
-	// Health check
+	// Health check (public)
 	api.Get("/health", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{
 			"status":  "ok",
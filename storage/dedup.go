@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"object-storage-server/database"
+)
+
+// BlobPrefix is the key prefix under which DedupDriver stores blobs,
+// as "_blobs/<first two hash digits>/<hash>"
+const BlobPrefix = "_blobs/"
+
+// DedupDriver stores content-addressed blobs in another driver. Every key
+// written through it refers to the blob of its content's SHA-256, so
+// identical uploads are stored once; a blob is removed with its last
+// reference. Objects stored under their own key before deduplication was
+// enabled are still served.
+type DedupDriver struct {
+	inner Driver
+	db    *database.DB
+
+	// Striped by the first hash byte. Held while a blob is created, linked
+	// or removed, so a blob being reused is never removed underneath.
+	locks [256]sync.Mutex
+}
+
+// localDedupDriver is a DedupDriver over a driver keeping objects on the
+// local filesystem, which hands out the paths of blobs for reading
+type localDedupDriver struct {
+	*DedupDriver
+}
+
+// NewDedupDriver wraps inner with content deduplication, keeping the blob
+// references in db
+func NewDedupDriver(inner Driver, db *database.DB) Driver {
+	d := &DedupDriver{inner: inner, db: db}
+	if _, ok := inner.(LocalPather); ok {
+		return &localDedupDriver{d}
+	}
+	return d
+}
+
+// Put streams r into a temporary file while hashing it, then stores it as
+// a new blob or drops it in favour of the existing blob with that hash
+func (d *DedupDriver) Put(key string, r io.Reader) (int64, error) {
+	tmp, err := d.tempFile()
+	if err != nil {
+		return 0, err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(tmp, io.TeeReader(r, hash))
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, d.store(key, tmp.Name(), hex.EncodeToString(hash.Sum(nil)), n)
+}
+
+// Move stores the local file at path under key, hashing it first. It is
+// used by MoveFile.
+func (d *DedupDriver) Move(key, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(hash, f)
+	f.Close()
+	if err != nil {
+		return 0, err
+	}
+	return n, d.store(key, path, hex.EncodeToString(hash.Sum(nil)), n)
+}
+
+// store links key to the blob with the given hash, moving the local file
+// at path into place when the blob does not exist yet and removing it
+// otherwise
+func (d *DedupDriver) store(key, path, hash string, size int64) error {
+	lock := d.lock(hash)
+	lock.Lock()
+	blob, err := d.db.GetBlob(hash)
+	if errors.Is(err, database.ErrNotFound) {
+		blob = &database.BlobRecord{Hash: hash, Key: blobKey(hash), Size: size}
+		_, err = MoveFile(d.inner, blob.Key, path)
+	} else {
+		os.Remove(path)
+	}
+	var orphan string
+	if err == nil {
+		orphan, err = d.db.LinkBlob(key, blob)
+	}
+	lock.Unlock()
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	if orphan != "" {
+		d.removeBlob(orphan)
+	}
+	// A file written under key before deduplication is shadowed now
+	if err := d.inner.Delete(key); err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("Failed to remove %s replaced by a blob: %v", key, err)
+	}
+	return nil
+}
+
+// removeBlob deletes the blob with the given hash unless it has been
+// linked again since it lost its last reference
+func (d *DedupDriver) removeBlob(hash string) {
+	lock := d.lock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	blob, deleted, err := d.db.DeleteBlobIfUnreferenced(hash)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			log.Printf("Failed to remove blob %s: %v", hash, err)
+		}
+		return
+	}
+	if !deleted {
+		return
+	}
+	if err := d.inner.Delete(blob.Key); err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("Failed to remove blob %s: %v", blob.Key, err)
+	}
+}
+
+// Get opens the blob of key, or the file stored under key itself
+func (d *DedupDriver) Get(key string) (io.ReadCloser, error) {
+	target, err := d.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	return d.inner.Get(target)
+}
+
+// GetRange opens a range of the blob of key, or of the file stored under key itself
+func (d *DedupDriver) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	target, err := d.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	return d.inner.GetRange(target, offset, length)
+}
+
+// Stat describes key with the size of its blob and the time it was written
+func (d *DedupDriver) Stat(key string) (*ObjectInfo, error) {
+	ref, err := d.db.GetBlobRef(key)
+	if errors.Is(err, database.ErrNotFound) {
+		return d.inner.Stat(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, Size: ref.Size, ModTime: ref.CreatedAt}, nil
+}
+
+// Delete drops the reference of key and removes its blob when it was the last one
+func (d *DedupDriver) Delete(key string) error {
+	orphan, err := d.db.UnlinkBlob(key)
+	if errors.Is(err, database.ErrNotFound) {
+		return d.inner.Delete(key)
+	}
+	if err != nil {
+		return err
+	}
+	if orphan != "" {
+		d.removeBlob(orphan)
+	}
+	return nil
+}
+
+// List returns the keys referring to blobs together with the files stored
+// under their own key, leaving out the blobs themselves
+func (d *DedupDriver) List(prefix string) ([]ObjectInfo, error) {
+	refs, err := d.db.ListBlobRefs(prefix)
+	if err != nil {
+		return nil, err
+	}
+	files, err := d.inner.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]ObjectInfo, 0, len(refs)+len(files))
+	linked := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		objects = append(objects, ObjectInfo{Key: ref.Key, Size: ref.Size, ModTime: ref.CreatedAt})
+		linked[ref.Key] = true
+	}
+	for _, file := range files {
+		if !linked[file.Key] && !strings.HasPrefix(file.Key, BlobPrefix) {
+			objects = append(objects, file)
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Hash returns the hex SHA-256 of the content stored under key
+func (d *DedupDriver) Hash(key string) (string, error) {
+	ref, err := d.db.GetBlobRef(key)
+	if errors.Is(err, database.ErrNotFound) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return ref.Hash, nil
+}
+
+// Keys returns the keys whose content has the given hash
+func (d *DedupDriver) Keys(hash string) ([]string, error) {
+	return d.db.BlobKeys(hash)
+}
+
+// Link makes dst refer to the blob of src without copying any content
+func (d *DedupDriver) Link(src, dst string) error {
+	ref, err := d.db.GetBlobRef(src)
+	if errors.Is(err, database.ErrNotFound) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	lock := d.lock(ref.Hash)
+	lock.Lock()
+	blob, err := d.db.GetBlob(ref.Hash)
+	var orphan string
+	if err == nil {
+		orphan, err = d.db.LinkBlob(dst, blob)
+	}
+	lock.Unlock()
+	if errors.Is(err, database.ErrNotFound) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if orphan != "" {
+		d.removeBlob(orphan)
+	}
+	if err := d.inner.Delete(dst); err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("Failed to remove %s replaced by a blob: %v", dst, err)
+	}
+	return nil
+}
+
+// resolve returns the key in the wrapped driver holding the content of key
+func (d *DedupDriver) resolve(key string) (string, error) {
+	ref, err := d.db.GetBlobRef(key)
+	if errors.Is(err, database.ErrNotFound) {
+		return key, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return blobKey(ref.Hash), nil
+}
+
+// tempFile creates the file an upload is spooled to while it is hashed,
+// next to the blobs when they live on the local filesystem so that it can
+// be renamed into place
+func (d *DedupDriver) tempFile() (*os.File, error) {
+	if lp, ok := d.inner.(LocalPather); ok {
+		path, err := lp.Path(BlobPrefix + "tmp")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		return os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	}
+	return os.CreateTemp("", "blob-*")
+}
+
+// lock returns the lock guarding blobs with the given hash
+func (d *DedupDriver) lock(hash string) *sync.Mutex {
+	b, _ := hex.DecodeString(hash[:2])
+	return &d.locks[b[0]]
+}
+
+// Path returns the filesystem path of the blob of key, or of the file
+// stored under key itself
+func (d *localDedupDriver) Path(key string) (string, error) {
+	target, err := d.resolve(key)
+	if err != nil {
+		return "", err
+	}
+	return d.inner.(LocalPather).Path(target)
+}
+
+// blobKey returns the storage key of the blob with the given hash
+func blobKey(hash string) string {
+	return BlobPrefix + hash[:2] + "/" + hash
+}
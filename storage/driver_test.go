@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDrivers runs the same conformance suite against every backend.
+// The S3 driver is tested against a MinIO (or other S3-compatible) server
+// when S3_TEST_ENDPOINT is set, e.g.:
+//
+//	docker run -d -p 9000:9000 minio/minio server /data
+//	S3_TEST_ENDPOINT=http://localhost:9000 go test ./storage
+func TestDrivers(t *testing.T) {
+	t.Run("local", func(t *testing.T) {
+		d, err := NewLocalDriver(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		testDriver(t, d)
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		testDriver(t, NewMemoryDriver())
+	})
+
+	t.Run("s3", func(t *testing.T) {
+		endpoint := os.Getenv("S3_TEST_ENDPOINT")
+		if endpoint == "" {
+			t.Skip("S3_TEST_ENDPOINT not set")
+		}
+		d, err := NewS3Driver(S3Config{
+			Endpoint:       endpoint,
+			Region:         envOr("S3_TEST_REGION", "us-east-1"),
+			Bucket:         envOr("S3_TEST_BUCKET", "objects-test"),
+			AccessKey:      envOr("S3_TEST_ACCESS_KEY", "minioadmin"),
+			SecretKey:      envOr("S3_TEST_SECRET_KEY", "minioadmin"),
+			Prefix:         fmt.Sprintf("conformance-%d", time.Now().UnixNano()),
+			ForcePathStyle: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			objects, _ := d.List("")
+			for _, obj := range objects {
+				d.Delete(obj.Key)
+			}
+		})
+		testDriver(t, d)
+	})
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func testDriver(t *testing.T, d Driver) {
+	put := func(key, content string) {
+		t.Helper()
+		n, err := d.Put(key, strings.NewReader(content))
+		if err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+		if n != int64(len(content)) {
+			t.Fatalf("Put(%q) = %d bytes, want %d", key, n, len(content))
+		}
+	}
+	read := func(rc io.ReadCloser, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		if _, err := d.Get("missing.txt"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get: got %v, want ErrNotFound", err)
+		}
+		if _, err := d.GetRange("missing.txt", 0, 1); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetRange: got %v, want ErrNotFound", err)
+		}
+		if _, err := d.Stat("missing.txt"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat: got %v, want ErrNotFound", err)
+		}
+		if err := d.Delete("missing.txt"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Delete: got %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("put and get", func(t *testing.T) {
+		put("docs/hello.txt", "hello world")
+		if got := read(d.Get("docs/hello.txt")); got != "hello world" {
+			t.Errorf("Get = %q", got)
+		}
+		info, err := d.Stat("docs/hello.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Key != "docs/hello.txt" || info.Size != 11 || info.ModTime.IsZero() {
+			t.Errorf("Stat = %+v", info)
+		}
+
+		put("docs/hello.txt", "replaced")
+		if got := read(d.Get("docs/hello.txt")); got != "replaced" {
+			t.Errorf("Get after replace = %q", got)
+		}
+	})
+
+	t.Run("range", func(t *testing.T) {
+		put("range.txt", "0123456789")
+		tests := []struct {
+			offset, length int64
+			want           string
+		}{
+			{0, -1, "0123456789"},
+			{0, 4, "0123"},
+			{3, 4, "3456"},
+			{6, -1, "6789"},
+			{8, 10, "89"},
+			{2, 0, ""},
+		}
+		for _, tt := range tests {
+			if got := read(d.GetRange("range.txt", tt.offset, tt.length)); got != tt.want {
+				t.Errorf("GetRange(%d, %d) = %q, want %q", tt.offset, tt.length, got, tt.want)
+			}
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		put("list/b.txt", "b")
+		put("list/a.txt", "aa")
+		put("list/sub/c.txt", "ccc")
+		put("listing.txt", "x")
+
+		objects, err := d.List("list/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, obj := range objects {
+			keys = append(keys, obj.Key)
+		}
+		want := []string{"list/a.txt", "list/b.txt", "list/sub/c.txt"}
+		if strings.Join(keys, ",") != strings.Join(want, ",") {
+			t.Errorf("List = %v, want %v", keys, want)
+		}
+		if len(objects) == 3 && objects[2].Size != 3 {
+			t.Errorf("List size of %s = %d, want 3", objects[2].Key, objects[2].Size)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		put("delete.txt", "gone")
+		if err := d.Delete("delete.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Stat("delete.txt"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat after Delete: got %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("move file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "upload.tmp")
+		if err := os.WriteFile(path, []byte("moved"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		n, err := MoveFile(d, "moved/file.txt", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 5 {
+			t.Errorf("MoveFile = %d bytes, want 5", n)
+		}
+		if got := read(d.Get("moved/file.txt")); got != "moved" {
+			t.Errorf("Get = %q", got)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("source file still exists: %v", err)
+		}
+	})
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LocalDriver stores objects as plain files below a root directory
+type LocalDriver struct {
+	root string
+}
+
+// NewLocalDriver creates a local disk driver rooted at dir
+func NewLocalDriver(dir string) (*LocalDriver, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	removeStaleTemp(dir)
+	return &LocalDriver{root: dir}, nil
+}
+
+// removeStaleTemp deletes temporary files left behind by writes that were
+// interrupted, e.g. when the previous process was killed mid-upload
+func removeStaleTemp(root string) {
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && strings.HasPrefix(entry.Name(), ".tmp-") {
+			os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// Path returns the filesystem path for key, rejecting keys that escape the root
+func (d *LocalDriver) Path(key string) (string, error) {
+	clean := filepath.Clean("/" + filepath.FromSlash(key))
+	if clean == string(filepath.Separator) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(d.root, clean), nil
+}
+
+// Put writes r to a temporary file and renames it into place,
+// so readers never observe a partially written object
+func (d *LocalDriver) Put(key string, r io.Reader) (int64, error) {
+	path, err := d.Path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+// Get opens the object file
+func (d *LocalDriver) Get(key string) (io.ReadCloser, error) {
+	return d.GetRange(key, 0, -1)
+}
+
+// GetRange opens the object file positioned at offset
+func (d *LocalDriver) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	path, err := d.Path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+// Stat returns file information for the object
+func (d *LocalDriver) Stat(key string) (*ObjectInfo, error) {
+	path, err := d.Path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, ErrNotFound
+	}
+	return &ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// Delete removes the object file
+func (d *LocalDriver) Delete(key string) error {
+	path, err := d.Path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// List walks the root directory and returns objects matching prefix.
+// Hidden files (temporary uploads, .gitkeep) are skipped.
+func (d *LocalDriver) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := filepath.Walk(d.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() && path != d.root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// limitedReadCloser pairs a limited reader with the underlying closer
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
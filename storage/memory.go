@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// MemoryDriver keeps objects in memory. It is intended for tests and
+// ephemeral deployments where nothing needs to survive a restart.
+type MemoryDriver struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+// NewMemoryDriver creates an empty in-memory driver
+func NewMemoryDriver() *MemoryDriver {
+	return &MemoryDriver{objects: make(map[string]memoryObject)}
+}
+
+// Put reads r fully and stores it under key
+func (d *MemoryDriver) Put(key string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	d.mu.Lock()
+	d.objects[key] = memoryObject{data: data, modTime: time.Now()}
+	d.mu.Unlock()
+
+	return int64(len(data)), nil
+}
+
+// Get returns a reader over the whole object
+func (d *MemoryDriver) Get(key string) (io.ReadCloser, error) {
+	return d.GetRange(key, 0, -1)
+}
+
+// GetRange returns a reader over a slice of the object
+func (d *MemoryDriver) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	d.mu.RLock()
+	obj, ok := d.objects[key]
+	d.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	size := int64(len(obj.data))
+	if offset > size {
+		offset = size
+	}
+	end := size
+	if length >= 0 && offset+length < size {
+		end = offset + length
+	}
+	return io.NopCloser(bytes.NewReader(obj.data[offset:end])), nil
+}
+
+// Stat returns the object size and modification time
+func (d *MemoryDriver) Stat(key string) (*ObjectInfo, error) {
+	d.mu.RLock()
+	obj, ok := d.objects[key]
+	d.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &ObjectInfo{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+// Delete removes the object
+func (d *MemoryDriver) Delete(key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.objects[key]; !ok {
+		return ErrNotFound
+	}
+	delete(d.objects, key)
+	return nil
+}
+
+// List returns objects whose key starts with prefix
+func (d *MemoryDriver) List(prefix string) ([]ObjectInfo, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	objects := make([]ObjectInfo, 0, len(d.objects))
+	for key, obj := range d.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime})
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
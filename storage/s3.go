@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Config holds the connection settings for an S3-compatible backend
+type S3Config struct {
+	Endpoint       string // Empty for AWS, e.g. "http://localhost:9000" for MinIO
+	Region         string
+	Bucket         string
+	AccessKey      string
+	SecretKey      string
+	Prefix         string // Optional key prefix inside the bucket
+	ForcePathStyle bool   // Required by MinIO and most self-hosted S3 servers
+}
+
+// S3Driver stores objects in an S3-compatible bucket
+type S3Driver struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+	prefix   string
+}
+
+// NewS3Driver connects to the bucket described by cfg, creating it if it does not exist
+func NewS3Driver(cfg S3Config) (*S3Driver, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 bucket is required")
+	}
+
+	awsCfg := aws.NewConfig().
+		WithRegion(cfg.Region).
+		WithS3ForcePathStyle(cfg.ForcePathStyle)
+	if cfg.Endpoint != "" {
+		awsCfg = awsCfg.WithEndpoint(cfg.Endpoint)
+	}
+	if cfg.AccessKey != "" {
+		awsCfg = awsCfg.WithCredentials(credentials.NewStaticCredentials(cfg.AccessKey, cfg.SecretKey, ""))
+	}
+
+	sess, err := session.NewSession(awsCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 session: %w", err)
+	}
+
+	d := &S3Driver{
+		client:   s3.New(sess),
+		uploader: s3manager.NewUploader(sess),
+		bucket:   cfg.Bucket,
+		prefix:   strings.Trim(cfg.Prefix, "/"),
+	}
+	if d.prefix != "" {
+		d.prefix += "/"
+	}
+
+	if err := d.ensureBucket(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ensureBucket creates the bucket when it is missing
+func (d *S3Driver) ensureBucket() error {
+	_, err := d.client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(d.bucket)})
+	if err == nil {
+		return nil
+	}
+	if !isS3NotFound(err) {
+		return fmt.Errorf("failed to access s3 bucket %q: %w", d.bucket, err)
+	}
+
+	if _, err := d.client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(d.bucket)}); err != nil {
+		return fmt.Errorf("failed to create s3 bucket %q: %w", d.bucket, err)
+	}
+	return nil
+}
+
+// Put uploads r under key. Large bodies are sent as S3 multipart uploads.
+func (d *S3Driver) Put(key string, r io.Reader) (int64, error) {
+	counter := &countingReader{r: r}
+	_, err := d.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(d.prefix + key),
+		Body:   counter,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+// Get downloads the whole object
+func (d *S3Driver) Get(key string) (io.ReadCloser, error) {
+	return d.GetRange(key, 0, -1)
+}
+
+// GetRange downloads part of the object using an HTTP Range request
+func (d *S3Driver) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(d.prefix + key),
+	}
+	if length == 0 {
+		// S3 has no way to express an empty range
+		if _, err := d.Stat(key); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if offset > 0 || length > 0 {
+		if length > 0 {
+			input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+		} else {
+			input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+		}
+	}
+
+	out, err := d.client.GetObject(input)
+	if err != nil {
+		return nil, mapS3Error(err)
+	}
+	return out.Body, nil
+}
+
+// Stat issues a HEAD request for the object
+func (d *S3Driver) Stat(key string) (*ObjectInfo, error) {
+	out, err := d.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(d.prefix + key),
+	})
+	if err != nil {
+		return nil, mapS3Error(err)
+	}
+	return &ObjectInfo{
+		Key:     key,
+		Size:    aws.Int64Value(out.ContentLength),
+		ModTime: aws.TimeValue(out.LastModified),
+	}, nil
+}
+
+// Delete removes the object. S3 deletes are idempotent, so the object
+// is checked first to report ErrNotFound like the other drivers.
+func (d *S3Driver) Delete(key string) error {
+	if _, err := d.Stat(key); err != nil {
+		return err
+	}
+	_, err := d.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(d.prefix + key),
+	})
+	return mapS3Error(err)
+}
+
+// List pages through ListObjectsV2 for the given prefix
+func (d *S3Driver) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := d.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(d.bucket),
+		Prefix: aws.String(d.prefix + prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:     strings.TrimPrefix(aws.StringValue(obj.Key), d.prefix),
+				Size:    aws.Int64Value(obj.Size),
+				ModTime: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, mapS3Error(err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// isS3NotFound reports whether err is a 404 from the S3 API
+func isS3NotFound(err error) bool {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	var aErr awserr.Error
+	if errors.As(err, &aErr) {
+		switch aErr.Code() {
+		case s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchBucket, "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+// mapS3Error converts S3 not-found errors into ErrNotFound
+func mapS3Error(err error) error {
+	if err != nil && isS3NotFound(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// countingReader counts bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"object-storage-server/config"
+)
+
+// ErrNotFound is returned when an object does not exist in the store
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Driver is the interface every storage backend implements.
+// Keys are slash-separated object names relative to the store root.
+type Driver interface {
+	// Put stores the content of r under key, replacing any existing object
+	Put(key string, r io.Reader) (int64, error)
+	// Get opens the whole object for reading
+	Get(key string) (io.ReadCloser, error)
+	// GetRange opens length bytes of the object starting at offset.
+	// A negative length reads until the end of the object.
+	GetRange(key string, offset, length int64) (io.ReadCloser, error)
+	// Stat returns information about the object
+	Stat(key string) (*ObjectInfo, error)
+	// Delete removes the object. Deleting a missing object returns ErrNotFound.
+	Delete(key string) error
+	// List returns all objects whose key starts with prefix, sorted by key
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+// LocalPather is implemented by drivers that keep objects on the local
+// filesystem and can hand out a direct path to them
+type LocalPather interface {
+	Path(key string) (string, error)
+}
+
+// Mover is implemented by drivers that take over local files themselves
+// instead of having MoveFile upload or rename them
+type Mover interface {
+	Move(key, path string) (int64, error)
+}
+
+// Deduplicator is implemented by drivers that store each distinct content
+// once and let keys share it
+type Deduplicator interface {
+	// Hash returns the hex SHA-256 of the content stored under key
+	Hash(key string) (string, error)
+	// Keys returns the keys whose content has the given hash
+	Keys(hash string) ([]string, error)
+	// Link makes dst refer to the content of src without copying it
+	Link(src, dst string) error
+}
+
+// LocalCopy returns a filesystem path holding the content of key.
+// Drivers implementing LocalPather return their own path; for other drivers
+// the object is copied into a temporary file. The returned cleanup function
+// must always be called once the path is no longer needed.
+func LocalCopy(d Driver, key string) (string, func(), error) {
+	if lp, ok := d.(LocalPather); ok {
+		path, err := lp.Path(key)
+		if err != nil {
+			return "", func() {}, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				return "", func() {}, ErrNotFound
+			}
+			return "", func() {}, err
+		}
+		return path, func() {}, nil
+	}
+
+	src, err := d.Get(key)
+	if err != nil {
+		return "", func() {}, err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp("", "object-*"+filepath.Ext(key))
+	if err != nil {
+		return "", func() {}, err
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		cleanup()
+		return "", func() {}, err
+	}
+	if err := tmp.Close(); err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+
+	return tmp.Name(), cleanup, nil
+}
+
+// PutFile uploads the local file at path to the store under key
+func PutFile(d Driver, key, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return d.Put(key, f)
+}
+
+// MoveFile stores the local file at path under key and removes the file.
+// The local driver renames it into place, which avoids copying large files
+// when path is on the same filesystem; drivers implementing Mover handle
+// it themselves and others upload and delete it.
+func MoveFile(d Driver, key, path string) (int64, error) {
+	if m, ok := d.(Mover); ok {
+		return m.Move(key, path)
+	}
+	if lp, ok := d.(LocalPather); ok {
+		target, err := lp.Path(key)
+		if err != nil {
+			return 0, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return 0, err
+		}
+		if err := os.Rename(path, target); err == nil {
+			return info.Size(), nil
+		}
+		// Different filesystems, fall back to copying
+	}
+
+	n, err := PutFile(d, key, path)
+	if err != nil {
+		return 0, err
+	}
+	os.Remove(path)
+	return n, nil
+}
+
+// New creates the storage driver selected in the configuration
+func New(cfg *config.Config) (Driver, error) {
+	switch cfg.StorageDriver {
+	case "", "local":
+		return NewLocalDriver(cfg.UploadDir)
+	case "memory":
+		return NewMemoryDriver(), nil
+	case "s3":
+		return NewS3Driver(S3Config{
+			Endpoint:       cfg.S3Endpoint,
+			Region:         cfg.S3Region,
+			Bucket:         cfg.S3Bucket,
+			AccessKey:      cfg.S3AccessKey,
+			SecretKey:      cfg.S3SecretKey,
+			Prefix:         cfg.S3Prefix,
+			ForcePathStyle: cfg.S3ForcePathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", cfg.StorageDriver)
+	}
+}
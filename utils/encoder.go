@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// VariantFormats are the formats image renditions may additionally be
+// stored in, in the order ViewFile prefers them
+var VariantFormats = []string{"avif", "webp"}
+
+// ffmpegImageEncoders lists the ffmpeg encoders usable for the formats Go
+// cannot encode itself, in order of preference
+var ffmpegImageEncoders = map[string][]string{
+	"webp": {"libwebp"},
+	"avif": {"libaom-av1", "libsvtav1"},
+}
+
+var (
+	encodersOnce sync.Once
+	encoders     map[string]string // Format to the ffmpeg encoder found for it
+)
+
+// renditionFormats are the variant formats ResizeImage produces, see SetRenditionFormats
+var renditionFormats []string
+
+// SetRenditionFormats selects the variant formats ResizeImage stores next
+// to each image rendition. Unknown formats are ignored.
+func SetRenditionFormats(formats []string) {
+	renditionFormats = nil
+	for _, format := range formats {
+		if isVariantFormat(format) {
+			renditionFormats = append(renditionFormats, format)
+		}
+	}
+}
+
+// RenditionFormats returns the variant formats ResizeImage produces
+func RenditionFormats() []string {
+	return renditionFormats
+}
+
+// isVariantFormat reports whether format is one of VariantFormats
+func isVariantFormat(format string) bool {
+	for _, f := range VariantFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// VariantName returns the name of the variant of the rendition filename
+// in format, e.g. "photo_small.jpg.webp". Keeping the rendition's
+// extension avoids clashing with the renditions of "photo.webp".
+func VariantName(filename, format string) string {
+	return filename + "." + format
+}
+
+// CanEncodeImage reports whether images can be encoded in format ("jpg",
+// "png", "gif", "webp" or "avif"). WebP and AVIF need ffmpeg built with
+// libwebp and libaom or SVT-AV1 respectively.
+func CanEncodeImage(format string) bool {
+	switch format {
+	case "jpg", "png", "gif":
+		return true
+	}
+	return imageEncoder(format) != ""
+}
+
+// imageEncoder returns the ffmpeg encoder available for format, "" when
+// ffmpeg or a suitable encoder is missing. Encoders are looked up once.
+func imageEncoder(format string) string {
+	encodersOnce.Do(func() {
+		encoders = make(map[string]string)
+		if !CheckFFmpegInstalled() {
+			return
+		}
+		output, err := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+		if err != nil {
+			return
+		}
+
+		// Lines look like " V....D libwebp   libwebp WebP image (codec webp)"
+		available := make(map[string]bool)
+		for _, line := range strings.Split(string(output), "\n") {
+			if fields := strings.Fields(line); len(fields) >= 2 {
+				available[fields[1]] = true
+			}
+		}
+		for f, candidates := range ffmpegImageEncoders {
+			for _, encoder := range candidates {
+				if available[encoder] {
+					encoders[f] = encoder
+					break
+				}
+			}
+		}
+	})
+	return encoders[format]
+}
+
+// encodeWithFFmpeg encodes img as WebP or AVIF. AVIF output has no alpha
+// channel.
+func encodeWithFFmpeg(img image.Image, out io.Writer, format string, quality int) error {
+	encoder := imageEncoder(format)
+	if encoder == "" {
+		return fmt.Errorf("%s encoding needs ffmpeg with %s", format, strings.Join(ffmpegImageEncoders[format], " or "))
+	}
+
+	tmpDir, err := os.MkdirTemp("", "encode-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	inputPath := filepath.Join(tmpDir, "input.png")
+	input, err := os.Create(inputPath)
+	if err != nil {
+		return err
+	}
+	err = (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(input, img)
+	if closeErr := input.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	args := ffmpeg.KwArgs{"c:v": encoder, "frames:v": 1}
+	switch encoder {
+	case "libwebp":
+		args["quality"] = quality
+	case "libaom-av1":
+		args["crf"] = avifCRF(quality)
+		args["still-picture"] = 1
+		args["cpu-used"] = 6
+		args["pix_fmt"] = "yuv420p"
+	case "libsvtav1":
+		args["crf"] = avifCRF(quality)
+		args["preset"] = 8
+		args["pix_fmt"] = "yuv420p"
+	}
+
+	outputPath := filepath.Join(tmpDir, "output."+format)
+	if err := runFFmpeg(context.Background(), ffmpeg.Input(inputPath).Output(outputPath, args)); err != nil {
+		return fmt.Errorf("ffmpeg failed to encode %s: %w", format, err)
+	}
+
+	output, err := os.Open(outputPath)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	_, err = io.Copy(out, output)
+	return err
+}
+
+// avifCRF maps a 1-100 quality to the 0-63 quantizer of the AV1 encoders,
+// the way libavif does
+func avifCRF(quality int) int {
+	return ((100-quality)*63 + 50) / 100
+}
+
+// isOpaque reports whether img has no transparent pixels
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return true
+}
@@ -0,0 +1,635 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"object-storage-server/database"
+	"object-storage-server/storage"
+
+	"github.com/disintegration/imaging"
+)
+
+// EXIF tags read by parseEXIF
+const (
+	tagMake               = 0x010F
+	tagModel              = 0x0110
+	tagOrientation        = 0x0112
+	tagExifIFD            = 0x8769
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+)
+
+// maxMetadataChunk bounds the PNG and WebP chunks read into memory while
+// looking for EXIF, so a corrupt length cannot exhaust memory
+const maxMetadataChunk = 16 << 20
+
+var errInvalidEXIF = errors.New("invalid EXIF data")
+
+// exifFields are the EXIF fields kept in object metadata
+type exifFields struct {
+	Make               string
+	Model              string
+	Orientation        int
+	DateTimeOriginal   string
+	OffsetTimeOriginal string
+}
+
+// ReadImageInfo returns the dimensions and EXIF fields of the image stored
+// under key. Images without EXIF only get their dimensions.
+func ReadImageInfo(store storage.Driver, key string) (*database.ImageInfo, error) {
+	width, height, err := ImageDimensions(store, key)
+	if err != nil {
+		return nil, err
+	}
+	info := &database.ImageInfo{Width: width, Height: height}
+
+	src, err := store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	payload, err := readEXIF(bufio.NewReader(src), imageContainer(key))
+	if err != nil || payload == nil {
+		// Broken EXIF does not make the image unusable
+		return info, nil
+	}
+	fields, err := parseEXIF(payload)
+	if err != nil {
+		return info, nil
+	}
+
+	if fields.Orientation >= 1 && fields.Orientation <= 8 {
+		info.Orientation = fields.Orientation
+		if fields.Orientation >= 5 {
+			// Rotated by 90 degrees, the displayed image is transposed
+			info.Width, info.Height = height, width
+		}
+	}
+	info.Camera = fields.Make
+	if fields.Model != "" {
+		if strings.HasPrefix(fields.Model, fields.Make) {
+			// Many cameras repeat the make, e.g. "Canon" "Canon EOS R5"
+			info.Camera = fields.Model
+		} else {
+			info.Camera = strings.TrimSpace(fields.Make + " " + fields.Model)
+		}
+	}
+	info.TakenAt = exifTime(fields.DateTimeOriginal, fields.OffsetTimeOriginal)
+	return info, nil
+}
+
+// StripStoredImageMetadata removes the metadata of the image stored under
+// key, see StripImageMetadata, and stores the result in its place. It
+// returns the size of the stored image and whether it changed.
+func StripStoredImageMetadata(store storage.Driver, key string) (int64, bool, error) {
+	src, err := store.Get(key)
+	if err != nil {
+		return 0, false, err
+	}
+	data, err := io.ReadAll(src)
+	src.Close()
+	if err != nil {
+		return 0, false, err
+	}
+
+	stripped, err := StripImageMetadata(data, imageContainer(key))
+	if err != nil {
+		return int64(len(data)), false, err
+	}
+	if bytes.Equal(stripped, data) {
+		return int64(len(data)), false, nil
+	}
+	if _, err := store.Put(key, bytes.NewReader(stripped)); err != nil {
+		return 0, false, err
+	}
+	return int64(len(stripped)), true, nil
+}
+
+// StripImageMetadata removes EXIF, XMP, IPTC, comments and text chunks
+// from a "jpeg", "png" or "webp" image, keeping the ICC colour profile.
+// The EXIF orientation of JPEG and PNG images is kept in a minimal EXIF
+// block, so they are still displayed upright. Other formats are returned
+// unchanged.
+func StripImageMetadata(data []byte, container string) ([]byte, error) {
+	switch container {
+	case "jpeg":
+		return stripJPEG(data)
+	case "png":
+		return stripPNG(data)
+	case "webp":
+		return stripWebP(data)
+	}
+	return data, nil
+}
+
+// imageContainer returns the container format of an image file name:
+// "jpeg", "png", "gif" or "webp"
+func imageContainer(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".png":
+		return "png"
+	case ".gif":
+		return "gif"
+	case ".webp":
+		return "webp"
+	}
+	return ""
+}
+
+// readEXIF returns the EXIF payload (a TIFF structure) of an image in
+// container format, nil when it has none
+func readEXIF(r *bufio.Reader, container string) ([]byte, error) {
+	switch container {
+	case "jpeg":
+		return readJPEGEXIF(r)
+	case "png":
+		return readPNGEXIF(r)
+	case "webp":
+		return readWebPEXIF(r)
+	}
+	return nil, nil
+}
+
+// readJPEGEXIF scans the segments before the image data for an APP1 Exif segment
+func readJPEGEXIF(r *bufio.Reader) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil, errors.New("not a JPEG image")
+	}
+	for {
+		marker, err := nextJPEGMarker(r)
+		if err != nil {
+			return nil, err
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan or end of image, no EXIF before the image data
+			return nil, nil
+		}
+		if standaloneJPEGMarker(marker) {
+			continue
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, err
+		}
+		n := int(binary.BigEndian.Uint16(length[:])) - 2
+		if n < 0 {
+			return nil, errors.New("invalid JPEG segment length")
+		}
+		if marker != 0xE1 {
+			if _, err := r.Discard(n); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		segment := make([]byte, n)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, err
+		}
+		if payload, ok := bytes.CutPrefix(segment, []byte("Exif\x00\x00")); ok {
+			return payload, nil
+		}
+	}
+}
+
+// nextJPEGMarker reads the next marker, skipping fill bytes
+func nextJPEGMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, errors.New("invalid JPEG marker")
+	}
+	for b == 0xFF {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// standaloneJPEGMarker reports whether a marker has no length and payload
+func standaloneJPEGMarker(marker byte) bool {
+	return marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7)
+}
+
+// readPNGEXIF scans the chunks before the image data for an eXIf chunk
+func readPNGEXIF(r *bufio.Reader) ([]byte, error) {
+	var signature [8]byte
+	if _, err := io.ReadFull(r, signature[:]); err != nil || string(signature[:]) != "\x89PNG\r\n\x1a\n" {
+		return nil, errors.New("not a PNG image")
+	}
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		switch string(header[4:]) {
+		case "IDAT", "IEND":
+			return nil, nil
+		case "eXIf":
+			if length > maxMetadataChunk {
+				return nil, errInvalidEXIF
+			}
+			payload := make([]byte, length)
+			_, err := io.ReadFull(r, payload)
+			return payload, err
+		}
+		// Chunk data and CRC
+		if _, err := r.Discard(int(length) + 4); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readWebPEXIF scans the chunks of a WebP image for an EXIF chunk, which
+// follows the image data
+func readWebPEXIF(r *bufio.Reader) ([]byte, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WEBP" {
+		return nil, errors.New("not a WebP image")
+	}
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			if err == io.EOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+		size := binary.LittleEndian.Uint32(chunk[4:])
+		padded := int(size) + int(size&1)
+		if string(chunk[:4]) != "EXIF" {
+			if _, err := r.Discard(padded); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if size > maxMetadataChunk {
+			return nil, errInvalidEXIF
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		// Some writers keep the JPEG APP1 prefix
+		payload, _ = bytes.CutPrefix(payload, []byte("Exif\x00\x00"))
+		return payload, nil
+	}
+}
+
+// parseEXIF reads the fields kept in object metadata from an EXIF payload
+func parseEXIF(tiff []byte) (*exifFields, error) {
+	if len(tiff) < 8 {
+		return nil, errInvalidEXIF
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errInvalidEXIF
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return nil, errInvalidEXIF
+	}
+
+	fields := &exifFields{}
+	var exifIFD uint32
+	err := readIFD(tiff, order, order.Uint32(tiff[4:]), func(tag uint16, value []byte) {
+		switch tag {
+		case tagMake:
+			fields.Make = exifString(value)
+		case tagModel:
+			fields.Model = exifString(value)
+		case tagOrientation:
+			if len(value) >= 2 {
+				fields.Orientation = int(order.Uint16(value))
+			}
+		case tagExifIFD:
+			if len(value) >= 4 {
+				exifIFD = order.Uint32(value)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if exifIFD != 0 {
+		// The capture time lives in the Exif sub-IFD; a broken one keeps the IFD0 fields
+		readIFD(tiff, order, exifIFD, func(tag uint16, value []byte) {
+			switch tag {
+			case tagDateTimeOriginal:
+				fields.DateTimeOriginal = exifString(value)
+			case tagOffsetTimeOriginal:
+				fields.OffsetTimeOriginal = exifString(value)
+			}
+		})
+	}
+	return fields, nil
+}
+
+// readIFD calls fn with the tag and raw value of every entry of the IFD at
+// offset. Entries of unknown types or pointing outside tiff are skipped.
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32, fn func(tag uint16, value []byte)) error {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return errInvalidEXIF
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	entries := tiff[offset+2:]
+	if len(entries) < count*12 {
+		return errInvalidEXIF
+	}
+
+	// Bytes per value of the TIFF field types
+	typeSizes := map[uint16]uint64{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+	for i := 0; i < count; i++ {
+		entry := entries[i*12 : i*12+12]
+		typeSize, ok := typeSizes[order.Uint16(entry[2:])]
+		if !ok {
+			continue
+		}
+		size := typeSize * uint64(order.Uint32(entry[4:]))
+		if size <= 4 {
+			fn(order.Uint16(entry), entry[8:8+size])
+			continue
+		}
+		start := uint64(order.Uint32(entry[8:]))
+		if start+size > uint64(len(tiff)) {
+			continue
+		}
+		fn(order.Uint16(entry), tiff[start:start+size])
+	}
+	return nil
+}
+
+// exifString returns an ASCII value without its terminating NUL and padding
+func exifString(value []byte) string {
+	return strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+}
+
+// exifTime formats an EXIF date such as "2024:05:01 10:20:30" as RFC 3339,
+// with the zone of offset ("+07:00") when the camera recorded one
+func exifTime(value, offset string) string {
+	t, err := time.Parse("2006:01:02 15:04:05", value)
+	if err != nil || t.Year() < 1900 {
+		return ""
+	}
+	if zone, err := time.Parse("-07:00", offset); err == nil {
+		_, seconds := zone.Zone()
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.FixedZone("", seconds))
+		return t.Format(time.RFC3339)
+	}
+	return t.Format("2006-01-02T15:04:05")
+}
+
+// orientationEXIF returns an EXIF payload holding only orientation
+func orientationEXIF(orientation int) []byte {
+	payload := make([]byte, 26)
+	copy(payload, "MM\x00\x2a\x00\x00\x00\x08") // Big endian TIFF, IFD0 at offset 8
+	binary.BigEndian.PutUint16(payload[8:], 1)  // One entry
+	binary.BigEndian.PutUint16(payload[10:], tagOrientation)
+	binary.BigEndian.PutUint16(payload[12:], 3) // SHORT
+	binary.BigEndian.PutUint32(payload[14:], 1) // One value
+	binary.BigEndian.PutUint16(payload[18:], uint16(orientation))
+	// Bytes 22-25: no next IFD
+	return payload
+}
+
+// exifOrientation returns the orientation recorded in an EXIF payload, 1
+// when it has none
+func exifOrientation(payload []byte) int {
+	if payload == nil {
+		return 1
+	}
+	fields, err := parseEXIF(payload)
+	if err != nil || fields.Orientation < 1 || fields.Orientation > 8 {
+		return 1
+	}
+	return fields.Orientation
+}
+
+// stripJPEG keeps the segments needed to decode and colour manage a JPEG:
+// everything but application segments, JFIF (APP0), the ICC profile (APP2)
+// and Adobe colour transform (APP14)
+func stripJPEG(data []byte) ([]byte, error) {
+	payload, err := readJPEGEXIF(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	orientation := exifOrientation(payload)
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	pos := 2
+	orientationWritten := orientation == 1
+	for {
+		start := pos
+		for pos < len(data) && data[pos] == 0xFF {
+			pos++
+		}
+		if pos >= len(data) || pos == start {
+			return nil, errors.New("invalid JPEG marker")
+		}
+		marker := data[pos]
+		pos++
+		if marker == 0xDA {
+			if !orientationWritten {
+				writeJPEGOrientation(out, orientation)
+			}
+			// Image data and everything after it is kept as is
+			out.WriteByte(0xFF)
+			out.Write(data[pos-1:])
+			return out.Bytes(), nil
+		}
+		if standaloneJPEGMarker(marker) {
+			out.Write([]byte{0xFF, marker})
+			continue
+		}
+		if pos+2 > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		end := pos + int(binary.BigEndian.Uint16(data[pos:]))
+		if end > len(data) || end < pos+2 {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		segment := data[pos+2 : end]
+		pos = end
+
+		keep := true
+		switch {
+		case marker == 0xFE:
+			// Comment
+			keep = false
+		case marker == 0xE2:
+			keep = bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00"))
+		case marker >= 0xE1 && marker <= 0xEF:
+			keep = marker == 0xEE
+		}
+		if !orientationWritten && marker != 0xE0 {
+			// After JFIF, which must come first
+			writeJPEGOrientation(out, orientation)
+			orientationWritten = true
+		}
+		if keep {
+			out.Write([]byte{0xFF, marker})
+			out.Write(data[pos-len(segment)-2 : pos])
+		}
+	}
+}
+
+// writeJPEGOrientation writes an APP1 segment holding only orientation
+func writeJPEGOrientation(out *bytes.Buffer, orientation int) {
+	payload := append([]byte("Exif\x00\x00"), orientationEXIF(orientation)...)
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(out, binary.BigEndian, uint16(len(payload)+2))
+	out.Write(payload)
+}
+
+// stripPNG drops the eXIf, text and time chunks of a PNG. Colour chunks
+// (iCCP, sRGB, gAMA, cHRM) are kept.
+func stripPNG(data []byte) ([]byte, error) {
+	payload, err := readPNGEXIF(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	orientation := exifOrientation(payload)
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:8])
+	for pos := 8; pos < len(data); {
+		if pos+12 > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		end := pos + 12 + int(binary.BigEndian.Uint32(data[pos:]))
+		if end > len(data) || end < pos+12 {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		switch chunkType {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out.Write(data[pos:end])
+		}
+		if chunkType == "IHDR" && orientation != 1 {
+			writePNGChunk(out, "eXIf", orientationEXIF(orientation))
+		}
+		pos = end
+	}
+	return out.Bytes(), nil
+}
+
+// writePNGChunk writes a chunk with its length and CRC
+func writePNGChunk(out *bytes.Buffer, chunkType string, payload []byte) {
+	binary.Write(out, binary.BigEndian, uint32(len(payload)))
+	out.WriteString(chunkType)
+	out.Write(payload)
+	binary.Write(out, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(chunkType), payload...)))
+}
+
+// stripWebP drops the EXIF and XMP chunks of a WebP and clears their flags
+// in the VP8X header. WebP decoders ignore EXIF orientation, so none is kept.
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP image")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+	for pos := 12; pos < len(data); {
+		if pos+8 > len(data) {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size + size&1
+		if end > len(data) || end < pos+8 {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		switch string(data[pos : pos+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := bytes.Clone(data[pos:end])
+			if len(chunk) > 8 {
+				// Flags: 0x08 EXIF, 0x04 XMP
+				chunk[8] &^= 0x08 | 0x04
+			}
+			out.Write(chunk)
+		default:
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:], uint32(len(stripped)-8))
+	return stripped, nil
+}
+
+// DecodeStoredImage decodes the image stored under key, rotated and
+// flipped as the EXIF orientation of JPEG and PNG images asks. WebP
+// orientation is ignored, as browsers display WebP images unrotated.
+func DecodeStoredImage(store storage.Driver, key string) (image.Image, error) {
+	src, err := store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	img, err := imaging.Decode(src)
+	src.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	container := imageContainer(key)
+	if container != "jpeg" && container != "png" {
+		return img, nil
+	}
+	src, err = store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	payload, err := readEXIF(bufio.NewReader(src), container)
+	if err != nil {
+		return img, nil
+	}
+	return orient(img, exifOrientation(payload)), nil
+}
+
+// orient applies an EXIF orientation to img
+func orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
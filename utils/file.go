@@ -1,19 +1,28 @@
 package utils
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image"
-	"image/gif"
-	"image/jpeg"
-	"image/png"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"object-storage-server/database"
+	"object-storage-server/storage"
 
 	"github.com/disintegration/imaging"
 	"github.com/google/uuid"
 	ffmpeg "github.com/u2takey/ffmpeg-go"
+	_ "golang.org/x/image/webp" // Decoding .webp uploads
 )
 
 // GenerateUniqueFileName generates a unique filename using UUID v7
@@ -23,6 +32,103 @@ func GenerateUniqueFileName(originalName string) string {
 	return fmt.Sprintf("%s%s", uuidV7.String(), ext)
 }
 
+// MaxObjectKeyLength is the longest object key a client may choose, in bytes
+const MaxObjectKeyLength = 1024
+
+// ValidateObjectKey checks that a client chosen object key such as
+// "avatars/user42/profile.png" is a safe relative path: slash separated
+// segments that are neither empty nor start with "." (which also rules out
+// "." and ".."), without backslashes or control characters
+func ValidateObjectKey(key string) error {
+	if key == "" {
+		return errors.New("key is empty")
+	}
+	if len(key) > MaxObjectKeyLength {
+		return fmt.Errorf("key is longer than %d bytes", MaxObjectKeyLength)
+	}
+	if !utf8.ValidString(key) {
+		return errors.New("key is not valid UTF-8")
+	}
+	for _, r := range key {
+		if r == '\\' || unicode.IsControl(r) {
+			return errors.New("key may not contain backslashes or control characters")
+		}
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" {
+			return errors.New("key may not start or end with \"/\" or contain \"//\"")
+		}
+		if strings.HasPrefix(segment, ".") {
+			return errors.New("key segments may not start with \".\"")
+		}
+		if len(segment) > 255 {
+			return errors.New("key segments may not be longer than 255 bytes")
+		}
+	}
+	return nil
+}
+
+// ParseUploadTime extracts the creation time embedded in a UUID v7 filename.
+// Rendition names such as "<uuid>_small.jpg" resolve to their original's time
+// and key prefixes such as "avatars-<uuid>.jpg" are skipped.
+func ParseUploadTime(filename string) (time.Time, bool) {
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	if i := strings.Index(name, "_"); i >= 0 {
+		name = name[:i]
+	}
+	if len(name) > 36 {
+		name = name[len(name)-36:]
+	}
+
+	id, err := uuid.Parse(name)
+	if err != nil || id.Version() != 7 {
+		return time.Time{}, false
+	}
+	sec, nsec := id.Time().UnixTime()
+	return time.Unix(sec, nsec), true
+}
+
+// GetFileType returns "image", "video", "audio" or "other" for filename
+func GetFileType(filename string) string {
+	if IsImage(filename) {
+		return "image"
+	} else if IsVideo(filename) {
+		return "video"
+	} else if IsAudio(filename) {
+		return "audio"
+	}
+	return "other"
+}
+
+// IsDerivative reports whether filename looks like a rendition generated
+// by the processors rather than an uploaded original
+func IsDerivative(filename string) bool {
+	_, ok := DerivativeStem(filename)
+	return ok
+}
+
+// DerivativeStem returns the name of the original a rendition was generated
+// from, without directory and extension (renditions may use a different
+// extension than their original, e.g. video thumbnails). Variants of image
+// renditions such as "photo_small.jpg.webp" count as renditions too.
+func DerivativeStem(filename string) (string, bool) {
+	ext := filepath.Ext(filename)
+	name := strings.TrimSuffix(filepath.Base(filename), ext)
+	if isVariantFormat(strings.ToLower(strings.TrimPrefix(ext, "."))) && IsImage(name) {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	i := strings.LastIndex(name, "_")
+	if i < 0 {
+		return "", false
+	}
+
+	switch name[i+1:] {
+	case "thumbnail", "small", "medium", "large", "360p", "480p", "720p", "1080p", "low", "high":
+		return name[:i], true
+	}
+	return "", false
+}
+
 // IsImage checks if file is an image based on extension
 func IsImage(filename string) bool {
 	ext := strings.ToLower(filepath.Ext(filename))
@@ -59,16 +165,138 @@ func IsAudio(filename string) bool {
 	return false
 }
 
+// ImageDimensions returns the pixel size of the image stored under key,
+// reading only its header
+func ImageDimensions(store storage.Driver, key string) (int, int, error) {
+	src, err := store.Get(key)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer src.Close()
+
+	cfg, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// LocalImageDimensions returns the width and height of the image file at
+// path, reading only its header
+func LocalImageDimensions(path string) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// Rendition describes a derived file generated from an original upload
+type Rendition struct {
+	Name     string // e.g. "thumbnail", "720p", "high"
+	FileName string
+}
+
+// GetRenditions returns every rendition the processors may produce for filename.
+// The files only exist once processing has finished.
+func GetRenditions(filename string) []Rendition {
+	ext := filepath.Ext(filename)
+	nameWithoutExt := strings.TrimSuffix(filename, ext)
+
+	var renditions []Rendition
+	switch {
+	case IsImage(filename):
+		for _, res := range []string{"thumbnail", "small", "medium", "large"} {
+			renditionFile := fmt.Sprintf("%s_%s%s", nameWithoutExt, res, ext)
+			renditions = append(renditions, Rendition{res, renditionFile})
+			for _, format := range VariantFormats {
+				if !strings.EqualFold(ext, "."+format) {
+					renditions = append(renditions, Rendition{res + "." + format, VariantName(renditionFile, format)})
+				}
+			}
+		}
+	case IsVideo(filename):
+		renditions = append(renditions, Rendition{"thumbnail", fmt.Sprintf("%s_thumbnail.jpg", nameWithoutExt)})
+		for _, res := range []string{"360p", "480p", "720p", "1080p"} {
+			renditions = append(renditions, Rendition{res, fmt.Sprintf("%s_%s%s", nameWithoutExt, res, ext)})
+		}
+	case IsAudio(filename):
+		for _, quality := range []string{"low", "medium", "high"} {
+			renditions = append(renditions, Rendition{quality, fmt.Sprintf("%s_%s.mp3", nameWithoutExt, quality)})
+		}
+	}
+	return renditions
+}
+
+// RenditionErrors collects the renditions a processor failed to produce.
+// Processors return it alongside the renditions that did succeed.
+type RenditionErrors map[string]error
+
+func (e RenditionErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, 0, len(names))
+	for _, name := range names {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", name, e[name]))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// orNil returns nil when no rendition failed, so callers can compare with nil
+func (e RenditionErrors) orNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// ProfileProcesses reports whether the processing profile generates any
+// rendition for files of fileType ("image", "video", "audio")
+func ProfileProcesses(profile, fileType string) bool {
+	switch profile {
+	case database.ProfileNone:
+		return false
+	case database.ProfileThumbnail:
+		return fileType == "image" || fileType == "video"
+	}
+	return fileType == "image" || fileType == "video" || fileType == "audio"
+}
+
+// ProfileIncludes reports whether the processing profile generates the
+// rendition called name. Variants such as "thumbnail.webp" follow their
+// rendition.
+func ProfileIncludes(profile, name string) bool {
+	name, _, _ = strings.Cut(name, ".")
+	switch profile {
+	case database.ProfileNone:
+		return false
+	case database.ProfileThumbnail:
+		return name == "thumbnail"
+	}
+	return true
+}
+
 // CheckFFmpegInstalled checks if FFmpeg is installed
 func CheckFFmpegInstalled() bool {
 	_, err := exec.LookPath("ffmpeg")
 	return err == nil
 }
 
-// ResizeImage creates multiple resized versions of an image
-func ResizeImage(inputPath, outputDir, baseFilename string) (map[string]string, error) {
-	// Open original image
-	src, err := imaging.Open(inputPath)
+// ResizeImage creates the resized versions of an image selected by the
+// processing profile. It stops between renditions once ctx is cancelled.
+func ResizeImage(ctx context.Context, store storage.Driver, baseFilename, profile string) (map[string]string, error) {
+	// Open original image, upright as its EXIF orientation asks
+	src, err := DecodeStoredImage(store, baseFilename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open image: %w", err)
 	}
@@ -82,10 +310,18 @@ func ResizeImage(inputPath, outputDir, baseFilename string) (map[string]string,
 	}
 
 	resizedFiles := make(map[string]string)
+	failed := make(RenditionErrors)
 	ext := filepath.Ext(baseFilename)
 	nameWithoutExt := strings.TrimSuffix(baseFilename, ext)
 
 	for name, width := range resolutions {
+		if err := ctx.Err(); err != nil {
+			return resizedFiles, err
+		}
+		if !ProfileIncludes(profile, name) {
+			continue
+		}
+
 		// Skip if original is smaller than target resolution
 		bounds := src.Bounds()
 		if bounds.Dx() <= width {
@@ -97,37 +333,47 @@ func ResizeImage(inputPath, outputDir, baseFilename string) (map[string]string,
 
 		// Generate filename
 		resizedFilename := fmt.Sprintf("%s_%s%s", nameWithoutExt, name, ext)
-		resizedPath := filepath.Join(outputDir, resizedFilename)
 
-		// Save based on format
-		if err := saveImage(resized, resizedPath, ext); err != nil {
-			continue // Skip if save fails
+		// Encode based on format and store
+		var buf bytes.Buffer
+		if err := saveImage(resized, &buf, ext); err != nil {
+			failed[name] = fmt.Errorf("failed to encode: %w", err)
+			continue
+		}
+		if _, err := store.Put(resizedFilename, &buf); err != nil {
+			failed[name] = fmt.Errorf("failed to save: %w", err)
+			continue
 		}
 
 		resizedFiles[name] = resizedFilename
+
+		// Modern formats next to the rendition, chosen by ViewFile from the Accept header
+		for _, format := range renditionFormats {
+			if strings.EqualFold(ext, "."+format) || (format == "avif" && !isOpaque(resized)) {
+				// AVIF output would lose the transparency
+				continue
+			}
+			variant := name + "." + format
+			variantFilename := VariantName(resizedFilename, format)
+			var encoded bytes.Buffer
+			if err := EncodeImage(resized, &encoded, format, DefaultImageQuality); err != nil {
+				failed[variant] = fmt.Errorf("failed to encode: %w", err)
+				continue
+			}
+			if _, err := store.Put(variantFilename, &encoded); err != nil {
+				failed[variant] = fmt.Errorf("failed to save: %w", err)
+				continue
+			}
+			resizedFiles[variant] = variantFilename
+		}
 	}
 
-	return resizedFiles, nil
+	return resizedFiles, failed.orNil()
 }
 
-// saveImage saves an image based on its extension
-func saveImage(img image.Image, path, ext string) error {
-	out, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	switch strings.ToLower(ext) {
-	case ".jpg", ".jpeg":
-		return jpeg.Encode(out, img, &jpeg.Options{Quality: 85})
-	case ".png":
-		return png.Encode(out, img)
-	case ".gif":
-		return gif.Encode(out, img, nil)
-	default:
-		return jpeg.Encode(out, img, &jpeg.Options{Quality: 85})
-	}
+// saveImage encodes an image based on its extension
+func saveImage(img image.Image, out io.Writer, ext string) error {
+	return EncodeImage(img, out, ext, DefaultImageQuality)
 }
 
 // GetContentType returns content type based on file extension
@@ -140,6 +386,7 @@ func GetContentType(filename string) string {
 		".png":  "image/png",
 		".gif":  "image/gif",
 		".webp": "image/webp",
+		".avif": "image/avif",
 		".svg":  "image/svg+xml",
 		".pdf":  "application/pdf",
 		".doc":  "application/msword",
@@ -171,31 +418,40 @@ func GetContentType(filename string) string {
 	return "application/octet-stream"
 }
 
-// ProcessVideo creates thumbnail and multiple resolutions for video
-func ProcessVideo(inputPath, outputDir, baseFilename string) (map[string]string, error) {
+// ProcessVideo creates the thumbnail and the resolutions selected by the
+// processing profile for video. Cancelling ctx kills the running ffmpeg process.
+func ProcessVideo(ctx context.Context, store storage.Driver, baseFilename, profile string) (map[string]string, error) {
 	if !CheckFFmpegInstalled() {
 		return nil, fmt.Errorf("ffmpeg not installed")
 	}
 
+	// FFmpeg needs the input on the local filesystem
+	inputPath, cleanup, err := storage.LocalCopy(store, baseFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open video: %w", err)
+	}
+	defer cleanup()
+
 	processedFiles := make(map[string]string)
+	failed := make(RenditionErrors)
 	ext := filepath.Ext(baseFilename)
 	nameWithoutExt := strings.TrimSuffix(baseFilename, ext)
 
 	// Generate thumbnail (frame at 1 second)
 	thumbnailFilename := fmt.Sprintf("%s_thumbnail.jpg", nameWithoutExt)
-	thumbnailPath := filepath.Join(outputDir, thumbnailFilename)
 
-	err := ffmpeg.Input(inputPath, ffmpeg.KwArgs{"ss": "00:00:01"}).
-		Output(thumbnailPath, ffmpeg.KwArgs{
-			"vframes": 1,
-			"vf":      "scale=320:-1",
-		}).
-		OverWriteOutput().
-		ErrorToStdOut().
-		Run()
+	err = renderToStore(store, thumbnailFilename, func(outputPath string) error {
+		return runFFmpeg(ctx, ffmpeg.Input(inputPath, ffmpeg.KwArgs{"ss": "00:00:01"}).
+			Output(outputPath, ffmpeg.KwArgs{
+				"vframes": 1,
+				"vf":      "scale=320:-1",
+			}))
+	})
 
 	if err == nil {
 		processedFiles["thumbnail"] = thumbnailFilename
+	} else {
+		failed["thumbnail"] = err
 	}
 
 	// Generate different resolutions
@@ -207,37 +463,56 @@ func ProcessVideo(inputPath, outputDir, baseFilename string) (map[string]string,
 	}
 
 	for quality, scale := range resolutions {
+		if err := ctx.Err(); err != nil {
+			return processedFiles, err
+		}
+		if !ProfileIncludes(profile, quality) {
+			continue
+		}
+
 		resFilename := fmt.Sprintf("%s_%s%s", nameWithoutExt, quality, ext)
-		resPath := filepath.Join(outputDir, resFilename)
-
-		err := ffmpeg.Input(inputPath).
-			Output(resPath, ffmpeg.KwArgs{
-				"vf":     fmt.Sprintf("scale=%s", scale),
-				"c:v":    "libx264",
-				"crf":    "23",
-				"c:a":    "aac",
-				"b:a":    "128k",
-				"preset": "fast",
-			}).
-			OverWriteOutput().
-			ErrorToStdOut().
-			Run()
+
+		err := renderToStore(store, resFilename, func(outputPath string) error {
+			return runFFmpeg(ctx, ffmpeg.Input(inputPath).
+				Output(outputPath, ffmpeg.KwArgs{
+					"vf":     fmt.Sprintf("scale=%s", scale),
+					"c:v":    "libx264",
+					"crf":    "23",
+					"c:a":    "aac",
+					"b:a":    "128k",
+					"preset": "fast",
+				}))
+		})
 
 		if err == nil {
 			processedFiles[quality] = resFilename
+		} else {
+			failed[quality] = err
 		}
 	}
 
-	return processedFiles, nil
+	if err := ctx.Err(); err != nil {
+		return processedFiles, err
+	}
+	return processedFiles, failed.orNil()
 }
 
-// ProcessAudio creates multiple bitrates for audio
-func ProcessAudio(inputPath, outputDir, baseFilename string) (map[string]string, error) {
+// ProcessAudio creates the bitrates selected by the processing profile for
+// audio. Cancelling ctx kills the running ffmpeg process.
+func ProcessAudio(ctx context.Context, store storage.Driver, baseFilename, profile string) (map[string]string, error) {
 	if !CheckFFmpegInstalled() {
 		return nil, fmt.Errorf("ffmpeg not installed")
 	}
 
+	// FFmpeg needs the input on the local filesystem
+	inputPath, cleanup, err := storage.LocalCopy(store, baseFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audio: %w", err)
+	}
+	defer cleanup()
+
 	processedFiles := make(map[string]string)
+	failed := make(RenditionErrors)
 	ext := filepath.Ext(baseFilename)
 	nameWithoutExt := strings.TrimSuffix(baseFilename, ext)
 
@@ -249,23 +524,57 @@ func ProcessAudio(inputPath, outputDir, baseFilename string) (map[string]string,
 	}
 
 	for quality, bitrate := range bitrates {
+		if err := ctx.Err(); err != nil {
+			return processedFiles, err
+		}
+		if !ProfileIncludes(profile, quality) {
+			continue
+		}
+
 		audioFilename := fmt.Sprintf("%s_%s.mp3", nameWithoutExt, quality)
-		audioPath := filepath.Join(outputDir, audioFilename)
-
-		err := ffmpeg.Input(inputPath).
-			Output(audioPath, ffmpeg.KwArgs{
-				"b:a": bitrate,
-				"c:a": "libmp3lame",
-				"ar":  "44100",
-			}).
-			OverWriteOutput().
-			ErrorToStdOut().
-			Run()
+
+		err := renderToStore(store, audioFilename, func(outputPath string) error {
+			return runFFmpeg(ctx, ffmpeg.Input(inputPath).
+				Output(outputPath, ffmpeg.KwArgs{
+					"b:a": bitrate,
+					"c:a": "libmp3lame",
+					"ar":  "44100",
+				}))
+		})
 
 		if err == nil {
 			processedFiles[quality] = audioFilename
+		} else {
+			failed[quality] = err
 		}
 	}
 
-	return processedFiles, nil
+	if err := ctx.Err(); err != nil {
+		return processedFiles, err
+	}
+	return processedFiles, failed.orNil()
+}
+
+// runFFmpeg runs the ffmpeg command for stream, killing it when ctx is cancelled
+func runFFmpeg(ctx context.Context, stream *ffmpeg.Stream) error {
+	stream.Context = ctx
+	return stream.OverWriteOutput().ErrorToStdOut().Run()
+}
+
+// renderToStore runs render against a temporary output file and uploads
+// the result under key. Partial output never reaches the store.
+func renderToStore(store storage.Driver, key string, render func(outputPath string) error) error {
+	tmpDir, err := os.MkdirTemp("", "render-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	outputPath := filepath.Join(tmpDir, filepath.Base(key))
+	if err := render(outputPath); err != nil {
+		return err
+	}
+
+	_, err = storage.PutFile(store, key, outputPath)
+	return err
 }
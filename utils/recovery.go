@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"errors"
+	"log"
+
+	"object-storage-server/database"
+)
+
+// Recover re-enqueues jobs that were queued or running when the process
+// stopped and then optionally runs Reconcile. It blocks until every job has
+// been handed to the queue, so it is usually started in its own goroutine.
+func (p *WorkerPool) Recover(reconcile bool) {
+	// Jobs were already counted as active by loadPending
+	p.mu.Lock()
+	jobs := p.recovered
+	p.recovered = nil
+	p.mu.Unlock()
+
+	for i, job := range jobs {
+		// Interrupted jobs start over from scratch
+		p.updateJob(job.ID, func(rec *database.JobRecord) {
+			rec.Status = database.JobQueued
+			rec.StartedAt = nil
+		})
+		if err := p.send(job, -1); err != nil {
+			for _, rest := range jobs[i:] {
+				p.release(rest)
+			}
+			log.Printf("[Recovery] Stopped re-enqueueing jobs: %v", err)
+			return
+		}
+	}
+	if len(jobs) > 0 {
+		log.Printf("[Recovery] Re-enqueued %d unfinished jobs", len(jobs))
+	}
+
+	if reconcile {
+		p.Reconcile()
+	}
+}
+
+// Reconcile scans stored originals and enqueues processing for those
+// whose renditions were never produced or have gone missing. It runs while
+// the server already accepts uploads, so originals stored after the pool
+// started are left to the job their upload submits.
+func (p *WorkerPool) Reconcile() {
+	objects, err := p.store.List("")
+	if err != nil {
+		log.Printf("[Reconcile] Failed to list objects: %v", err)
+		return
+	}
+
+	ffmpegInstalled := CheckFFmpegInstalled()
+	enqueued := 0
+
+	for _, obj := range objects {
+		if IsDerivative(obj.Key) || p.HasActiveJob(obj.Key) || obj.ModTime.After(p.started) {
+			continue
+		}
+
+		fileType := GetFileType(obj.Key)
+		switch fileType {
+		case "image":
+		case "video", "audio":
+			if !ffmpegInstalled {
+				continue
+			}
+		default:
+			continue
+		}
+
+		rec, err := p.db.GetObject(obj.Key)
+		if errors.Is(err, database.ErrNotFound) {
+			// Uploaded before the metadata store existed
+			rec = &database.ObjectRecord{
+				FileName:         obj.Key,
+				ContentType:      GetContentType(obj.Key),
+				FileType:         fileType,
+				Size:             obj.Size,
+				UploadedAt:       obj.ModTime,
+				ProcessingStatus: database.ProcessingPending,
+			}
+			if err := p.db.PutObject(rec); err != nil {
+				log.Printf("[Reconcile] Failed to record %s: %v", obj.Key, err)
+				continue
+			}
+		} else if err != nil {
+			log.Printf("[Reconcile] Failed to load metadata for %s: %v", obj.Key, err)
+			continue
+		}
+
+		// The stored object may predate an overwrite that is still in flight
+		if rec.UploadedAt.After(p.started) {
+			continue
+		}
+
+		if !ProfileProcesses(rec.ProcessingProfile, fileType) || !p.needsProcessing(rec) {
+			continue
+		}
+
+		if _, err := p.Submit(Job{Type: fileType, FileName: obj.Key, Profile: rec.ProcessingProfile}); err != nil {
+			log.Printf("[Reconcile] Failed to queue %s: %v", obj.Key, err)
+			continue
+		}
+		enqueued++
+	}
+
+	if enqueued > 0 {
+		log.Printf("[Reconcile] Enqueued processing for %d originals missing renditions", enqueued)
+	}
+}
+
+// needsProcessing reports whether an original is missing its renditions.
+// Failed objects are not retried automatically.
+func (p *WorkerPool) needsProcessing(rec *database.ObjectRecord) bool {
+	switch rec.ProcessingStatus {
+	case database.ProcessingFailed:
+		return false
+	case database.ProcessingCompleted:
+		// Renditions recorded as produced must still exist
+		for _, renditionFile := range rec.Renditions {
+			if _, err := p.store.Stat(renditionFile); err != nil {
+				return true
+			}
+		}
+		return false
+	default:
+		// Never processed, or the job was lost before it was persisted
+		return true
+	}
+}
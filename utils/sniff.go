@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// SniffLength is the number of leading bytes DetectContentType looks at
+const SniffLength = 512
+
+// asfHeader is the GUID starting ASF containers (.wmv, .wma)
+var asfHeader = []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11, 0xA6, 0xD9, 0x00, 0xAA, 0x00, 0x62, 0xCE, 0x6C}
+
+// DetectContentType determines the MIME type of content from its first
+// bytes. On top of the types known to net/http it recognises the media
+// containers the processors accept. Unknown content is
+// "application/octet-stream".
+func DetectContentType(header []byte) string {
+	switch {
+	case len(header) >= 12 && string(header[4:8]) == "ftyp":
+		switch string(header[8:12]) {
+		case "avif", "avis":
+			return "image/avif"
+		case "qt  ":
+			return "video/quicktime"
+		case "M4A ", "M4B ", "M4P ":
+			return "audio/mp4"
+		case "M4V ", "M4VH", "M4VP":
+			return "video/x-m4v"
+		}
+		return "video/mp4"
+	case bytes.HasPrefix(header, []byte("\x1A\x45\xDF\xA3")):
+		if bytes.Contains(header[:min(len(header), 64)], []byte("matroska")) {
+			return "video/x-matroska"
+		}
+		return "video/webm"
+	case bytes.HasPrefix(header, []byte("OggS")):
+		if bytes.Contains(header, []byte("\x80theora")) {
+			return "video/ogg"
+		}
+		return "audio/ogg"
+	case bytes.HasPrefix(header, []byte("FLV\x01")):
+		return "video/x-flv"
+	case bytes.HasPrefix(header, asfHeader):
+		return "video/x-ms-asf"
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return "audio/flac"
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xF6 == 0xF0:
+		// ADTS frame: sync word and MPEG layer 0
+		return "audio/aac"
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0:
+		// MPEG audio frame without ID3 tag
+		return "audio/mpeg"
+	}
+
+	detected := http.DetectContentType(header)
+	switch detected {
+	case "video/avi":
+		return "video/x-msvideo"
+	case "audio/wave":
+		return "audio/wav"
+	}
+	return detected
+}
+
+// MatchesContent reports whether content of the detected type may be
+// stored under filename. Names with an image extension need image content;
+// video and audio extensions need audio or video content, as their
+// containers are shared (an .mp4 may hold only audio). Other extensions
+// accept anything.
+func MatchesContent(filename, detected string) bool {
+	switch GetFileType(filename) {
+	case "image":
+		return strings.HasPrefix(detected, "image/") && detected != "image/svg+xml"
+	case "video", "audio":
+		return strings.HasPrefix(detected, "video/") || strings.HasPrefix(detected, "audio/")
+	}
+	return true
+}
+
+// ExtensionForType returns the file extension for a type returned by
+// DetectContentType, ".bin" for unknown content
+func ExtensionForType(detected string) string {
+	mediaType, _, _ := strings.Cut(detected, ";")
+
+	extensions := map[string]string{
+		"image/jpeg":                   ".jpg",
+		"image/png":                    ".png",
+		"image/gif":                    ".gif",
+		"image/webp":                   ".webp",
+		"image/avif":                   ".avif",
+		"image/bmp":                    ".bmp",
+		"image/x-icon":                 ".ico",
+		"video/mp4":                    ".mp4",
+		"video/quicktime":              ".mov",
+		"video/x-m4v":                  ".m4v",
+		"video/x-matroska":             ".mkv",
+		"video/webm":                   ".webm",
+		"video/ogg":                    ".ogv",
+		"video/x-flv":                  ".flv",
+		"video/x-ms-asf":               ".wmv",
+		"video/x-msvideo":              ".avi",
+		"audio/mp4":                    ".m4a",
+		"audio/mpeg":                   ".mp3",
+		"audio/aac":                    ".aac",
+		"audio/flac":                   ".flac",
+		"audio/ogg":                    ".ogg",
+		"audio/wav":                    ".wav",
+		"audio/aiff":                   ".aiff",
+		"audio/midi":                   ".mid",
+		"application/pdf":              ".pdf",
+		"application/zip":              ".zip",
+		"application/x-gzip":           ".gz",
+		"application/x-rar-compressed": ".rar",
+		"text/plain":                   ".txt",
+		"text/html":                    ".html",
+		"text/xml":                     ".xml",
+	}
+
+	if ext, exists := extensions[mediaType]; exists {
+		return ext
+	}
+	return ".bin"
+}
+
+// CheckFFprobeInstalled checks if ffprobe is installed
+func CheckFFprobeInstalled() bool {
+	_, err := exec.LookPath("ffprobe")
+	return err == nil
+}
+
+// ProbeMediaType refines the type DetectContentType found for the media
+// file at path with ffprobe: containers without a video stream (cover art
+// aside) are audio, containers with one are video. It fails when ffprobe
+// cannot read any stream.
+func ProbeMediaType(path, detected string) (string, error) {
+	output, err := ffmpeg.Probe(path)
+	if err != nil {
+		return "", err
+	}
+	var probe struct {
+		Streams []struct {
+			CodecType   string `json:"codec_type"`
+			Disposition struct {
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal([]byte(output), &probe); err != nil {
+		return "", err
+	}
+
+	hasVideo, hasAudio := false, false
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			hasVideo = hasVideo || stream.Disposition.AttachedPic == 0
+		case "audio":
+			hasAudio = true
+		}
+	}
+
+	// Same container, the other kind of stream
+	counterparts := map[string]string{
+		"video/mp4":        "audio/mp4",
+		"video/x-m4v":      "audio/mp4",
+		"video/x-matroska": "audio/x-matroska",
+		"video/webm":       "audio/webm",
+		"video/ogg":        "audio/ogg",
+		"video/x-ms-asf":   "audio/x-ms-wma",
+		"audio/mp4":        "video/mp4",
+		"audio/ogg":        "video/ogg",
+	}
+	if !hasVideo && !hasAudio {
+		return "", errors.New("no audio or video stream found")
+	}
+	if hasVideo == strings.HasPrefix(detected, "audio/") {
+		if counterpart, ok := counterparts[detected]; ok {
+			return counterpart, nil
+		}
+	}
+	return detected, nil
+}
+
+// MediaDuration returns the duration of the audio or video file at path,
+// as reported by ffprobe
+func MediaDuration(path string) (time.Duration, error) {
+	output, err := ffmpeg.Probe(path)
+	if err != nil {
+		return 0, err
+	}
+	var probe struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal([]byte(output), &probe); err != nil {
+		return 0, err
+	}
+	seconds, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil {
+		return 0, errors.New("ffprobe reported no duration")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"strings"
+
+	"object-storage-server/storage"
+
+	"github.com/disintegration/imaging"
+)
+
+// Fit modes of ImageTransform
+const (
+	FitContain = "contain" // Fit inside the box, keeping the aspect ratio
+	FitCover   = "cover"   // Fill the box, cropping the overflow around the center
+	FitFill    = "fill"    // Stretch to the box
+)
+
+// DefaultImageQuality is the JPEG quality used when none is asked for
+const DefaultImageQuality = 85
+
+// ImageTransform describes a resize and re-encode of an image
+type ImageTransform struct {
+	Width   int    // Pixels, 0 to follow Height keeping the aspect ratio
+	Height  int    // Pixels, 0 to follow Width keeping the aspect ratio
+	Fit     string // FitContain, FitCover or FitFill; the latter two need both sides
+	Quality int    // JPEG, WebP and AVIF quality, 1-100
+	Format  string // Output extension: "jpg", "png", "gif", "webp" or "avif"
+}
+
+// Canonical returns the transform as a query string with a fixed field
+// order, identifying it in cache keys and signatures
+func (t ImageTransform) Canonical() string {
+	return fmt.Sprintf("w=%d&h=%d&fit=%s&q=%d&fmt=%s", t.Width, t.Height, t.Fit, t.Quality, t.Format)
+}
+
+// ContentType returns the MIME type of the transform's output
+func (t ImageTransform) ContentType() string {
+	return GetContentType("." + t.Format)
+}
+
+// Apply resizes img according to the transform. The result is never
+// larger than img, nor than maxDimension on either side: with a single
+// side the derived one is bounded too, and boxes larger than img are
+// scaled down keeping their aspect ratio. FitContain never enlarges.
+func (t ImageTransform) Apply(img image.Image, maxDimension int) image.Image {
+	if t.Width == 0 && t.Height == 0 {
+		return img
+	}
+	if t.Fit == FitContain && t.Width != 0 && t.Height != 0 {
+		return imaging.Fit(img, t.Width, t.Height, imaging.Lanczos)
+	}
+
+	srcWidth, srcHeight := img.Bounds().Dx(), img.Bounds().Dy()
+	if srcWidth == 0 || srcHeight == 0 {
+		return img
+	}
+	width, height := float64(t.Width), float64(t.Height)
+	if width == 0 {
+		width = height * float64(srcWidth) / float64(srcHeight)
+	} else if height == 0 {
+		height = width * float64(srcHeight) / float64(srcWidth)
+	}
+	scale := min(1, float64(srcWidth)/width, float64(srcHeight)/height,
+		float64(maxDimension)/width, float64(maxDimension)/height)
+	w := max(1, int(math.Round(width*scale)))
+	h := max(1, int(math.Round(height*scale)))
+
+	if t.Fit == FitCover {
+		return imaging.Fill(img, w, h, imaging.Center, imaging.Lanczos)
+	}
+	return imaging.Resize(img, w, h, imaging.Lanczos)
+}
+
+// ImageFormat returns the output format ImageTransform uses for an
+// extension, "jpg" for images that cannot be encoded as such. WebP falls
+// back to lossless PNG when it cannot be encoded.
+func ImageFormat(ext string) string {
+	switch strings.ToLower(strings.TrimPrefix(ext, ".")) {
+	case "png":
+		return "png"
+	case "gif":
+		return "gif"
+	case "webp":
+		if CanEncodeImage("webp") {
+			return "webp"
+		}
+		return "png"
+	}
+	return "jpg"
+}
+
+// EncodeImage encodes img in the format of ext, JPEG for unknown
+// extensions. WebP and AVIF are encoded with ffmpeg and fail when
+// CanEncodeImage reports them unavailable.
+func EncodeImage(img image.Image, out io.Writer, ext string, quality int) error {
+	switch format := strings.ToLower(strings.TrimPrefix(ext, ".")); format {
+	case "png":
+		return png.Encode(out, img)
+	case "gif":
+		return gif.Encode(out, img, nil)
+	case "webp", "avif":
+		return encodeWithFFmpeg(img, out, format, quality)
+	default:
+		return jpeg.Encode(out, img, &jpeg.Options{Quality: quality})
+	}
+}
+
+// TransformStoredImage decodes the image stored under key, applies t
+// bounded by maxDimension and writes the result to out. Like renditions,
+// the result is upright.
+func TransformStoredImage(store storage.Driver, key string, t ImageTransform, maxDimension int, out io.Writer) error {
+	img, err := DecodeStoredImage(store, key)
+	if err != nil {
+		return err
+	}
+	return EncodeImage(t.Apply(img, maxDimension), out, t.Format, t.Quality)
+}
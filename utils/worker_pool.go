@@ -1,41 +1,110 @@
 package utils
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"sync"
+	"time"
+
+	"object-storage-server/database"
+	"object-storage-server/storage"
+
+	"github.com/google/uuid"
 )
 
 // Job represents a processing job
 type Job struct {
-	Type      string // "image", "video", "audio"
-	FilePath  string
-	UploadDir string
-	FileName  string
+	ID       string // Assigned by Submit when empty
+	Type     string // "image", "video", "audio"
+	FileName string // Object key of the original in storage
+	Profile  string // Processing profile, empty for database.ProfileFull
 }
 
+// ErrQueueFull is returned when no queue slot became free in time
+var ErrQueueFull = errors.New("job queue is full")
+
+// ErrPoolClosed is returned when submitting to a pool that is shutting down
+var ErrPoolClosed = errors.New("worker pool is shut down")
+
 // WorkerPool manages concurrent processing jobs
 type WorkerPool struct {
+	store       storage.Driver
+	db          *database.DB
 	jobQueue    chan Job
 	workerCount int
 	wg          sync.WaitGroup
+	ctx         context.Context // Cancelled when the shutdown deadline passes
+	cancel      context.CancelFunc
+	started     time.Time // Objects stored later are submitted by their upload, not Reconcile
+
+	mu        sync.Mutex
+	active    map[string]map[string]bool // IDs of the queued, deferred or running jobs per file
+	running   map[string]string          // ID of the job running for each file
+	cancelled map[string]bool            // IDs of jobs that must be skipped or discarded
+	deferred  int                        // Jobs waiting in the store for a queue slot
+	recovered []Job                      // Unfinished jobs found on startup, enqueued by Recover
+
+	sendMu       sync.RWMutex // Held by senders, taken exclusively to close the queue
+	closed       bool
+	quit         chan struct{}
+	wake         chan struct{}
+	dispatcherWg sync.WaitGroup
 }
 
-// NewWorkerPool creates a new worker pool
-func NewWorkerPool(workerCount int, queueSize int) *WorkerPool {
+// NewWorkerPool creates a new worker pool that processes objects in store
+// and records processing results in db
+func NewWorkerPool(store storage.Driver, db *database.DB, workerCount int, queueSize int) *WorkerPool {
+	ctx, cancel := context.WithCancel(context.Background())
 	pool := &WorkerPool{
+		store:       store,
+		db:          db,
 		jobQueue:    make(chan Job, queueSize),
 		workerCount: workerCount,
+		ctx:         ctx,
+		cancel:      cancel,
+		started:     time.Now(),
+		active:      make(map[string]map[string]bool),
+		running:     make(map[string]string),
+		cancelled:   make(map[string]bool),
+		quit:        make(chan struct{}),
+		wake:        make(chan struct{}, 1),
 	}
+	pool.loadPending()
 	pool.start()
 	return pool
 }
 
-// start initializes workers
+// loadPending counts jobs persisted by a previous run as active before any
+// worker starts, so their bookkeeping is in place when they are dispatched
+func (p *WorkerPool) loadPending() {
+	jobs, err := p.db.ListJobs(database.JobQueued, database.JobRunning, database.JobDeferred)
+	if err != nil {
+		log.Printf("[Recovery] Failed to load pending jobs: %v", err)
+		return
+	}
+
+	for _, rec := range jobs {
+		job := Job{ID: rec.ID, Type: rec.Type, FileName: rec.FileName, Profile: rec.Profile}
+		p.markActive(job)
+		if rec.Status == database.JobDeferred {
+			p.deferred++
+		} else {
+			p.recovered = append(p.recovered, job)
+		}
+	}
+}
+
+// start initializes workers and the deferred job dispatcher
 func (p *WorkerPool) start() {
 	for i := 0; i < p.workerCount; i++ {
 		p.wg.Add(1)
 		go p.worker(i)
 	}
+
+	p.dispatcherWg.Add(1)
+	go p.dispatcher()
 }
 
 // worker processes jobs from the queue
@@ -43,57 +112,556 @@ func (p *WorkerPool) worker(id int) {
 	defer p.wg.Done()
 
 	for job := range p.jobQueue {
+		// Past the shutdown deadline, leave the job queued for the next start
+		if p.ctx.Err() != nil {
+			p.release(job)
+			continue
+		}
+
+		if p.isCancelled(job.ID) {
+			log.Printf("[Worker %d] Skipping cancelled %s job: %s", id, job.Type, job.FileName)
+			p.updateJob(job.ID, func(rec *database.JobRecord) {
+				rec.Status = database.JobCancelled
+			})
+			p.finish(job)
+			continue
+		}
+
+		// Jobs for the same file run one after the other, so the output of
+		// a superseded job never mixes with that of its replacement
+		if !p.startRunning(job) {
+			p.postpone(job)
+			continue
+		}
+
 		log.Printf("[Worker %d] Processing %s: %s", id, job.Type, job.FileName)
+		p.updateJob(job.ID, func(rec *database.JobRecord) {
+			now := time.Now()
+			rec.Status = database.JobRunning
+			rec.StartedAt = &now
+		})
 
-		switch job.Type {
-		case "image":
-			_, err := ResizeImage(job.FilePath, job.UploadDir, job.FileName)
-			if err != nil {
-				log.Printf("[Worker %d] Image processing error: %v", id, err)
-			} else {
-				log.Printf("[Worker %d] Image processed successfully: %s", id, job.FileName)
-			}
+		results, err := p.process(job)
+		if errors.Is(err, context.Canceled) && p.ctx.Err() != nil {
+			p.checkpoint(id, job, results)
+			continue
+		}
+		if err != nil {
+			log.Printf("[Worker %d] %s processing error: %v", id, job.Type, err)
+		} else {
+			log.Printf("[Worker %d] %s processed successfully: %s", id, job.Type, job.FileName)
+		}
 
-		case "video":
-			_, err := ProcessVideo(job.FilePath, job.UploadDir, job.FileName)
-			if err != nil {
-				log.Printf("[Worker %d] Video processing error: %v", id, err)
-			} else {
-				log.Printf("[Worker %d] Video processed successfully: %s", id, job.FileName)
+		// The original was deleted or replaced while processing, drop what was produced
+		if p.isCancelled(job.ID) {
+			for _, fileName := range results {
+				p.store.Delete(fileName)
 			}
+			log.Printf("[Worker %d] Discarded output of cancelled job: %s", id, job.FileName)
+			p.updateJob(job.ID, func(rec *database.JobRecord) {
+				rec.Status = database.JobCancelled
+			})
+		} else {
+			RecordProcessingResult(p.db, job.FileName, results, err)
+			p.updateJob(job.ID, func(rec *database.JobRecord) {
+				rec.Renditions = renditionResults(job.FileName, results, err)
+				if processingFailed(results, err) {
+					rec.Status = database.JobFailed
+				} else {
+					rec.Status = database.JobSucceeded
+				}
+				if err != nil {
+					rec.Error = err.Error()
+				}
+			})
+		}
 
-		case "audio":
-			_, err := ProcessAudio(job.FilePath, job.UploadDir, job.FileName)
-			if err != nil {
-				log.Printf("[Worker %d] Audio processing error: %v", id, err)
-			} else {
-				log.Printf("[Worker %d] Audio processed successfully: %s", id, job.FileName)
-			}
+		p.finish(job)
+	}
+}
+
+// checkpoint puts a job interrupted by shutdown back in the queued state
+// and removes its partial output, so it is redone from scratch on the next start
+func (p *WorkerPool) checkpoint(workerID int, job Job, results map[string]string) {
+	for _, fileName := range results {
+		p.store.Delete(fileName)
+	}
+	p.updateJob(job.ID, func(rec *database.JobRecord) {
+		rec.Status = database.JobQueued
+		rec.StartedAt = nil
+	})
+	p.release(job)
+	log.Printf("[Worker %d] Interrupted %s job, re-queued for next start: %s", workerID, job.Type, job.FileName)
+}
+
+// process runs the processor matching the job type
+func (p *WorkerPool) process(job Job) (map[string]string, error) {
+	switch job.Type {
+	case "image":
+		return ResizeImage(p.ctx, p.store, job.FileName, job.Profile)
+	case "video":
+		return ProcessVideo(p.ctx, p.store, job.FileName, job.Profile)
+	case "audio":
+		return ProcessAudio(p.ctx, p.store, job.FileName, job.Profile)
+	default:
+		return nil, fmt.Errorf("unknown job type %q", job.Type)
+	}
+}
+
+// RecordProcessingResult stores the renditions and outcome of processing
+// fileName in its metadata record. Files without a record are ignored.
+func RecordProcessingResult(db *database.DB, fileName string, results map[string]string, procErr error) {
+	err := db.UpdateObject(fileName, func(rec *database.ObjectRecord) error {
+		if rec.Renditions == nil {
+			rec.Renditions = make(map[string]string)
+		}
+		for name, renditionFile := range results {
+			rec.Renditions[name] = renditionFile
+		}
+
+		now := time.Now()
+		rec.ProcessedAt = &now
+		if processingFailed(results, procErr) {
+			rec.ProcessingStatus = database.ProcessingFailed
+		} else {
+			rec.ProcessingStatus = database.ProcessingCompleted
+		}
+		rec.ProcessingError = ""
+		if procErr != nil {
+			rec.ProcessingError = procErr.Error()
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		log.Printf("Failed to record processing result for %s: %v", fileName, err)
+	}
+}
+
+// processingFailed reports whether a processor run produced nothing usable.
+// Runs where only some renditions failed still count as successful.
+func processingFailed(results map[string]string, err error) bool {
+	if err == nil {
+		return false
+	}
+	var partial RenditionErrors
+	return !errors.As(err, &partial) || len(results) == 0
+}
+
+// renditionResults lists the outcome of every expected rendition of fileName
+func renditionResults(fileName string, results map[string]string, err error) []database.JobRendition {
+	var failed RenditionErrors
+	errors.As(err, &failed)
+
+	renditions := make([]database.JobRendition, 0, len(results))
+	for _, rendition := range GetRenditions(fileName) {
+		result := database.JobRendition{Name: rendition.Name, FileName: rendition.FileName}
+		if produced, ok := results[rendition.Name]; ok {
+			result.FileName = produced
+			result.Status = database.RenditionSucceeded
+		} else if renditionErr, ok := failed[rendition.Name]; ok {
+			result.Status = database.RenditionFailed
+			result.Error = renditionErr.Error()
+		} else {
+			// e.g. image renditions wider than the original
+			result.Status = database.RenditionSkipped
+		}
+		renditions = append(renditions, result)
+	}
+	return renditions
+}
+
+// updateJob applies fn to the job record, stamping the finish time
+// once the job reaches a final state
+func (p *WorkerPool) updateJob(jobID string, fn func(rec *database.JobRecord)) {
+	err := p.db.UpdateJob(jobID, func(rec *database.JobRecord) error {
+		fn(rec)
+		switch rec.Status {
+		case database.JobSucceeded, database.JobFailed, database.JobCancelled:
+			now := time.Now()
+			rec.FinishedAt = &now
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to update job %s: %v", jobID, err)
+	}
+}
+
+// RunRetention periodically removes finished job records older than
+// retention, until stop is closed
+func (p *WorkerPool) RunRetention(retention time.Duration, stop <-chan struct{}) {
+	interval := retention / 2
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.pruneJobs(retention)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.pruneJobs(retention)
 		}
 	}
 }
 
-// Submit adds a job to the queue
-func (p *WorkerPool) Submit(job Job) {
-	p.jobQueue <- job
+// pruneJobs removes job records that finished more than retention ago
+func (p *WorkerPool) pruneJobs(retention time.Duration) {
+	removed, err := p.db.DeleteFinishedJobs(time.Now().Add(-retention))
+	if err != nil {
+		log.Printf("[Jobs] Failed to remove finished jobs: %v", err)
+		return
+	}
+	if removed > 0 {
+		log.Printf("[Jobs] Removed %d finished jobs older than %s", removed, retention)
+	}
+}
+
+// Submit persists the job as queued and adds it to the queue, waiting as
+// long as needed for a free slot. The job is only acknowledged once it is
+// on disk, so it survives a restart. It returns the job ID that can be used
+// to query its status.
+func (p *WorkerPool) Submit(job Job) (string, error) {
+	return p.SubmitTimeout(job, -1)
+}
+
+// TrySubmit is like Submit but fails with ErrQueueFull instead of waiting
+func (p *WorkerPool) TrySubmit(job Job) (string, error) {
+	return p.SubmitTimeout(job, 0)
+}
+
+// SubmitTimeout is like Submit but waits at most timeout for a free slot.
+// A zero timeout does not wait and a negative timeout waits indefinitely.
+// When no slot frees up in time the job is dropped and ErrQueueFull is returned.
+func (p *WorkerPool) SubmitTimeout(job Job, timeout time.Duration) (string, error) {
+	job, err := p.persist(job, database.JobQueued)
+	if err != nil {
+		return "", err
+	}
+
+	p.markActive(job)
+	if err := p.send(job, timeout); err != nil {
+		p.release(job)
+		if delErr := p.db.DeleteJob(job.ID); delErr != nil {
+			log.Printf("Failed to remove rejected job %s: %v", job.ID, delErr)
+		}
+		return "", err
+	}
+
+	p.linkJob(job)
+	return job.ID, nil
+}
+
+// WaitForRoom reports whether the queue has a free slot, waiting up to
+// timeout for one. The slot is not reserved, so a following Submit may
+// still find the queue full. Without a queue buffer there is nothing to
+// check and it always reports true.
+func (p *WorkerPool) WaitForRoom(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if cap(p.jobQueue) == 0 || len(p.jobQueue) < cap(p.jobQueue) {
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
 }
 
-// Shutdown gracefully stops the worker pool
-func (p *WorkerPool) Shutdown() {
+// Defer persists the job as deferred without taking a queue slot.
+// The dispatcher enqueues deferred jobs in order as soon as the queue has room.
+func (p *WorkerPool) Defer(job Job) (string, error) {
+	job, err := p.persist(job, database.JobDeferred)
+	if err != nil {
+		return "", err
+	}
+
+	p.markActive(job)
+	p.mu.Lock()
+	p.deferred++
+	p.mu.Unlock()
+
+	p.linkJob(job)
+	p.wakeDispatcher()
+	return job.ID, nil
+}
+
+// persist assigns an ID to the job and stores it with the given status
+func (p *WorkerPool) persist(job Job, status string) (Job, error) {
+	if job.ID == "" {
+		job.ID = uuid.Must(uuid.NewV7()).String()
+	}
+
+	err := p.db.PutJob(&database.JobRecord{
+		ID:       job.ID,
+		Type:     job.Type,
+		FileName: job.FileName,
+		Profile:  job.Profile,
+		Status:   status,
+		QueuedAt: time.Now(),
+	})
+	if err != nil {
+		return job, fmt.Errorf("failed to persist job: %w", err)
+	}
+	return job, nil
+}
+
+// linkJob stores the job ID in the metadata record of the job's file
+func (p *WorkerPool) linkJob(job Job) {
+	err := p.db.UpdateObject(job.FileName, func(rec *database.ObjectRecord) error {
+		rec.JobID = job.ID
+		return nil
+	})
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		log.Printf("Failed to link job %s to %s: %v", job.ID, job.FileName, err)
+	}
+}
+
+// send hands an already active job to the workers, waiting up to timeout
+// for a free slot. A negative timeout waits until the pool shuts down.
+func (p *WorkerPool) send(job Job, timeout time.Duration) error {
+	p.sendMu.RLock()
+	defer p.sendMu.RUnlock()
+
+	if p.closed {
+		return ErrPoolClosed
+	}
+
+	// Fast path, also the only attempt when timeout is zero
+	select {
+	case p.jobQueue <- job:
+		return nil
+	default:
+	}
+	if timeout == 0 {
+		return ErrQueueFull
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case p.jobQueue <- job:
+		return nil
+	case <-expired:
+		return ErrQueueFull
+	case <-p.quit:
+		return ErrPoolClosed
+	}
+}
+
+// dispatcher moves deferred jobs into the queue when slots free up
+func (p *WorkerPool) dispatcher() {
+	defer p.dispatcherWg.Done()
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+		p.dispatchDeferred()
+	}
+}
+
+// dispatchDeferred enqueues deferred jobs oldest first until the queue is full
+func (p *WorkerPool) dispatchDeferred() {
+	p.mu.Lock()
+	pending := p.deferred
+	p.mu.Unlock()
+	if pending == 0 {
+		return
+	}
+
+	jobs, err := p.db.ListJobs(database.JobDeferred)
+	if err != nil {
+		log.Printf("Failed to load deferred jobs: %v", err)
+		return
+	}
+
+	for _, rec := range jobs {
+		job := Job{ID: rec.ID, Type: rec.Type, FileName: rec.FileName, Profile: rec.Profile}
+
+		// Mark queued before sending so a fast worker's update is not overwritten
+		p.updateJob(job.ID, func(rec *database.JobRecord) {
+			rec.Status = database.JobQueued
+		})
+		if err := p.send(job, 0); err != nil {
+			p.updateJob(job.ID, func(rec *database.JobRecord) {
+				rec.Status = database.JobDeferred
+			})
+			return
+		}
+
+		p.mu.Lock()
+		p.deferred--
+		p.mu.Unlock()
+	}
+}
+
+// wakeDispatcher asks the dispatcher to look for deferred jobs
+func (p *WorkerPool) wakeDispatcher() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// markActive records a queued, deferred or running job
+func (p *WorkerPool) markActive(job Job) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.active[job.FileName] == nil {
+		p.active[job.FileName] = make(map[string]bool)
+	}
+	p.active[job.FileName][job.ID] = true
+}
+
+// HasActiveJob reports whether fileName has a queued, deferred or running job
+func (p *WorkerPool) HasActiveJob(fileName string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.active[fileName]) > 0
+}
+
+// Cancel marks the jobs currently queued, deferred or running for fileName
+// as cancelled. Queued jobs are skipped and output of running jobs is
+// discarded; jobs submitted afterwards, e.g. for an object that replaced
+// fileName, are not affected. It reports whether there was any job to cancel.
+func (p *WorkerPool) Cancel(fileName string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for jobID := range p.active[fileName] {
+		p.cancelled[jobID] = true
+	}
+	return len(p.active[fileName]) > 0
+}
+
+// isCancelled reports whether the job has been cancelled
+func (p *WorkerPool) isCancelled(jobID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cancelled[jobID]
+}
+
+// startRunning marks the job as running unless another job for the same
+// file is running already
+func (p *WorkerPool) startRunning(job Job) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, busy := p.running[job.FileName]; busy {
+		return false
+	}
+	p.running[job.FileName] = job.ID
+	return true
+}
+
+// postpone defers a job whose file is busy with another job. The
+// dispatcher enqueues it again once a job has finished.
+func (p *WorkerPool) postpone(job Job) {
+	p.updateJob(job.ID, func(rec *database.JobRecord) {
+		rec.Status = database.JobDeferred
+	})
+	p.mu.Lock()
+	p.deferred++
+	p.mu.Unlock()
+}
+
+// finish releases the bookkeeping for a completed job and
+// lets the dispatcher fill the freed queue slot
+func (p *WorkerPool) finish(job Job) {
+	p.release(job)
+	p.wakeDispatcher()
+}
+
+// release drops the bookkeeping of a job that left the pool
+func (p *WorkerPool) release(job Job) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.active[job.FileName], job.ID)
+	if len(p.active[job.FileName]) == 0 {
+		delete(p.active, job.FileName)
+	}
+	if p.running[job.FileName] == job.ID {
+		delete(p.running, job.FileName)
+	}
+	delete(p.cancelled, job.ID)
+}
+
+// Shutdown gracefully stops the worker pool. New submissions are refused
+// and workers keep draining the queue for up to timeout. After that, running
+// jobs are interrupted and, like jobs still in the queue, left queued in the
+// store to be resumed on the next start. It reports whether the queue was
+// fully drained.
+func (p *WorkerPool) Shutdown(timeout time.Duration) bool {
+	// Stop the dispatcher and release blocked senders before closing the queue
+	close(p.quit)
+	p.dispatcherWg.Wait()
+
+	p.sendMu.Lock()
+	p.closed = true
 	close(p.jobQueue)
-	p.wg.Wait()
+	p.sendMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	drained := true
+	select {
+	case <-done:
+	case <-timer.C:
+		drained = false
+		log.Printf("[Shutdown] Job drain timeout of %s reached, interrupting running jobs", timeout)
+		p.cancel()
+		<-done
+	}
+	p.cancel()
+	return drained
 }
 
 // Global worker pool instance
 var globalWorkerPool *WorkerPool
 var once sync.Once
 
-// GetWorkerPool returns the global worker pool instance (singleton)
-func GetWorkerPool() *WorkerPool {
+// InitWorkerPool creates the global worker pool on top of store and db.
+// workerCount is the max number of concurrent processing jobs and queueSize
+// how many more may wait in the queue.
+// Only the first call has an effect; later calls return the existing pool.
+func InitWorkerPool(store storage.Driver, db *database.DB, workerCount, queueSize int) *WorkerPool {
 	once.Do(func() {
-		// Initialize with 4 workers and queue size of 100
-		// This means max 4 concurrent processing jobs, with up to 100 waiting in queue
-		globalWorkerPool = NewWorkerPool(4, 100)
+		globalWorkerPool = NewWorkerPool(store, db, workerCount, queueSize)
 	})
 	return globalWorkerPool
 }
+
+// GetWorkerPool returns the global worker pool instance (singleton).
+// InitWorkerPool must have been called first.
+func GetWorkerPool() *WorkerPool {
+	return globalWorkerPool
+}